@@ -2,15 +2,24 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"math/rand"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/iot-bp-project-2018/raspi-server/internal/command"
 	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+	"github.com/iot-bp-project-2018/raspi-server/internal/deviceconfig"
 	"github.com/iot-bp-project-2018/raspi-server/internal/mqttclient"
+	"github.com/iot-bp-project-2018/raspi-server/internal/provisioning"
+	"github.com/iot-bp-project-2018/raspi-server/internal/sensorpayload"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -21,11 +30,33 @@ var (
 
 	receiverFlag = flag.String("receiver", "kronos", "host address to which the data should be sent")
 
+	enrollFlag              = flag.String("enroll", "", "provision this host with the given `address` and write the resulting configuration to the -config file")
+	bootstrapKeyFlag        = flag.String("bootstrap-key", "", "bootstrap key shown by the server when provisioning (hexadecimal notation)")
+	bootstrapPassphraseFlag = flag.String("bootstrap-passphrase", "", "bootstrap passphrase shown by the server when provisioning")
+
 	brightnessFlag  = flag.Bool("brightness", false, "report brightness data")
 	temperatureFlag = flag.Bool("temperature", false, "report temperature data")
 	humidityFlag    = flag.Bool("humidity", false, "report humidity data")
+
+	encodingFlag = flag.String("encoding", "json", "payload encoding (json or tlv)")
+	batchFlag    = flag.Int("batch", 1, "number of measurement rounds to buffer before sending them in one batch")
+
+	childrenFlag = flag.String("children", "", "act as gateway and report on behalf of the given comma separated child device `ids`")
 )
 
+const defaultInterval = 10 * time.Second
+
+// interval is the reporting interval in nanoseconds, which the server can
+// change with a command or the device configuration.
+var interval = int64(defaultInterval)
+
+// configs holds the configuration pushed by the server for this host (empty
+// id) and its child devices.
+var configs struct {
+	sync.Mutex
+	devices map[string]deviceconfig.Config
+}
+
 func init() {
 	rand.Seed(time.Now().Unix())
 }
@@ -44,26 +75,60 @@ func main() {
 		return
 	}
 
+	contentType, ok := map[string]string{"json": commproto.ContentTypeJSON, "tlv": sensorpayload.ContentTypeTLV}[*encodingFlag]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "unknown encoding, please use json or tlv")
+		return
+	}
+
 	if *verboseFlag {
 		log.SetLevel(log.DebugLevel)
 	}
 
+	ps := mqttclient.NewMQTTClientWithServer(*mqttFlag)
+
+	if *enrollFlag != "" {
+		if err := enroll(ps); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
+
 	config, err := commproto.ParseConfiguration(*configFlag)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return
 	}
 
-	ps := mqttclient.NewMQTTClientWithServer(*mqttFlag)
 	client := commproto.NewClient(config, ps)
+	client.RegisterHandler(commproto.MessageCommand, func(message commproto.Message) {
+		handleCommand(client, message)
+	})
+	client.RegisterHandler(commproto.MessageConfig, func(message commproto.Message) {
+		handleConfig(client, message)
+	})
 	client.Start()
 
+	if *batchFlag < 1 {
+		fmt.Fprintln(os.Stderr, "batch size must be positive")
+		return
+	}
+
 	brightness := 100.0 * rand.Float64()
 	temperature := 15.0 + 10.0*rand.Float64()
 	humidity := 40.0 + 40.0*rand.Float64()
 
+	// The empty device id stands for this host itself.
+	devices := []string{""}
+	if *childrenFlag != "" {
+		devices = strings.Split(*childrenFlag, ",")
+	}
+
+	var readings []sensorpayload.Reading
+	rounds := 0
+
 	for {
-		time.Sleep(10 * time.Second)
+		time.Sleep(time.Duration(atomic.LoadInt64(&interval)))
 
 		brightness += 5.0 * rand.NormFloat64()
 		temperature += 0.5 * rand.NormFloat64()
@@ -87,45 +152,136 @@ func main() {
 			humidity = 100.0
 		}
 
-		if *brightnessFlag {
-			measure(client, "brightness", brightness, "%")
-		}
+		now := time.Now().UnixNano()
 
-		if *temperatureFlag {
-			measure(client, "temperature", temperature, "°C")
+		configs.Lock()
+		for _, device := range devices {
+			config := configs.devices[device]
+			if *brightnessFlag && config.Enabled(1) {
+				readings = append(readings, sensorpayload.Reading{DeviceID: device, SensorID: 1, Value: config.Calibrate(1, brightness), Type: "brightness", Unit: "%", Timestamp: now})
+			}
+
+			if *temperatureFlag && config.Enabled(2) {
+				readings = append(readings, sensorpayload.Reading{DeviceID: device, SensorID: 2, Value: config.Calibrate(2, temperature), Type: "temperature", Unit: "°C", Timestamp: now})
+			}
+
+			if *humidityFlag && config.Enabled(3) {
+				readings = append(readings, sensorpayload.Reading{DeviceID: device, SensorID: 3, Value: config.Calibrate(3, humidity), Type: "humidity", Unit: "%", Timestamp: now})
+			}
 		}
+		configs.Unlock()
 
-		if *humidityFlag {
-			measure(client, "humidity", humidity, "%")
+		rounds++
+		if rounds >= *batchFlag {
+			report(client, contentType, readings)
+			readings, rounds = nil, 0
 		}
 	}
 }
 
-type Measurement struct {
-	DeviceID        string  `json:"device_id"`
-	SensorID        int     `json:"sensor_id"`
-	Value           float64 `json:"value"`
-	MeasurementType string  `json:"type"`
-	Unit            string  `json:"unit"`
+func enroll(ps commproto.PubSubClient) error {
+	key, err := hex.DecodeString(*bootstrapKeyFlag)
+	if err != nil {
+		return fmt.Errorf("invalid bootstrap key: %v", err)
+	}
+	bootstrap := commproto.PartnerConfiguration{Key: key, Passphrase: *bootstrapPassphraseFlag}
+	if len(bootstrap.Key) != commproto.KeySize || bootstrap.Passphrase == "" {
+		return errors.New("please specify the bootstrap secret using the -bootstrap-key and -bootstrap-passphrase flags")
+	}
+	config, err := provisioning.Enroll(ps, *enrollFlag, *receiverFlag, "fakesensor", bootstrap, 10*time.Minute)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"file": *configFlag}).Info("Provisioning succeeded")
+	return commproto.SaveConfiguration(*configFlag, config)
 }
 
-func measure(client *commproto.Client, measurementType string, value float64, unit string) {
-	measurement := Measurement{
-		DeviceID:        "FFFF",
-		SensorID:        1,
-		Value:           value,
-		MeasurementType: measurementType,
-		Unit:            unit,
+func report(client *commproto.Client, contentType string, readings []sensorpayload.Reading) {
+	if len(readings) == 0 {
+		// All sensors are disabled by the server.
+		return
 	}
-	data, err := json.Marshal(measurement)
+	data, err := sensorpayload.Encode(contentType, readings)
 	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Warn("Failed to marshal measurement")
+		log.WithFields(log.Fields{"err": err}).Warn("Failed to encode measurements")
 		return
 	}
-	err = client.Send(*receiverFlag, data)
+	err = client.SendMessage(*receiverFlag, commproto.MessageSensorData, contentType, data)
 	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Warn("Failed to send measurement")
+		log.WithFields(log.Fields{"err": err}).Warn("Failed to send measurements")
 		return
 	}
-	log.WithFields(log.Fields{"type": measurementType, "value": value, "unit": unit}).Info("Sent measurement")
+	for _, reading := range readings {
+		log.WithFields(log.Fields{"device": reading.DeviceID, "type": reading.Type, "value": reading.Value, "unit": reading.Unit}).Info("Sent measurement")
+	}
+	log.WithFields(log.Fields{"bytes": len(data), "encoding": contentType}).Debug("Sent measurements")
+}
+
+// handleCommand executes a command of the server and acknowledges it. Relays
+// and reboots are only simulated.
+func handleCommand(client *commproto.Client, message commproto.Message) {
+	var c command.Command
+	if err := json.Unmarshal(message.Body, &c); err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("Malformed command")
+		return
+	}
+	ack := command.Ack{ID: c.ID, OK: true}
+	if err := c.Validate(); err != nil {
+		ack.OK, ack.Error = false, err.Error()
+	} else {
+		fields := log.Fields{"command": c.Name, "device": c.DeviceID}
+		switch c.Name {
+		case command.SetRelay:
+			on, _ := c.Relay()
+			fields["actuator"], fields["on"] = *c.Actuator, on
+		case command.SetInterval:
+			value, _ := c.Interval()
+			atomic.StoreInt64(&interval, int64(value))
+			fields["interval"] = value
+		}
+		log.WithFields(fields).Info("Executed command")
+	}
+	body, err := json.Marshal(ack)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if err := client.SendMessage(message.Sender, commproto.MessageCommandAck, commproto.ContentTypeJSON, body); err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("Failed to acknowledge command")
+	}
+}
+
+// handleConfig applies a configuration pushed by the server and acknowledges
+// it. The reporting interval of child devices is that of this host.
+func handleConfig(client *commproto.Client, message commproto.Message) {
+	var config deviceconfig.Config
+	if err := json.Unmarshal(message.Body, &config); err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("Malformed configuration")
+		return
+	}
+	ack := deviceconfig.Ack{Version: config.Version, DeviceID: config.DeviceID, OK: true}
+	if err := config.Validate(); err != nil {
+		ack.OK, ack.Error = false, err.Error()
+	} else {
+		configs.Lock()
+		if configs.devices == nil {
+			configs.devices = make(map[string]deviceconfig.Config)
+		}
+		configs.devices[config.DeviceID] = config
+		configs.Unlock()
+		if config.DeviceID == "" {
+			value := config.Interval()
+			if value == 0 {
+				value = defaultInterval
+			}
+			atomic.StoreInt64(&interval, int64(value))
+		}
+		log.WithFields(log.Fields{"version": config.Version, "device": config.DeviceID, "interval": config.Interval(), "sensors": config.Sensors}).Info("Applied configuration")
+	}
+	body, err := json.Marshal(ack)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if err := client.SendMessage(message.Sender, commproto.MessageConfigAck, commproto.ContentTypeJSON, body); err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("Failed to acknowledge configuration")
+	}
 }
@@ -142,6 +142,10 @@ func main() {
 		var message strings.Builder
 		message.WriteString(sender)
 		message.WriteString(": ")
+		if messageType, contentType, body, err := commproto.DecodeEnvelope(data); err == nil && messageType != commproto.MessageUntyped {
+			fmt.Fprintf(&message, "[%s %s] ", messageType, contentType)
+			data = body
+		}
 		message.WriteString(string(data))
 		message.WriteString("\n")
 		fmt.Fprint(out, message.String())
@@ -0,0 +1,169 @@
+// Package secrets provides a command line tool used to manage the encrypted
+// secrets file of the server and to move the secrets out of a plaintext
+// network configuration.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+	"github.com/iot-bp-project-2018/raspi-server/internal/secrets"
+	"github.com/iot-bp-project-2018/raspi-server/internal/util/terminal"
+)
+
+var (
+	fileFlag          = flag.String("file", "config/secrets.json", "encrypted secrets `file`")
+	masterKeyFileFlag = flag.String("master-key-file", "", "read the master key from `file` instead of asking for a passphrase")
+)
+
+// masterPassphraseVariable is the environment variable the master passphrase
+// is read from if no master key file is given, like for the server.
+const masterPassphraseVariable = "RASPI_MASTER_PASSPHRASE"
+
+const usage = `usage: secrets [flags] command
+
+commands:
+  list                 list the names of all secrets
+  get NAME             print a secret
+  set NAME             store a secret read from standard input
+  delete NAME          delete a secret
+  import NETWORKFILE   move all keys and passphrases of a network
+                       configuration into the secrets file
+  set-influx           store the InfluxDB password used by the server
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fmt.Fprintln(os.Stderr, "\nflags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	key, err := readMasterKey()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	file, err := secrets.OpenEncryptedFile(*fileFlag, key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := run(file, args[0], args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(file *secrets.EncryptedFile, command string, args []string) error {
+	switch {
+	case command == "list" && len(args) == 0:
+		for _, name := range file.Names() {
+			fmt.Println(name)
+		}
+		return nil
+	case command == "get" && len(args) == 1:
+		value, err := file.Secret(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(value))
+		return nil
+	case command == "set" && len(args) == 1:
+		value, err := readValue("value: ")
+		if err != nil {
+			return err
+		}
+		return file.SetSecret(args[0], value)
+	case command == "set-influx" && len(args) == 0:
+		value, err := readValue("InfluxDB password: ")
+		if err != nil {
+			return err
+		}
+		return file.SetSecret("influx-password", value)
+	case command == "delete" && len(args) == 1:
+		return file.DeleteSecret(args[0])
+	case command == "import" && len(args) == 1:
+		return importNetwork(file, args[0])
+	default:
+		flag.Usage()
+		os.Exit(2)
+		return nil
+	}
+}
+
+// importNetwork moves the plaintext keys and passphrases of all partners into
+// the secrets file and rewrites the network file with references.
+func importNetwork(file *secrets.EncryptedFile, filename string) error {
+	config, err := commproto.ParseConfigurationWithSecrets(filename, file)
+	if err != nil {
+		return err
+	}
+	for address, partner := range config.Partners {
+		if partner.KeySecret == "" {
+			partner.KeySecret = address + "-key"
+			if err := file.SetSecret(partner.KeySecret, []byte(hex.EncodeToString(partner.Key))); err != nil {
+				return err
+			}
+		}
+		if partner.PassphraseSecret == "" {
+			partner.PassphraseSecret = address + "-passphrase"
+			if err := file.SetSecret(partner.PassphraseSecret, []byte(partner.Passphrase)); err != nil {
+				return err
+			}
+		}
+		config.Partners[address] = partner
+		fmt.Printf("imported secrets of '%s'\n", address)
+	}
+	return commproto.SaveConfiguration(filename, config)
+}
+
+func readMasterKey() ([]byte, error) {
+	if *masterKeyFileFlag != "" {
+		data, err := ioutil.ReadFile(*masterKeyFileFlag)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(data), "\r\n")), nil
+	}
+	if passphrase := os.Getenv(masterPassphraseVariable); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	return readValue("master passphrase: ")
+}
+
+// stdin is shared by all reads, so that piped input is not lost in the buffer
+// of a previous read.
+var stdin = bufio.NewReader(os.Stdin)
+
+// readValue reads a line from standard input without echoing it, if standard
+// input is a terminal.
+func readValue(prompt string) ([]byte, error) {
+	fd := int(syscall.Stdin)
+	if terminal.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		value, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return value, err
+	}
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+	"github.com/iot-bp-project-2018/raspi-server/internal/rules"
+)
+
+var alertEngine *rules.Engine
+
+// startAlerting loads the alert rules and evaluates them periodically. Rules
+// are also evaluated on every stored reading. Alerts of the "message" notifier
+// are sent with the client.
+func startAlerting(client *commproto.Client) error {
+	engine, err := rules.LoadEngine(rulesFile, notifierFactory(client))
+	if err != nil {
+		return err
+	}
+	alertEngine = engine
+	go func() {
+		for range time.Tick(alertTickInterval) {
+			alertEngine.Tick()
+		}
+	}()
+	return nil
+}
+
+// notifierFactory supports the built-in notifiers and the "message" notifier,
+// which sends alerts as commproto.MessageAlert to the partner Partner through
+// the client.
+func notifierFactory(client *commproto.Client) rules.NotifierFactory {
+	return func(config rules.NotifierConfiguration) (rules.Notifier, error) {
+		if config.Type != "message" {
+			return rules.DefaultFactory(config)
+		}
+		if config.Partner == "" {
+			return nil, errors.New("missing partner")
+		}
+		return rules.NotifierFunc(func(alert rules.Alert) error {
+			body, err := json.Marshal(alert)
+			if err != nil {
+				return err
+			}
+			return client.SendMessage(config.Partner, commproto.MessageAlert, commproto.ContentTypeJSON, body)
+		}), nil
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+	"github.com/iot-bp-project-2018/raspi-server/internal/util/rotatefile"
+)
+
+// SecurityEventSummary aggregates the security events of one type caused by
+// one partner on one channel.
+type SecurityEventSummary struct {
+	Type      commproto.SecurityEventType `json:"type"`
+	Partner   string                      `json:"partner"`
+	Channel   string                      `json:"channel"`
+	Count     int                         `json:"count"`
+	FirstSeen time.Time                   `json:"firstSeen"`
+	LastSeen  time.Time                   `json:"lastSeen"`
+
+	windowStart time.Time
+	windowCount int
+}
+
+// SecurityAlert is raised when the events of a summary exceed the alert
+// threshold of their type within securityAlertWindow.
+type SecurityAlert struct {
+	Type    commproto.SecurityEventType `json:"type"`
+	Partner string                      `json:"partner"`
+	Channel string                      `json:"channel"`
+	Count   int                         `json:"count"`
+	Time    time.Time                   `json:"time"`
+}
+
+type securityEventKey struct {
+	eventType commproto.SecurityEventType
+	partner   string
+	channel   string
+}
+
+var auditLog struct {
+	mutex     sync.Mutex
+	file      *rotatefile.File
+	summaries map[securityEventKey]*SecurityEventSummary
+	recent    []commproto.SecurityEvent
+	alerts    []SecurityAlert
+}
+
+func startAuditLog(client *commproto.Client) {
+	auditLog.summaries = make(map[securityEventKey]*SecurityEventSummary)
+	file, err := rotatefile.Open(securityLogFile, securityLogMaxSize, securityLogKeep)
+	if err != nil {
+		log.Println("[audit] failed to open security log, events are only kept in memory")
+		log.Println(err)
+	} else {
+		auditLog.file = file
+	}
+	client.RegisterSecurityCallback(recordSecurityEvent)
+}
+
+func recordSecurityEvent(event commproto.SecurityEvent) {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	writeAuditEntry(generic{"event": event})
+
+	auditLog.recent = append(auditLog.recent, event)
+	if len(auditLog.recent) > securityRecentEvents {
+		auditLog.recent = auditLog.recent[len(auditLog.recent)-securityRecentEvents:]
+	}
+
+	key := securityEventKey{event.Type, event.Partner, event.Channel}
+	summary, ok := auditLog.summaries[key]
+	if !ok {
+		if len(auditLog.summaries) >= securityMaxSummaries {
+			evictSecuritySummary()
+		}
+		summary = &SecurityEventSummary{Type: event.Type, Partner: event.Partner, Channel: event.Channel, FirstSeen: event.Time}
+		auditLog.summaries[key] = summary
+	}
+	summary.Count++
+	summary.LastSeen = event.Time
+
+	if event.Time.Sub(summary.windowStart) > securityAlertWindow {
+		summary.windowStart = event.Time
+		summary.windowCount = 0
+	}
+	summary.windowCount++
+	if summary.windowCount == securityAlertThreshold(event.Type) {
+		alert := SecurityAlert{Type: event.Type, Partner: event.Partner, Channel: event.Channel, Count: summary.windowCount, Time: event.Time}
+		log.Printf("[audit] ALERT: %d '%s' events from '%s' on '%s' within %v\n", alert.Count, alert.Type, alert.Partner, alert.Channel, securityAlertWindow)
+		writeAuditEntry(generic{"alert": alert})
+		auditLog.alerts = append(auditLog.alerts, alert)
+		if len(auditLog.alerts) > securityRecentEvents {
+			auditLog.alerts = auditLog.alerts[len(auditLog.alerts)-securityRecentEvents:]
+		}
+	}
+}
+
+// evictSecuritySummary drops the least recently seen summary. The caller must
+// hold auditLog.mutex.
+func evictSecuritySummary() {
+	var oldest securityEventKey
+	var lastSeen time.Time
+	for key, summary := range auditLog.summaries {
+		if lastSeen.IsZero() || summary.LastSeen.Before(lastSeen) {
+			oldest, lastSeen = key, summary.LastSeen
+		}
+	}
+	delete(auditLog.summaries, oldest)
+}
+
+func securityAlertThreshold(eventType commproto.SecurityEventType) int {
+	if threshold, ok := securityAlertThresholds[eventType]; ok {
+		return threshold
+	}
+	return securityDefaultAlertThreshold
+}
+
+// writeAuditEntry appends an entry to the security log. The caller must hold
+// auditLog.mutex.
+func writeAuditEntry(entry generic) {
+	if auditLog.file == nil {
+		return
+	}
+	if err := auditLog.file.WriteJSON(entry); err != nil {
+		log.Println("[audit] failed to write security log:", err)
+	}
+}
+
+// getSecurityReport returns the summaries ordered by the time of their last
+// event, the most recent events and the most recent alerts.
+func getSecurityReport() (summaries []*SecurityEventSummary, recent []commproto.SecurityEvent, alerts []SecurityAlert) {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+	summaries = make([]*SecurityEventSummary, 0, len(auditLog.summaries))
+	for _, summary := range auditLog.summaries {
+		copied := *summary
+		summaries = append(summaries, &copied)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].LastSeen.After(summaries[j].LastSeen)
+	})
+	recent = append([]commproto.SecurityEvent{}, auditLog.recent...)
+	alerts = append([]SecurityAlert{}, auditLog.alerts...)
+	return
+}
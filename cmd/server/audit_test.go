@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+)
+
+func TestSecuritySummariesAreLimited(t *testing.T) {
+	auditLog.summaries = make(map[securityEventKey]*SecurityEventSummary)
+	defer func() { auditLog.summaries, auditLog.recent, auditLog.alerts = nil, nil, nil }()
+	at := time.Unix(1546300800, 0)
+	recordSecurityEvent(commproto.SecurityEvent{Type: commproto.EventReplay, Partner: "shredder", Channel: "data", Time: at})
+	for i := 0; i < securityMaxSummaries+10; i++ {
+		recordSecurityEvent(commproto.SecurityEvent{Type: commproto.EventUnknownSender, Partner: fmt.Sprintf("spoofed-%d", i), Channel: "data", Time: at.Add(time.Duration(i+1) * time.Second)})
+	}
+
+	summaries, _, _ := getSecurityReport()
+	if len(summaries) != securityMaxSummaries {
+		t.Fatalf("expected %d summaries, got %d", securityMaxSummaries, len(summaries))
+	}
+	for _, summary := range summaries {
+		if summary.Partner == "shredder" || summary.Partner == "spoofed-0" {
+			t.Fatalf("least recently seen summary of '%s' was kept", summary.Partner)
+		}
+	}
+}
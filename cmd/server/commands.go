@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/command"
+	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+	"github.com/iot-bp-project-2018/raspi-server/internal/util/rotatefile"
+)
+
+// CommandStatus is the delivery state of a command.
+type CommandStatus string
+
+// Command states
+const (
+	CommandPending CommandStatus = "pending"
+	CommandAcked   CommandStatus = "acked"
+	CommandFailed  CommandStatus = "failed"
+)
+
+// CommandRecord tracks a command sent to a device.
+type CommandRecord struct {
+	Command  command.Command `json:"command"`
+	DeviceID string          `json:"deviceId"`
+	// Receiver is the partner the command was sent to, which is the gateway
+	// for child devices.
+	Receiver  string        `json:"receiver"`
+	Status    CommandStatus `json:"status"`
+	Error     string        `json:"error,omitempty"`
+	IssuedAt  time.Time     `json:"issuedAt"`
+	UpdatedAt time.Time     `json:"updatedAt"`
+}
+
+var commands struct {
+	mutex   sync.Mutex
+	history []*CommandRecord
+	byID    map[string]*CommandRecord
+	file    *rotatefile.File
+}
+
+// startCommands opens the command log and fails commands that are not
+// acknowledged in time.
+func startCommands() {
+	commands.byID = make(map[string]*CommandRecord)
+	file, err := rotatefile.Open(commandLogFile, commandLogMaxSize, commandLogKeep)
+	if err != nil {
+		log.Println("[commands] failed to open command log, history is only kept in memory")
+		log.Println(err)
+	} else {
+		commands.file = file
+	}
+	go func() {
+		for now := range time.Tick(commandTimeout / 2) {
+			expireCommands(now)
+		}
+	}()
+}
+
+// issueCommand validates a command and sends it to the device. Commands for
+// child devices are sent to their gateway.
+func issueCommand(deviceID string, c command.Command) (CommandRecord, error) {
+	device, ok := deviceStorage.Get(deviceID)
+	if !ok {
+		return CommandRecord{}, fmt.Errorf("unknown device '%s'", deviceID)
+	}
+	if c.Actuator != nil {
+		actuator := device.actuator(*c.Actuator)
+		if actuator == nil {
+			return CommandRecord{}, fmt.Errorf("unknown actuator %d of device '%s'", *c.Actuator, deviceID)
+		}
+		if c.Name == command.SetRelay && actuator.Type != "relay" {
+			return CommandRecord{}, fmt.Errorf("actuator %d is not a relay", *c.Actuator)
+		}
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return CommandRecord{}, err
+	}
+	c.ID = hex.EncodeToString(id)
+	receiver := deviceID
+	if device.Gateway != "" {
+		receiver, c.DeviceID = device.Gateway, deviceID
+	}
+	if err := c.Validate(); err != nil {
+		return CommandRecord{}, err
+	}
+	body, err := json.Marshal(c)
+	if err != nil {
+		return CommandRecord{}, err
+	}
+
+	now := time.Now()
+	record := &CommandRecord{Command: c, DeviceID: deviceID, Receiver: receiver, Status: CommandPending, IssuedAt: now, UpdatedAt: now}
+	commands.mutex.Lock()
+	commands.byID[c.ID] = record
+	commands.history = append(commands.history, record)
+	if len(commands.history) > commandHistorySize {
+		delete(commands.byID, commands.history[0].Command.ID)
+		commands.history = commands.history[1:]
+	}
+	logCommand(record)
+	commands.mutex.Unlock()
+
+	if err := protoClient.SendMessage(receiver, commproto.MessageCommand, commproto.ContentTypeJSON, body); err != nil {
+		updateCommand(c.ID, CommandFailed, err.Error())
+	}
+	commands.mutex.Lock()
+	defer commands.mutex.Unlock()
+	return *record, nil
+}
+
+func commandAckHandler(message commproto.Message) {
+	var ack command.Ack
+	if err := json.Unmarshal(message.Body, &ack); err != nil {
+		log.Printf("[commands] malformed acknowledgement from '%s': %v\n", message.Sender, err)
+		return
+	}
+	commands.mutex.Lock()
+	record, ok := commands.byID[ack.ID]
+	commands.mutex.Unlock()
+	if !ok || record.Receiver != message.Sender {
+		log.Printf("[commands] ignoring acknowledgement of unknown command '%s' from '%s'\n", ack.ID, message.Sender)
+		return
+	}
+	if ack.OK {
+		updateCommand(ack.ID, CommandAcked, "")
+		if record.Command.Name == command.SetInterval {
+			applyCommandInterval(record)
+		}
+	} else {
+		if ack.Error == "" {
+			ack.Error = "rejected by device"
+		}
+		updateCommand(ack.ID, CommandFailed, ack.Error)
+	}
+}
+
+// applyCommandInterval keeps the desired configuration in line with an
+// acknowledged set-interval command, so the next configuration push does not
+// revert the interval.
+func applyCommandInterval(record *CommandRecord) {
+	interval, err := record.Command.Interval()
+	if err != nil {
+		return
+	}
+	if _, err := deviceConfigs.ApplyInterval(record.DeviceID, interval); err != nil {
+		log.Printf("[commands] failed to record interval of '%s': %v\n", record.DeviceID, err)
+		return
+	}
+	pushDeviceConfig(record.DeviceID)
+}
+
+// updateCommand changes the status of a pending command.
+func updateCommand(id string, status CommandStatus, reason string) {
+	commands.mutex.Lock()
+	defer commands.mutex.Unlock()
+	record, ok := commands.byID[id]
+	if !ok || record.Status != CommandPending {
+		return
+	}
+	record.Status, record.Error, record.UpdatedAt = status, reason, time.Now()
+	logCommand(record)
+}
+
+// expireCommands fails all commands that are pending for longer than
+// commandTimeout.
+func expireCommands(now time.Time) {
+	var expired []string
+	commands.mutex.Lock()
+	for _, record := range commands.history {
+		if record.Status == CommandPending && now.Sub(record.IssuedAt) > commandTimeout {
+			expired = append(expired, record.Command.ID)
+		}
+	}
+	commands.mutex.Unlock()
+	for _, id := range expired {
+		updateCommand(id, CommandFailed, "no acknowledgement")
+	}
+}
+
+// logCommand writes the record to the command log. The caller must hold the
+// mutex.
+func logCommand(record *CommandRecord) {
+	log.Printf("[commands] command '%s' (%s) for device '%s' is %s\n", record.Command.ID, record.Command.Name, record.DeviceID, record.Status)
+	if commands.file != nil {
+		if err := commands.file.WriteJSON(record); err != nil {
+			log.Println("[commands] failed to write command log:", err)
+		}
+	}
+}
+
+// getCommandHistory returns the commands of a device, or of all devices if
+// deviceID is empty, newest first.
+func getCommandHistory(deviceID string) []CommandRecord {
+	commands.mutex.Lock()
+	defer commands.mutex.Unlock()
+	result := []CommandRecord{}
+	for i := len(commands.history) - 1; i >= 0; i-- {
+		if record := commands.history[i]; deviceID == "" || record.DeviceID == deviceID {
+			result = append(result, *record)
+		}
+	}
+	return result
+}
@@ -1,17 +1,127 @@
 package main
 
-import "time"
+import (
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+)
 
 var buttonTimeout = 5 * time.Second
 
+const bootstrapLifetime = 10 * time.Minute
+
+// Readings may be measured at most readingClockTolerance after and
+// maxReadingAge before the message that carries them was sent.
+const readingClockTolerance = time.Second
+const maxReadingAge = 7 * 24 * time.Hour
+
+// Maximum length of the id of a child device reported by a gateway
+const maxDeviceIDLength = 64
+
+// Limits of device and sensor metadata
+const maxMetadataLength = 100 // characters of names, locations, rooms and tags
+const maxNotesLength = 2000
+const maxTags = 20
+
+// Maximum number of sensors a filtered or multi-series data query may select
+const maxFilteredSeries = 50
+
+// Maximum number of selectors of a multi-series data query
+const maxSeriesSelectors = 20
+
+// Limits of the time range and resolution of data queries. A query returns at
+// most maxQueryBuckets values per sensor.
+const maxQueryRange = 5 * 366 * 24 * time.Hour
+const minQueryResolution = time.Second
+const maxQueryBuckets = 10000
+const maxQueryAggregates = 10
+
+// Exports query and write the readings in chunks of exportChunk, so that only
+// one chunk is held in memory. Their time range is limited by maxQueryRange.
+const exportChunk = 24 * time.Hour
+
+// Number of points written per batch when relabeling stored data
+const relabelBatchSize = 5000
+
+// Stored data is relabeled and recalibrated in time windows of seriesWindow,
+// so that only one window is held in memory.
+const seriesWindow = 24 * time.Hour
+
+// Devices are marked offline after being silent for the offline factor
+// (-offline-factor) times their observed reporting interval, but never before
+// livenessMinTimeout. Devices that reported only once use
+// livenessDefaultTimeout.
+const livenessMinTimeout = time.Minute
+const livenessDefaultTimeout = 10 * time.Minute
+const livenessSmoothing = 0.2 // weight of the latest interval in the moving average
+const livenessCheckInterval = 10 * time.Second
+const livenessSaveInterval = time.Minute
+const livenessRecentEvents = 100
+
+// Commands that are not acknowledged within commandTimeout fail. The last
+// commandHistorySize commands are kept in memory, all are logged to
+// commandLogFile.
+const commandTimeout = 30 * time.Second
+const commandHistorySize = 500
+const commandLogMaxSize = 1 << 20 // bytes
+const commandLogKeep = 5
+
+// Interval in which alert rules are evaluated without new readings
+const alertTickInterval = 10 * time.Second
+
 const webserverEndpoint = ":80"
 
+// The InfluxDB 1.x adapter uses the database, user and password, the 2.x
+// adapter the database as bucket, the organization and the token.
 const influxHost = "http://localhost:8086"
 const influxDatabase = "bp"
 const influxUser = "bp"
-const influxPassword = "xiedu2aNgaefie9Kaen1aivoochura"
+const influxPasswordSecret = "influx-password"
+const influxOrganization = "bp"
+const influxTokenSecret = "influx-token"
+
+// The embedded store keeps its data in this directory.
+const embeddedDataDirectory = "data"
+const embeddedCompactInterval = 10 * time.Minute
+
+// Points that cannot be written while the storage is unavailable are spilled
+// to this file.
+const ingestSpillFile = embeddedDataDirectory + "/ingest-spill.lp"
+
+const masterPassphraseVariable = "RASPI_MASTER_PASSPHRASE"
 
 const configDirectory = "config"
 const networkFile = "config/network.json"
 const tokenFile = "config/tokens.json"
 const devicesFile = "config/devices.json"
+const devicesSaveDelay = 2 * time.Second
+const livenessFile = "config/liveness.json"
+const rulesFile = "config/rules.json"
+const deviceConfigsFile = "config/device-configs.json"
+const revocationsFile = "config/revocations.json"
+const securityLogFile = "config/security.log"
+const quarantineFile = "config/quarantine.log"
+const commandLogFile = "config/commands.log"
+
+const securityLogMaxSize = 1 << 20 // bytes
+const securityLogKeep = 5
+const securityRecentEvents = 100
+
+// Events of unknown senders carry unauthenticated addresses, so the number of
+// summaries is limited. The least recently seen summary is dropped first.
+const securityMaxSummaries = 1000
+
+const quarantineMaxSize = 1 << 20 // bytes
+const quarantineKeep = 3
+
+// An alert is raised when one partner causes as many security events of one
+// type on one channel within securityAlertWindow as the threshold for the type.
+var securityAlertWindow = time.Minute
+
+const securityDefaultAlertThreshold = 10
+
+var securityAlertThresholds = map[commproto.SecurityEventType]int{
+	commproto.EventRevokedPartner: 1,
+	commproto.EventUnknownSender:  20,
+	commproto.EventReplay:         5,
+}
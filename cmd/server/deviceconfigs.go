@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+	"github.com/iot-bp-project-2018/raspi-server/internal/deviceconfig"
+)
+
+// DeviceConfigState is the desired configuration of a device and what the
+// device reported back.
+type DeviceConfigState struct {
+	DeviceID  string              `json:"deviceId"`
+	Desired   deviceconfig.Config `json:"desired"`
+	UpdatedAt time.Time           `json:"updatedAt"`
+	PushedAt  *time.Time          `json:"pushedAt,omitempty"`
+	// AppliedVersion is the last version the device acknowledged.
+	AppliedVersion uint64     `json:"appliedVersion"`
+	AppliedAt      *time.Time `json:"appliedAt,omitempty"`
+	// Error is the reason the last push or the device rejected the desired
+	// configuration.
+	Error string `json:"error,omitempty"`
+	// Drifted is set while the device has not applied the desired
+	// configuration.
+	Drifted bool `json:"drifted"`
+}
+
+// DeviceConfigStore keeps the desired configuration of all devices and saves
+// it to a file. It is safe for concurrent use.
+type DeviceConfigStore struct {
+	mutex    sync.Mutex
+	states   map[string]*DeviceConfigState
+	filename string
+}
+
+var deviceConfigs *DeviceConfigStore
+
+// LoadDeviceConfigStore creates a store and restores the configurations saved
+// in the given file, if it exists.
+func LoadDeviceConfigStore(filename string) (*DeviceConfigStore, error) {
+	store := &DeviceConfigStore{states: make(map[string]*DeviceConfigState), filename: filename}
+	if filename == "" {
+		return store, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.states); err != nil {
+		return nil, fmt.Errorf("device configuration file '%s': %v", filename, err)
+	}
+	for id, state := range store.states {
+		state.DeviceID = id
+	}
+	return store, nil
+}
+
+// Set replaces the desired configuration of a device with the next version.
+func (s *DeviceConfigStore) Set(deviceID string, config deviceconfig.Config) (DeviceConfigState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state, ok := s.states[deviceID]
+	if !ok {
+		state = &DeviceConfigState{DeviceID: deviceID}
+	}
+	config.Version = state.Desired.Version + 1
+	if err := config.Validate(); err != nil {
+		return DeviceConfigState{}, err
+	}
+	s.states[deviceID] = state
+	state.Desired, state.UpdatedAt, state.Error = config, time.Now(), ""
+	state.Drifted = true
+	return *state, s.save()
+}
+
+// ApplyInterval records a reporting interval the device already applied
+// outside of a configuration push, e.g. after a set-interval command. The
+// desired configuration gets a new version with that interval, which counts as
+// applied unless the device was drifted before.
+func (s *DeviceConfigStore) ApplyInterval(deviceID string, interval time.Duration) (DeviceConfigState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state, ok := s.states[deviceID]
+	if !ok {
+		state = &DeviceConfigState{DeviceID: deviceID}
+	}
+	config := state.Desired
+	config.Version++
+	config.IntervalSeconds = int(interval / time.Second)
+	if err := config.Validate(); err != nil {
+		return DeviceConfigState{}, err
+	}
+	s.states[deviceID] = state
+	now := time.Now()
+	state.Desired, state.UpdatedAt = config, now
+	if !state.Drifted {
+		state.AppliedVersion, state.AppliedAt = config.Version, &now
+	}
+	return *state, s.save()
+}
+
+// Pushed records the result of sending the desired configuration to a device.
+func (s *DeviceConfigStore) Pushed(deviceID string, version uint64, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state, ok := s.states[deviceID]
+	if !ok || state.Desired.Version != version {
+		return
+	}
+	now := time.Now()
+	state.PushedAt = &now
+	if err != nil {
+		state.Error = err.Error()
+	}
+}
+
+// Acknowledge records the answer of a device to a pushed configuration.
+func (s *DeviceConfigStore) Acknowledge(deviceID string, ack deviceconfig.Ack) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state, ok := s.states[deviceID]
+	if !ok || ack.Version == 0 || ack.Version > state.Desired.Version {
+		return fmt.Errorf("unknown configuration version %d", ack.Version)
+	}
+	if !ack.OK {
+		if ack.Version == state.Desired.Version {
+			state.Error = ack.Error
+			if state.Error == "" {
+				state.Error = "rejected by device"
+			}
+		}
+		return nil
+	}
+	if ack.Version < state.AppliedVersion {
+		return nil
+	}
+	now := time.Now()
+	state.AppliedVersion, state.AppliedAt = ack.Version, &now
+	state.Drifted = state.AppliedVersion != state.Desired.Version
+	if !state.Drifted {
+		state.Error = ""
+	}
+	return s.save()
+}
+
+// Get returns the configuration state of a device.
+func (s *DeviceConfigStore) Get(deviceID string) (DeviceConfigState, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state, ok := s.states[deviceID]
+	if !ok {
+		return DeviceConfigState{}, false
+	}
+	return *state, true
+}
+
+// States returns the configuration states of all devices ordered by device id.
+func (s *DeviceConfigStore) States() []DeviceConfigState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := make([]DeviceConfigState, 0, len(s.states))
+	for _, state := range s.states {
+		result = append(result, *state)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].DeviceID < result[j].DeviceID })
+	return result
+}
+
+// Forget removes the configuration of a device, e.g. after it was deleted.
+func (s *DeviceConfigStore) Forget(deviceID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.states[deviceID]; !ok {
+		return nil
+	}
+	delete(s.states, deviceID)
+	return s.save()
+}
+
+// save writes all configurations to the file. The caller must hold the mutex.
+func (s *DeviceConfigStore) save() error {
+	if s.filename == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.states, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := s.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.filename)
+}
+
+// startDeviceConfigs pushes the desired configuration to devices when they
+// come online. Configurations of deleted devices are forgotten.
+func startDeviceConfigs(store *DeviceConfigStore, devices *DeviceRepository, tracker *LivenessTracker) {
+	tracker.Subscribe(func(event LivenessEvent) {
+		if event.Type == DeviceOnline {
+			// Listeners are called with the tracker mutex held.
+			go pushDeviceConfig(event.DeviceID)
+		}
+	})
+	devices.Subscribe(func(event DeviceEvent) {
+		if event.Type == DeviceDeleted {
+			if err := store.Forget(event.Device.ID); err != nil {
+				log.Println("[configs] failed to write device configuration file")
+				log.Println(err)
+			}
+		}
+	})
+}
+
+// setDeviceConfig changes the desired configuration of a device and pushes it.
+func setDeviceConfig(deviceID string, config deviceconfig.Config) (DeviceConfigState, error) {
+	if _, ok := deviceStorage.Get(deviceID); !ok {
+		return DeviceConfigState{}, fmt.Errorf("unknown device '%s'", deviceID)
+	}
+	state, err := deviceConfigs.Set(deviceID, config)
+	if err != nil {
+		return state, err
+	}
+	pushDeviceConfig(deviceID)
+	state, _ = deviceConfigs.Get(deviceID)
+	return state, nil
+}
+
+// pushDeviceConfig sends the desired configuration to a device that has not
+// applied it yet. Configurations of child devices are sent to their gateway.
+func pushDeviceConfig(deviceID string) {
+	state, ok := deviceConfigs.Get(deviceID)
+	if !ok || !state.Drifted {
+		return
+	}
+	device, ok := deviceStorage.Get(deviceID)
+	if !ok {
+		return
+	}
+	config := state.Desired
+	receiver := deviceID
+	if device.Gateway != "" {
+		receiver, config.DeviceID = device.Gateway, deviceID
+	}
+	body, err := json.Marshal(config)
+	if err != nil {
+		log.Panicln(err)
+	}
+	err = protoClient.SendMessage(receiver, commproto.MessageConfig, commproto.ContentTypeJSON, body)
+	if err != nil {
+		log.Printf("[configs] failed to push configuration %d to '%s': %v\n", config.Version, deviceID, err)
+	} else {
+		log.Printf("[configs] pushed configuration %d to '%s'\n", config.Version, deviceID)
+	}
+	deviceConfigs.Pushed(deviceID, config.Version, err)
+}
+
+func configAckHandler(message commproto.Message) {
+	var ack deviceconfig.Ack
+	if err := json.Unmarshal(message.Body, &ack); err != nil {
+		log.Printf("[configs] malformed acknowledgement from '%s': %v\n", message.Sender, err)
+		return
+	}
+	deviceID := message.Sender
+	if ack.DeviceID != "" {
+		if device, ok := deviceStorage.Get(ack.DeviceID); !ok || device.Gateway != message.Sender {
+			log.Printf("[configs] '%s' acknowledged configuration of foreign device '%s'\n", message.Sender, ack.DeviceID)
+			return
+		}
+		deviceID = ack.DeviceID
+	}
+	if err := deviceConfigs.Acknowledge(deviceID, ack); err != nil {
+		log.Printf("[configs] ignoring acknowledgement from '%s': %v\n", deviceID, err)
+		return
+	}
+	if !ack.OK {
+		log.Printf("[configs] '%s' rejected configuration %d: %s\n", deviceID, ack.Version, ack.Error)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/deviceconfig"
+)
+
+func TestDeviceConfigStoreDrift(t *testing.T) {
+	store, _ := LoadDeviceConfigStore("")
+
+	first, err := store.Set("shredder", deviceconfig.Config{IntervalSeconds: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := store.Set("shredder", deviceconfig.Config{IntervalSeconds: 60})
+	if first.Desired.Version != 1 || second.Desired.Version != 2 || !second.Drifted {
+		t.Fatalf("unexpected versions %d and %d", first.Desired.Version, second.Desired.Version)
+	}
+
+	if err := store.Acknowledge("shredder", deviceconfig.Ack{Version: 1, OK: true}); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := store.Get("shredder"); !state.Drifted || state.AppliedVersion != 1 {
+		t.Fatalf("device applied outdated version but is not drifted: %+v", state)
+	}
+	store.Acknowledge("shredder", deviceconfig.Ack{Version: 2, Error: "unsupported interval"})
+	if state, _ := store.Get("shredder"); !state.Drifted || state.Error != "unsupported interval" {
+		t.Fatalf("rejected configuration is not reported: %+v", state)
+	}
+	store.Acknowledge("shredder", deviceconfig.Ack{Version: 2, OK: true})
+	if state, _ := store.Get("shredder"); state.Drifted || state.Error != "" {
+		t.Fatalf("device applied latest version but is drifted: %+v", state)
+	}
+	if err := store.Acknowledge("shredder", deviceconfig.Ack{Version: 3, OK: true}); err == nil {
+		t.Fatal("Acknowledge accepted unknown version")
+	}
+}
+
+func TestDeviceConfigStoreApplyInterval(t *testing.T) {
+	store, _ := LoadDeviceConfigStore("")
+
+	state, err := store.ApplyInterval("shredder", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Desired.IntervalSeconds != 60 || state.Drifted || state.AppliedVersion != state.Desired.Version {
+		t.Fatalf("applied interval is not recorded as applied: %+v", state)
+	}
+
+	store.Set("shredder", deviceconfig.Config{Sensors: map[byte]deviceconfig.Sensor{2: {Offset: 1}}})
+	state, _ = store.ApplyInterval("shredder", 2*time.Minute)
+	if state.Desired.IntervalSeconds != 120 || state.Desired.Sensors[2].Offset != 1 || !state.Drifted {
+		t.Fatalf("interval of drifted device is not kept pending: %+v", state)
+	}
+}
+
+func TestDeviceConfigStorePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "device-configs.json")
+
+	store, err := LoadDeviceConfigStore(filename)
+	if err != nil {
+		t.Fatalf("LoadDeviceConfigStore returned err for missing file: %v", err)
+	}
+	store.Set("shredder", deviceconfig.Config{Sensors: map[byte]deviceconfig.Sensor{2: {Offset: -0.5}}})
+
+	loaded, err := LoadDeviceConfigStore(filename)
+
+	if err != nil {
+		t.Fatalf("LoadDeviceConfigStore returned err: %v", err)
+	}
+	state, ok := loaded.Get("shredder")
+	if !ok || state.DeviceID != "shredder" || state.Desired.Sensors[2].Offset != -0.5 || !state.Drifted {
+		t.Fatalf("unexpected loaded state %+v", state)
+	}
+}
@@ -2,80 +2,725 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"sync"
 	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/calibration"
+	"github.com/iot-bp-project-2018/raspi-server/internal/measurement"
 )
 
-// Device stores all information about a discovered device in the network
+// Device stores all information about a discovered device in the network.
+// Devices that are not connected directly report through a gateway, which
+// lists them as its children.
 type Device struct {
-	ID           string    `json:"id"`
-	Sensors      []*Sensor `json:"sensors"`
-	DiscoveredAt time.Time `json:"discoveredAt"`
+	ID string `json:"id"`
+	Metadata
+	Gateway      string      `json:"gateway,omitempty"`
+	Children     []string    `json:"children,omitempty"`
+	Sensors      []*Sensor   `json:"sensors"`
+	Actuators    []*Actuator `json:"actuators,omitempty"`
+	DiscoveredAt time.Time   `json:"discoveredAt"`
 }
 
 // Sensor stores all information about a devices sensor
 type Sensor struct {
-	ID           byte      `json:"id"`
+	ID byte `json:"id"`
+	Metadata
 	Type         string    `json:"type"`
 	Unit         string    `json:"unit"`
+	OriginalUnit string    `json:"originalUnit,omitempty"`
 	DiscoveredAt time.Time `json:"discoveredAt"`
+	// RetiredAt is set for sensors that are hidden but whose data is kept.
+	RetiredAt *time.Time `json:"retiredAt,omitempty"`
+	// Calibration corrects the readings of the sensor after they have been
+	// converted to the canonical unit. It is replaced as a whole, never
+	// modified in place.
+	Calibration calibration.Pipeline `json:"calibration,omitempty"`
+}
+
+// Actuator is an output of a device that can be controlled with commands.
+type Actuator struct {
+	ID   byte   `json:"id"`
+	Type string `json:"type"`
+	Metadata
+}
+
+// actuatorTypes lists the known actuator types.
+var actuatorTypes = map[string]bool{"relay": true}
+
+// clone returns a deep copy of the device, which can be handed out without
+// holding the repository mutex.
+func (d *Device) clone() Device {
+	c := *d
+	c.Metadata = d.Metadata.clone()
+	c.Children = append([]string(nil), d.Children...)
+	c.Sensors = make([]*Sensor, len(d.Sensors))
+	for i, sensor := range d.Sensors {
+		s := *sensor
+		s.Metadata = sensor.Metadata.clone()
+		if sensor.RetiredAt != nil {
+			retiredAt := *sensor.RetiredAt
+			s.RetiredAt = &retiredAt
+		}
+		c.Sensors[i] = &s
+	}
+	if d.Actuators != nil {
+		c.Actuators = make([]*Actuator, len(d.Actuators))
+		for i, actuator := range d.Actuators {
+			a := *actuator
+			a.Metadata = actuator.Metadata.clone()
+			c.Actuators[i] = &a
+		}
+	}
+	return c
+}
+
+func (d *Device) actuator(id byte) *Actuator {
+	for _, actuator := range d.Actuators {
+		if actuator.ID == id {
+			return actuator
+		}
+	}
+	return nil
+}
+
+// calibration returns the calibration of a sensor.
+func (d *Device) calibration(id byte) calibration.Pipeline {
+	for _, sensor := range d.Sensors {
+		if sensor.ID == id {
+			return sensor.Calibration
+		}
+	}
+	return nil
+}
+
+func (d *Device) hasSensor(id byte) bool {
+	for _, sensor := range d.Sensors {
+		if sensor.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// DeviceEventType describes a change of the device repository.
+type DeviceEventType string
+
+// Device repository changes
+const (
+	DeviceAdded   DeviceEventType = "device-added"
+	DeviceUpdated DeviceEventType = "device-updated"
+	DeviceDeleted DeviceEventType = "device-deleted"
+)
+
+// DeviceEvent is passed to device listeners after a device has changed.
+type DeviceEvent struct {
+	Type   DeviceEventType `json:"type"`
+	Device Device          `json:"device"`
 }
 
-var deviceStorage struct {
+// DeviceListener is called for every change of the device repository. It is
+// called synchronously by the goroutine that made the change and must not
+// block or modify the repository.
+type DeviceListener func(event DeviceEvent)
+
+// deviceFileContent is the format of the devices file.
+type deviceFileContent struct {
 	Devices []*Device `json:"devices"`
 }
 
-func addDevice(d *Device) {
-	deviceStorage.Devices = append(deviceStorage.Devices, d)
-	log.Printf("[devices] new device '%s' added to device storage\n", d.ID)
-	saveDevices()
+// DeviceRepository is a concurrency-safe store of all known devices. All
+// methods return copies, so devices can only be changed through the
+// repository. Changes are written to the devices file after devicesSaveDelay,
+// so that bursts of changes result in a single write.
+type DeviceRepository struct {
+	mutex     sync.RWMutex
+	devices   []*Device
+	listeners []DeviceListener
+
+	filename  string
+	saveMutex sync.Mutex
+	dirty     bool
+	saveTimer *time.Timer
 }
 
-func loadDevices() {
-	data, err := ioutil.ReadFile(devicesFile)
-	if err != nil {
-		deviceStorage.Devices = make([]*Device, 0)
+var deviceStorage *DeviceRepository
+
+// NewDeviceRepository creates an empty repository that is saved to the given
+// file. If filename is empty, the repository is not persisted.
+func NewDeviceRepository(filename string) *DeviceRepository {
+	return &DeviceRepository{devices: make([]*Device, 0), filename: filename}
+}
+
+// LoadDeviceRepository loads the repository from the given file. A missing
+// file results in an empty repository.
+func LoadDeviceRepository(filename string) (*DeviceRepository, error) {
+	repository := NewDeviceRepository(filename)
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
 		log.Println("[devices] empty devices list created")
-	} else {
-		json.Unmarshal(data, &deviceStorage)
-		log.Printf("[devices] device list loaded with %d entries\n", len(deviceStorage.Devices))
+		return repository, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var content deviceFileContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, fmt.Errorf("devices file '%s': %v", filename, err)
+	}
+	if content.Devices != nil {
+		repository.devices = content.Devices
+	}
+	repository.migrateSensorTypes()
+	log.Printf("[devices] device list loaded with %d entries\n", len(repository.devices))
+	return repository, nil
+}
+
+// migrateSensorTypes moves sensors whose unit moved to another type, e.g.
+// brightness in lx, to that type, like new readings are. Stored readings keep
+// the type tag they were written with.
+func (r *DeviceRepository) migrateSensorTypes() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, device := range r.devices {
+		for _, sensor := range device.Sensors {
+			unit := sensor.OriginalUnit
+			if unit == "" {
+				unit = sensor.Unit
+			}
+			if migrated := measurement.Default.Migrate(sensor.Type, unit); migrated != sensor.Type {
+				log.Printf("[devices] sensor %d of '%s' migrated from %s to %s\n", sensor.ID, device.ID, sensor.Type, migrated)
+				sensor.Type = migrated
+				r.changed()
+			}
+		}
+	}
+}
+
+// Subscribe registers a listener for changes of the repository.
+func (r *DeviceRepository) Subscribe(listener DeviceListener) {
+	r.mutex.Lock()
+	r.listeners = append(r.listeners, listener)
+	r.mutex.Unlock()
+}
+
+// Devices returns all devices in the order of their discovery.
+func (r *DeviceRepository) Devices() []Device {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	devices := make([]Device, len(r.devices))
+	for i, device := range r.devices {
+		devices[i] = device.clone()
+	}
+	return devices
+}
+
+// Get returns the device with the given id.
+func (r *DeviceRepository) Get(id string) (Device, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if device := r.find(id); device != nil {
+		return device.clone(), true
+	}
+	return Device{}, false
+}
+
+// Device returns the device with the given id and adds it to the repository
+// if it is not known yet.
+func (r *DeviceRepository) Device(id string) Device {
+	r.mutex.Lock()
+	device, added := r.findOrAdd(id)
+	c := device.clone()
+	r.mutex.Unlock()
+
+	if added {
+		r.notify(DeviceEvent{Type: DeviceAdded, Device: c})
+	}
+	return c
+}
+
+// Child returns the device a gateway reports on behalf of and adds it to the
+// repository if necessary. Child ids are global, so a child that belongs to
+// another gateway cannot be claimed; it must be deleted before it can move.
+// Devices that report directly cannot be claimed by a gateway either.
+func (r *DeviceRepository) Child(gatewayID, id string) (Device, error) {
+	var events []DeviceEvent
+	r.mutex.Lock()
+	child, err := r.child(gatewayID, id, &events)
+	var c Device
+	if err == nil {
+		c = child.clone()
+	}
+	r.mutex.Unlock()
+
+	for _, event := range events {
+		r.notify(event)
+	}
+	return c, err
+}
+
+func (r *DeviceRepository) child(gatewayID, id string, events *[]DeviceEvent) (*Device, error) {
+	gateway, added := r.findOrAdd(gatewayID)
+	if added {
+		*events = append(*events, DeviceEvent{Type: DeviceAdded, Device: gateway.clone()})
+	}
+	if gateway.Gateway != "" {
+		return nil, fmt.Errorf("device '%s' is a child of gateway '%s' and cannot act as gateway", gatewayID, gateway.Gateway)
+	}
+	child := r.find(id)
+	if child == nil {
+		child = &Device{ID: id, Gateway: gatewayID, Sensors: []*Sensor{}, DiscoveredAt: time.Now()}
+		r.add(child)
+		gateway.Children = append(gateway.Children, id)
+		*events = append(*events, DeviceEvent{Type: DeviceAdded, Device: child.clone()}, DeviceEvent{Type: DeviceUpdated, Device: gateway.clone()})
+		return child, nil
 	}
+	if child.Gateway == "" {
+		return nil, fmt.Errorf("device '%s' reports directly and cannot be a child of gateway '%s'", id, gatewayID)
+	}
+	if child.Gateway != gatewayID {
+		return nil, fmt.Errorf("device '%s' belongs to gateway '%s' and cannot be claimed by '%s'", id, child.Gateway, gatewayID)
+	}
+	return child, nil
+}
+
+// Resolve returns the device a reading belongs to: the sender itself or the
+// child device the sender reports on behalf of. A child of a gateway cannot
+// report directly.
+func (r *DeviceRepository) Resolve(sender string, reading SensorPayload) (Device, error) {
+	if reading.DeviceID == "" || reading.DeviceID == sender {
+		device := r.Device(sender)
+		if device.Gateway != "" {
+			return Device{}, fmt.Errorf("device '%s' is a child of gateway '%s' and cannot report directly", sender, device.Gateway)
+		}
+		return device, nil
+	}
+	return r.Child(sender, reading.DeviceID)
 }
 
-func saveDevices() {
-	data, err := json.MarshalIndent(deviceStorage, "", "\t")
+// UpdateSensor adds the sensor to the device if it is not known yet. The unit
+// is the canonical unit of the sensor type, originalUnit the unit the sensor
+// reports in. A change of the type or the original unit is recorded, e.g.
+// when readings of the sensor are migrated to another type.
+func (r *DeviceRepository) UpdateSensor(deviceID string, id byte, sensorType string, sensorUnit string, originalUnit string) error {
+	return r.update(deviceID, func(d *Device) bool {
+		for _, sensor := range d.Sensors {
+			if sensor.ID == id {
+				if sensor.Type == sensorType && sensor.Unit == sensorUnit && sensor.OriginalUnit == originalUnit {
+					return false
+				}
+				sensor.Type, sensor.Unit, sensor.OriginalUnit = sensorType, sensorUnit, originalUnit
+				return true
+			}
+		}
+		newSensor := &Sensor{ID: id, Type: sensorType, Unit: sensorUnit, OriginalUnit: originalUnit, DiscoveredAt: time.Now()}
+		d.Sensors = append(d.Sensors, newSensor)
+		log.Printf("[devices] new sensor (%d, %s, %s) added to device '%s'\n", newSensor.ID, newSensor.Type, newSensor.Unit, d.ID)
+		return true
+	})
+}
+
+// SetMetadata replaces the metadata of a device.
+func (r *DeviceRepository) SetMetadata(deviceID string, metadata Metadata) error {
+	metadata, err := metadata.normalize()
 	if err != nil {
-		log.Println("[devices] could not encode devices storage")
-		log.Panicln(err)
+		return err
 	}
-	err = ioutil.WriteFile(devicesFile, data, 0644)
+	return r.update(deviceID, func(d *Device) bool {
+		d.Metadata = metadata
+		return true
+	})
+}
+
+// SetName changes only the display name of a device.
+func (r *DeviceRepository) SetName(deviceID string, name string) error {
+	metadata, err := Metadata{Name: name}.normalize()
 	if err != nil {
-		log.Println("[devices] failed to write devices file")
-		log.Println(err)
+		return err
 	}
+	return r.update(deviceID, func(d *Device) bool {
+		d.Name = metadata.Name
+		return true
+	})
 }
 
-func getDevice(id string) *Device {
-	for _, device := range deviceStorage.Devices {
+// SetSensorMetadata replaces the metadata of a sensor.
+func (r *DeviceRepository) SetSensorMetadata(deviceID string, sensorID byte, metadata Metadata) error {
+	metadata, err := metadata.normalize()
+	if err != nil {
+		return err
+	}
+	found := false
+	err = r.update(deviceID, func(d *Device) bool {
+		for _, sensor := range d.Sensors {
+			if sensor.ID == sensorID {
+				sensor.Metadata = metadata
+				found = true
+			}
+		}
+		return found
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("unknown sensor %d of device '%s'", sensorID, deviceID)
+	}
+	return err
+}
+
+// SetCalibration replaces the calibration of a sensor.
+func (r *DeviceRepository) SetCalibration(deviceID string, sensorID byte, pipeline calibration.Pipeline) error {
+	if err := pipeline.Validate(); err != nil {
+		return err
+	}
+	found := false
+	err := r.update(deviceID, func(d *Device) bool {
+		for _, sensor := range d.Sensors {
+			if sensor.ID == sensorID {
+				sensor.Calibration = pipeline
+				found = true
+			}
+		}
+		return found
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("unknown sensor %d of device '%s'", sensorID, deviceID)
+	}
+	return err
+}
+
+// SetActuators replaces the actuator definitions of a device.
+func (r *DeviceRepository) SetActuators(deviceID string, actuators []Actuator) error {
+	definitions := make([]*Actuator, len(actuators))
+	seen := make(map[byte]bool)
+	for i, actuator := range actuators {
+		if seen[actuator.ID] {
+			return fmt.Errorf("duplicate actuator %d", actuator.ID)
+		}
+		if !actuatorTypes[actuator.Type] {
+			return fmt.Errorf("unknown actuator type '%s'", actuator.Type)
+		}
+		metadata, err := actuator.Metadata.normalize()
+		if err != nil {
+			return err
+		}
+		seen[actuator.ID] = true
+		definition := actuator
+		definition.Metadata = metadata
+		definitions[i] = &definition
+	}
+	return r.update(deviceID, func(d *Device) bool {
+		d.Actuators = definitions
+		return true
+	})
+}
+
+// RetireSensor hides a sensor or makes a retired sensor visible again.
+func (r *DeviceRepository) RetireSensor(deviceID string, sensorID byte, retired bool) error {
+	found := false
+	err := r.update(deviceID, func(d *Device) bool {
+		for _, sensor := range d.Sensors {
+			if sensor.ID != sensorID {
+				continue
+			}
+			found = true
+			if retired == (sensor.RetiredAt != nil) {
+				return false
+			}
+			if retired {
+				now := time.Now()
+				sensor.RetiredAt = &now
+			} else {
+				sensor.RetiredAt = nil
+			}
+			return true
+		}
+		return false
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("unknown sensor %d of device '%s'", sensorID, deviceID)
+	}
+	return err
+}
+
+// Delete removes a device. Gateways can only be deleted after their children.
+func (r *DeviceRepository) Delete(id string) error {
+	var events []DeviceEvent
+	r.mutex.Lock()
+	err := r.delete(id, &events)
+	r.mutex.Unlock()
+
+	for _, event := range events {
+		r.notify(event)
+	}
+	return err
+}
+
+// CheckDelete returns the error Delete would return without deleting the
+// device, so that e.g. its stored data is only changed if it can be deleted.
+func (r *DeviceRepository) CheckDelete(id string) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.checkDelete(id)
+}
+
+func (r *DeviceRepository) checkDelete(id string) error {
+	device := r.find(id)
+	if device == nil {
+		return fmt.Errorf("unknown device '%s'", id)
+	}
+	if len(device.Children) > 0 {
+		return fmt.Errorf("device '%s' is the gateway of %d devices", id, len(device.Children))
+	}
+	return nil
+}
+
+func (r *DeviceRepository) delete(id string, events *[]DeviceEvent) error {
+	if err := r.checkDelete(id); err != nil {
+		return err
+	}
+	device := r.find(id)
+	if gateway := r.find(device.Gateway); gateway != nil {
+		gateway.Children = removeString(gateway.Children, id)
+		*events = append(*events, DeviceEvent{Type: DeviceUpdated, Device: gateway.clone()})
+	}
+	for i, d := range r.devices {
+		if d == device {
+			r.devices = append(r.devices[:i], r.devices[i+1:]...)
+			break
+		}
+	}
+	*events = append(*events, DeviceEvent{Type: DeviceDeleted, Device: device.clone()})
+	log.Printf("[devices] device '%s' deleted from device storage\n", id)
+	r.changed()
+	return nil
+}
+
+// Merge moves the sensors and children of the source device to the target
+// device and deletes the source. Sensors known to both keep the properties of
+// the target sensor. Empty metadata fields of the target are filled in from
+// the source.
+func (r *DeviceRepository) Merge(sourceID, targetID string) (Device, error) {
+	var events []DeviceEvent
+	r.mutex.Lock()
+	target, err := r.merge(sourceID, targetID, &events)
+	var c Device
+	if err == nil {
+		c = target.clone()
+		events = append(events, DeviceEvent{Type: DeviceUpdated, Device: c})
+	}
+	r.mutex.Unlock()
+
+	for _, event := range events {
+		r.notify(event)
+	}
+	return c, err
+}
+
+// CheckMerge returns the error Merge would return without merging the
+// devices.
+func (r *DeviceRepository) CheckMerge(sourceID, targetID string) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.checkMerge(sourceID, targetID)
+}
+
+func (r *DeviceRepository) checkMerge(sourceID, targetID string) error {
+	if sourceID == targetID {
+		return errors.New("cannot merge a device with itself")
+	}
+	source, target := r.find(sourceID), r.find(targetID)
+	if source == nil {
+		return fmt.Errorf("unknown device '%s'", sourceID)
+	}
+	if target == nil {
+		return fmt.Errorf("unknown device '%s'", targetID)
+	}
+	if target.Gateway == sourceID || source.Gateway == targetID {
+		return errors.New("cannot merge a gateway with its child")
+	}
+	// The children would become children of a child.
+	if len(source.Children) > 0 && target.Gateway != "" {
+		return fmt.Errorf("cannot merge a gateway into '%s', which is a child of gateway '%s'", targetID, target.Gateway)
+	}
+	return nil
+}
+
+func (r *DeviceRepository) merge(sourceID, targetID string, events *[]DeviceEvent) (*Device, error) {
+	if err := r.checkMerge(sourceID, targetID); err != nil {
+		return nil, err
+	}
+	source, target := r.find(sourceID), r.find(targetID)
+
+	for _, sensor := range source.Sensors {
+		existing := false
+		for _, targetSensor := range target.Sensors {
+			if targetSensor.ID == sensor.ID {
+				existing = true
+				if sensor.DiscoveredAt.Before(targetSensor.DiscoveredAt) {
+					targetSensor.DiscoveredAt = sensor.DiscoveredAt
+				}
+			}
+		}
+		if !existing {
+			target.Sensors = append(target.Sensors, sensor)
+		}
+	}
+	for _, childID := range source.Children {
+		if child := r.find(childID); child != nil {
+			child.Gateway = targetID
+			target.Children = append(target.Children, childID)
+			*events = append(*events, DeviceEvent{Type: DeviceUpdated, Device: child.clone()})
+		}
+	}
+	source.Children = nil
+
+	metadata := &target.Metadata
+	for _, field := range []struct{ target, source *string }{
+		{&metadata.Name, &source.Name},
+		{&metadata.Location, &source.Location},
+		{&metadata.Room, &source.Room},
+		{&metadata.Notes, &source.Notes},
+	} {
+		if *field.target == "" {
+			*field.target = *field.source
+		}
+	}
+	for _, tag := range source.Tags {
+		if !metadata.hasTag(tag) {
+			metadata.Tags = append(metadata.Tags, tag)
+		}
+	}
+	if source.DiscoveredAt.Before(target.DiscoveredAt) {
+		target.DiscoveredAt = source.DiscoveredAt
+	}
+
+	log.Printf("[devices] device '%s' merged into '%s'\n", sourceID, targetID)
+	return target, r.delete(sourceID, events)
+}
+
+// update applies a change to a known device. The change function reports
+// whether it modified the device.
+func (r *DeviceRepository) update(id string, change func(d *Device) bool) error {
+	r.mutex.Lock()
+	device := r.find(id)
+	if device == nil {
+		r.mutex.Unlock()
+		return fmt.Errorf("unknown device '%s'", id)
+	}
+	changed := change(device)
+	var c Device
+	if changed {
+		c = device.clone()
+		r.changed()
+	}
+	r.mutex.Unlock()
+
+	if changed {
+		r.notify(DeviceEvent{Type: DeviceUpdated, Device: c})
+	}
+	return nil
+}
+
+// find returns the device with the given id or nil. The caller must hold the
+// mutex.
+func (r *DeviceRepository) find(id string) *Device {
+	for _, device := range r.devices {
 		if device.ID == id {
 			return device
 		}
 	}
-	newDevice := &Device{ID: id, Sensors: []*Sensor{}, DiscoveredAt: time.Now()}
-	addDevice(newDevice)
-	return newDevice
+	return nil
 }
 
-func (d *Device) updateSensor(id byte, sensorType string, sensorUnit string) *Sensor {
-	for _, sensor := range d.Sensors {
-		if sensor.ID == id {
-			return sensor
+// findOrAdd returns the device with the given id, adding it if necessary. The
+// caller must hold the mutex.
+func (r *DeviceRepository) findOrAdd(id string) (device *Device, added bool) {
+	if device := r.find(id); device != nil {
+		return device, false
+	}
+	device = &Device{ID: id, Sensors: []*Sensor{}, DiscoveredAt: time.Now()}
+	r.add(device)
+	return device, true
+}
+
+// add appends a new device. The caller must hold the mutex.
+func (r *DeviceRepository) add(d *Device) {
+	r.devices = append(r.devices, d)
+	log.Printf("[devices] new device '%s' added to device storage\n", d.ID)
+	r.changed()
+}
+
+func (r *DeviceRepository) notify(event DeviceEvent) {
+	r.mutex.RLock()
+	listeners := r.listeners
+	r.mutex.RUnlock()
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
+
+// changed schedules saving the repository. The caller must hold the mutex.
+func (r *DeviceRepository) changed() {
+	if r.filename == "" {
+		return
+	}
+	r.dirty = true
+	if r.saveTimer == nil {
+		r.saveTimer = time.AfterFunc(devicesSaveDelay, func() {
+			if err := r.Flush(); err != nil {
+				log.Println("[devices] failed to write devices file")
+				log.Println(err)
+			}
+		})
+	}
+}
+
+// Flush writes pending changes to the devices file. The file is replaced
+// atomically, so a crash never leaves a partially written file behind.
+func (r *DeviceRepository) Flush() error {
+	r.saveMutex.Lock()
+	defer r.saveMutex.Unlock()
+
+	r.mutex.Lock()
+	if r.saveTimer != nil {
+		r.saveTimer.Stop()
+		r.saveTimer = nil
+	}
+	if !r.dirty {
+		r.mutex.Unlock()
+		return nil
+	}
+	r.dirty = false
+	data, err := json.MarshalIndent(deviceFileContent{Devices: r.devices}, "", "\t")
+	r.mutex.Unlock()
+	if err != nil {
+		log.Println("[devices] could not encode devices storage")
+		log.Panicln(err)
+	}
+
+	tmp := r.filename + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, r.filename)
+	}
+	if err != nil {
+		r.mutex.Lock()
+		r.changed()
+		r.mutex.Unlock()
+	}
+	return err
+}
+
+func removeString(list []string, value string) []string {
+	result := list[:0]
+	for _, element := range list {
+		if element != value {
+			result = append(result, element)
 		}
 	}
-	newSensor := &Sensor{ID: id, Type: sensorType, Unit: sensorUnit, DiscoveredAt: time.Now()}
-	d.Sensors = append(d.Sensors, newSensor)
-	log.Printf("[devices] new sensor (%d, %s, %s) added to device '%s'\n", newSensor.ID, newSensor.Type, newSensor.Unit, d.ID)
-	saveDevices()
-	return newSensor
+	return result
 }
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/calibration"
+)
+
+func TestDeviceRepositoryConcurrentDiscovery(t *testing.T) {
+	repository := NewDeviceRepository("")
+	var added sync.Map
+	repository.Subscribe(func(event DeviceEvent) {
+		if event.Type == DeviceAdded {
+			added.Store(event.Device.ID, true)
+		}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				id := fmt.Sprintf("device%d", j%10)
+				repository.Device(id)
+				repository.UpdateSensor(id, byte(i), "temperature", "°C", "°F")
+				repository.Child("gateway", fmt.Sprintf("child%d", j%5))
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := json.Marshal(repository.Devices()); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	devices := repository.Devices()
+	if len(devices) != 16 {
+		t.Fatalf("expected 16 devices, actual %d", len(devices))
+	}
+	for _, device := range devices {
+		if _, ok := added.Load(device.ID); !ok {
+			t.Fatalf("no event for added device '%s'", device.ID)
+		}
+	}
+	gateway, _ := repository.Get("gateway")
+	if len(gateway.Children) != 5 {
+		t.Fatalf("expected 5 children of gateway, actual %v", gateway.Children)
+	}
+	device, _ := repository.Get("device0")
+	if len(device.Sensors) != 8 {
+		t.Fatalf("expected 8 sensors, actual %d", len(device.Sensors))
+	}
+}
+
+func TestDeviceRepositoryReturnsCopies(t *testing.T) {
+	repository := NewDeviceRepository("")
+	repository.Device("shredder")
+	repository.UpdateSensor("shredder", 1, "temperature", "°C", "°C")
+
+	device, _ := repository.Get("shredder")
+	device.Sensors[0].Unit = "changed"
+
+	stored, _ := repository.Get("shredder")
+	if stored.Sensors[0].Unit != "°C" {
+		t.Fatal("modifying a returned device changed the repository")
+	}
+}
+
+func TestUpdateSensorMigratesType(t *testing.T) {
+	repository := NewDeviceRepository("")
+	repository.Device("window")
+	repository.UpdateSensor("window", 1, "brightness", "lx", "lx")
+
+	repository.UpdateSensor("window", 1, "illuminance", "lx", "lx")
+
+	device, _ := repository.Get("window")
+	if len(device.Sensors) != 1 || device.Sensors[0].Type != "illuminance" {
+		t.Fatalf("sensor was not migrated: %+v", device.Sensors)
+	}
+}
+
+func TestLoadDeviceRepositoryMigratesTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "devices.json")
+	data := `{"devices": [{"id": "window", "sensors": [{"id": 1, "type": "brightness", "unit": "lx"}, {"id": 2, "type": "brightness", "unit": "%"}]}]}`
+	ioutil.WriteFile(filename, []byte(data), 0644)
+
+	repository, err := LoadDeviceRepository(filename)
+
+	if err != nil {
+		t.Fatalf("LoadDeviceRepository returned err: %v", err)
+	}
+	device, _ := repository.Get("window")
+	if device.Sensors[0].Type != "illuminance" || device.Sensors[1].Type != "brightness" {
+		t.Fatalf("unexpected sensor types after migration: %+v", device.Sensors)
+	}
+	if err := repository.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ := LoadDeviceRepository(filename)
+	if device, _ := loaded.Get("window"); device.Sensors[0].Type != "illuminance" {
+		t.Fatal("migrated sensor type was not saved")
+	}
+}
+
+func TestDeviceRepositoryPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "devices.json")
+
+	repository, err := LoadDeviceRepository(filename)
+	if err != nil {
+		t.Fatalf("LoadDeviceRepository returned err for missing file: %v", err)
+	}
+	repository.Child("gateway", "FFFF")
+	if err := repository.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadDeviceRepository(filename)
+
+	if err != nil {
+		t.Fatalf("LoadDeviceRepository returned err: %v", err)
+	}
+	child, ok := loaded.Get("FFFF")
+	if !ok || child.Gateway != "gateway" {
+		t.Fatalf("expected child of 'gateway', actual %+v", child)
+	}
+	if _, err := loaded.Child("FFFF", "gateway"); err == nil {
+		t.Fatal("Child accepted child device as gateway")
+	}
+	if _, err := loaded.Child("other", "FFFF"); err == nil {
+		t.Fatal("Child reassigned a child of another gateway")
+	}
+	if child, _ := loaded.Get("FFFF"); child.Gateway != "gateway" {
+		t.Fatalf("child moved to gateway '%s'", child.Gateway)
+	}
+	if _, err := loaded.Resolve("FFFF", SensorPayload{}); err == nil {
+		t.Fatal("Resolve accepted a reading of a child reporting directly")
+	}
+	if device, err := loaded.Resolve("gateway", SensorPayload{DeviceID: "gateway"}); err != nil || device.ID != "gateway" {
+		t.Fatalf("unexpected device %+v of a gateway reporting directly: %v", device, err)
+	}
+}
+
+func TestDeviceRepositoryMergeAndDelete(t *testing.T) {
+	repository := NewDeviceRepository("")
+	repository.UpdateSensor(repository.Device("typo").ID, 1, "temperature", "°C", "°C")
+	repository.UpdateSensor(repository.Device("typo").ID, 2, "humidity", "%", "%")
+	repository.UpdateSensor(repository.Device("shredder").ID, 1, "temperature", "°C", "°C")
+	repository.SetMetadata("typo", Metadata{Room: "Kitchen"})
+	repository.Child("typo", "FFFF")
+
+	merged, err := repository.Merge("typo", "shredder")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.Sensors) != 2 || merged.Room != "Kitchen" || len(merged.Children) != 1 {
+		t.Fatalf("unexpected merged device %+v", merged)
+	}
+	if child, _ := repository.Get("FFFF"); child.Gateway != "shredder" {
+		t.Fatalf("child was not moved to target, gateway is '%s'", child.Gateway)
+	}
+	if _, ok := repository.Get("typo"); ok {
+		t.Fatal("source device still exists after merge")
+	}
+	if err := repository.CheckDelete("shredder"); err == nil {
+		t.Fatal("CheckDelete accepted gateway with children")
+	}
+	if err := repository.CheckMerge("FFFF", "shredder"); err == nil {
+		t.Fatal("CheckMerge accepted child and its gateway")
+	}
+	repository.Child("other", "EEEE")
+	if _, err := repository.Merge("shredder", "EEEE"); err == nil {
+		t.Fatal("Merge moved children under a child")
+	}
+	if child, _ := repository.Get("FFFF"); child.Gateway != "shredder" {
+		t.Fatalf("failed merge moved the child to '%s'", child.Gateway)
+	}
+	if err := repository.Delete("shredder"); err == nil {
+		t.Fatal("Delete accepted gateway with children")
+	}
+	if err := repository.Delete("FFFF"); err != nil {
+		t.Fatal(err)
+	}
+	if gateway, _ := repository.Get("shredder"); len(gateway.Children) != 0 {
+		t.Fatalf("deleted child is still listed: %v", gateway.Children)
+	}
+}
+
+func TestDeviceRepositoryRetireSensor(t *testing.T) {
+	repository := NewDeviceRepository("")
+	repository.UpdateSensor(repository.Device("shredder").ID, 1, "temperature", "°C", "°C")
+
+	if err := repository.RetireSensor("shredder", 1, true); err != nil {
+		t.Fatal(err)
+	}
+	device, _ := repository.Get("shredder")
+	if device.Sensors[0].RetiredAt == nil {
+		t.Fatal("sensor was not retired")
+	}
+	if err := repository.RetireSensor("shredder", 2, true); err == nil {
+		t.Fatal("RetireSensor accepted unknown sensor")
+	}
+}
+
+func TestDeviceRepositorySetCalibration(t *testing.T) {
+	repository := NewDeviceRepository("")
+	repository.UpdateSensor(repository.Device("shredder").ID, 1, "temperature", "°C", "°C")
+
+	err := repository.SetCalibration("shredder", 1, calibration.Pipeline{{Type: calibration.Offset, Value: -1.5}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, _ := repository.Get("shredder")
+	if value := device.calibration(1).Apply(23); value != 21.5 {
+		t.Fatalf("expected calibrated value 21.5, actual %v", value)
+	}
+	if err := repository.SetCalibration("shredder", 1, calibration.Pipeline{{Type: "log"}}); err == nil {
+		t.Fatal("SetCalibration accepted invalid pipeline")
+	}
+	if err := repository.SetCalibration("shredder", 2, nil); err == nil {
+		t.Fatal("SetCalibration accepted unknown sensor")
+	}
+}
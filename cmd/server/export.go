@@ -0,0 +1,246 @@
+package main
+
+// This file implements the export of stored readings through the web API and
+// the export subcommand.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+	"github.com/iot-bp-project-2018/raspi-server/internal/export"
+	"github.com/iot-bp-project-2018/raspi-server/internal/storage"
+)
+
+// exportOptions select the columns of CSV and JSON Lines exports.
+var exportOptions = export.Options{
+	Tags:   []string{"device", "sensor", "type", "unit", "originalUnit", "gateway"},
+	Fields: []string{"value", "raw"},
+}
+
+// exportQueries returns the queries of the readings of the devices and
+// sensors. Sensors of devices that are exported as a whole are skipped.
+func exportQueries(devices []string, sensors []SensorRef, from, to time.Time) ([]storage.Query, error) {
+	if !from.Before(to) {
+		return nil, errors.New("Begin of the time range must be before its end")
+	}
+	if to.Sub(from) > maxQueryRange {
+		return nil, fmt.Errorf("Time range exceeds %d days", maxQueryRange/(24*time.Hour))
+	}
+	var matches []Tags
+	whole := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		if !commproto.ValidAddress(device) {
+			return nil, fmt.Errorf("Bad device id '%s'", device)
+		}
+		if !whole[device] {
+			whole[device] = true
+			matches = append(matches, Tags{"device": device})
+		}
+	}
+	seen := make(map[SensorRef]bool, len(sensors))
+	for _, sensor := range sensors {
+		if !commproto.ValidAddress(sensor.DeviceID) {
+			return nil, fmt.Errorf("Bad device id '%s'", sensor.DeviceID)
+		}
+		if !whole[sensor.DeviceID] && !seen[sensor] {
+			seen[sensor] = true
+			matches = append(matches, Tags{"device": sensor.DeviceID, "sensor": strconv.Itoa(int(sensor.SensorID))})
+		}
+	}
+	if len(matches) == 0 {
+		return nil, errors.New("No devices or sensors selected")
+	}
+	if len(matches) > maxFilteredSeries {
+		return nil, fmt.Errorf("Export selects more than %d devices and sensors", maxFilteredSeries)
+	}
+	queries := make([]storage.Query, len(matches))
+	for i, match := range matches {
+		queries[i] = storage.Query{Measurement: "datapoint", Match: match, From: from, To: to}
+	}
+	return queries, nil
+}
+
+// exportLocation returns the time zone of an export, UTC if timezone is empty.
+func exportLocation(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.UTC, nil
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil || timezone == "Local" {
+		return nil, fmt.Errorf("Unknown timezone '%s'", timezone)
+	}
+	return location, nil
+}
+
+// prepare validates the request and returns the format, the time zone and
+// the queries of the export.
+func (r ExportRequest) prepare() (export.Format, *time.Location, []storage.Query, error) {
+	format := export.Format(r.Format)
+	if !format.Valid() {
+		return "", nil, nil, fmt.Errorf("Unknown export format '%s'", r.Format)
+	}
+	location, err := exportLocation(r.Timezone)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	sensors := r.Sensors
+	if r.Filter != nil {
+		sensors = append(sensors[:len(sensors):len(sensors)], selectSensors(*r.Filter)...)
+	}
+	from, to := time.Unix(int64(r.BeginUnix), 0), time.Unix(int64(r.EndUnix), 0)
+	queries, err := exportQueries(r.Devices, sensors, from, to)
+	return format, location, queries, err
+}
+
+// exportReadings writes the readings selected by the queries to w in chunks
+// of exportChunk and returns the number of readings written.
+func exportReadings(w io.Writer, format export.Format, location *time.Location, queries []storage.Query) (int, error) {
+	if dataStore == nil {
+		return 0, errNoStorage
+	}
+	options := exportOptions
+	options.Location = location
+	writer, err := export.NewWriter(w, format, options)
+	if err != nil {
+		return 0, err
+	}
+	return export.Export(writer, dataStore, queries, exportChunk)
+}
+
+const exportUsage = `usage: server [flags] export [export flags]
+
+Writes the readings of the selected devices and sensors stored in the storage
+selected with -storage. Stop the server before exporting from the embedded
+storage.
+
+export flags:
+`
+
+// parseExportTime parses an RFC 3339 time or a date, which stands for
+// midnight in the location.
+func parseExportTime(value string, location *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, location)
+}
+
+// parseSensorRefs parses a comma separated list of DEVICE:SENSOR.
+func parseSensorRefs(value string) ([]SensorRef, error) {
+	var sensors []SensorRef
+	for _, ref := range strings.Split(value, ",") {
+		index := strings.LastIndex(ref, ":")
+		if index == -1 {
+			return nil, fmt.Errorf("invalid sensor '%s', expected DEVICE:SENSOR", ref)
+		}
+		id, err := strconv.ParseUint(ref[index+1:], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sensor id in '%s'", ref)
+		}
+		sensors = append(sensors, SensorRef{DeviceID: ref[:index], SensorID: byte(id)})
+	}
+	return sensors, nil
+}
+
+// runExport implements the export subcommand and returns the exit code.
+func runExport(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	formatFlag := flags.String("format", string(export.CSV), "output `format` (csv, ndjson or lineprotocol)")
+	fromFlag := flags.String("from", "", "export readings from this `time` (RFC 3339 or YYYY-MM-DD)")
+	toFlag := flags.String("to", "", "export readings before this `time` (RFC 3339 or YYYY-MM-DD), default now")
+	devicesFlag := flags.String("devices", "", "comma separated `ids` of devices to export")
+	sensorsFlag := flags.String("sensors", "", "comma separated `sensors` to export as DEVICE:SENSOR")
+	timezoneFlag := flags.String("timezone", "", "time `zone` of dates and exported times, default UTC")
+	outputFlag := flags.String("output", "", "write to `file` instead of standard output")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, exportUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return 2
+	}
+
+	request := ExportRequest{Format: *formatFlag, Timezone: *timezoneFlag}
+	if *devicesFlag != "" {
+		request.Devices = strings.Split(*devicesFlag, ",")
+	}
+	if *sensorsFlag != "" {
+		sensors, err := parseSensorRefs(*sensorsFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		request.Sensors = sensors
+	}
+	location, err := exportLocation(request.Timezone)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *fromFlag == "" {
+		fmt.Fprintln(os.Stderr, "missing -from")
+		return 2
+	}
+	from, err := parseExportTime(*fromFlag, location)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid -from:", err)
+		return 2
+	}
+	to := time.Now()
+	if *toFlag != "" {
+		if to, err = parseExportTime(*toFlag, location); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid -to:", err)
+			return 2
+		}
+	}
+	request.BeginUnix, request.EndUnix = int(from.Unix()), int(to.Unix())
+	format, location, queries, err := request.prepare()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if err := loadSecrets(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// The export only reads, so the embedded storage is not compacted.
+	options := storageOptions(*storageFlag)
+	options.CompactInterval = 0
+	store, err := storage.Open(*storageFlag, options)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	dataStore = store
+	defer store.Close()
+
+	var out io.Writer = os.Stdout
+	var file *os.File
+	if *outputFlag != "" {
+		if file, err = os.Create(*outputFlag); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		out = file
+	}
+	count, err := exportReadings(out, format, location, queries)
+	if file != nil {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export failed:", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "exported %d readings\n", count)
+	return 0
+}
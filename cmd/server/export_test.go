@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportReadings(t *testing.T) {
+	useEmbeddedStorage(t)
+	at := time.Unix(1546300800, 0)
+	collectMetrics([]Point{
+		{Measurement: "datapoint", Tags: Tags{"device": "shredder", "sensor": "1", "unit": "°C"}, Fields: Fields{"value": 21.5, "raw": 21.0}, Time: at},
+		{Measurement: "datapoint", Tags: Tags{"device": "shredder", "sensor": "2", "unit": "%"}, Fields: Fields{"value": 40.0}, Time: at.Add(36 * time.Hour)},
+		{Measurement: "datapoint", Tags: Tags{"device": "window", "sensor": "1", "unit": "°C"}, Fields: Fields{"value": 5.0}, Time: at.Add(time.Hour)},
+		{Measurement: "datapoint", Tags: Tags{"device": "window", "sensor": "2", "unit": "%"}, Fields: Fields{"value": 80.0}, Time: at.Add(time.Hour)},
+	})
+	ingestQueue.Flush()
+
+	request := ExportRequest{
+		Devices:   []string{"shredder"},
+		Sensors:   []SensorRef{{DeviceID: "window", SensorID: 1}, {DeviceID: "shredder", SensorID: 1}},
+		BeginUnix: int(at.Unix()),
+		EndUnix:   int(at.Add(72 * time.Hour).Unix()),
+		Format:    "csv",
+		Timezone:  "Europe/Berlin",
+	}
+	format, location, queries, err := request.prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 2 {
+		t.Fatalf("expected 2 queries, got %d", len(queries))
+	}
+	var buffer bytes.Buffer
+	count, err := exportReadings(&buffer, format, location, queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"time,device,sensor,type,unit,originalUnit,gateway,value,raw",
+		"2019-01-01T01:00:00+01:00,shredder,1,,°C,,,21.5,21",
+		"2019-01-01T02:00:00+01:00,window,1,,°C,,,5,",
+		"2019-01-02T13:00:00+01:00,shredder,2,,%,,,40,",
+		"",
+	}
+	if count != 3 || buffer.String() != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected export of %d readings:\n%s", count, buffer.String())
+	}
+}
+
+func TestExportRequestValidation(t *testing.T) {
+	valid := ExportRequest{Devices: []string{"shredder"}, BeginUnix: 0, EndUnix: 60, Format: "ndjson"}
+	if _, _, _, err := valid.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range []func(r *ExportRequest){
+		func(r *ExportRequest) { r.Format = "xml" },
+		func(r *ExportRequest) { r.Devices = nil },
+		func(r *ExportRequest) { r.Devices = []string{"bad\nid"} },
+		func(r *ExportRequest) { r.EndUnix = r.BeginUnix },
+		func(r *ExportRequest) { r.EndUnix = int(maxQueryRange/time.Second) + 1 },
+		func(r *ExportRequest) { r.Timezone = "Local" },
+	} {
+		request := valid
+		change(&request)
+		if _, _, _, err := request.prepare(); err == nil {
+			t.Errorf("invalid request was accepted: %+v", request)
+		}
+	}
+}
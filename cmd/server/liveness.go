@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Liveness describes when a device or sensor last reported and how often it
+// reports.
+type Liveness struct {
+	LastSeen  time.Time `json:"lastSeen"`
+	LastValue *float64  `json:"lastValue,omitempty"`
+	Messages  uint64    `json:"messages"`
+	// IntervalSeconds is the moving average of the time between two reports.
+	IntervalSeconds float64 `json:"intervalSeconds,omitempty"`
+	// RatePerMinute is derived from IntervalSeconds.
+	RatePerMinute float64 `json:"ratePerMinute,omitempty"`
+}
+
+// record updates the liveness with a report at the given time.
+func (l *Liveness) record(at time.Time) {
+	if !l.LastSeen.IsZero() {
+		if gap := at.Sub(l.LastSeen).Seconds(); gap > 0 {
+			if l.IntervalSeconds == 0 {
+				l.IntervalSeconds = gap
+			} else {
+				l.IntervalSeconds += livenessSmoothing * (gap - l.IntervalSeconds)
+			}
+			l.RatePerMinute = 60 / l.IntervalSeconds
+		}
+	}
+	if at.After(l.LastSeen) {
+		l.LastSeen = at
+	}
+	l.Messages++
+}
+
+// DeviceLiveness is the liveness of a device and its sensors.
+type DeviceLiveness struct {
+	Liveness
+	Online  bool              `json:"online"`
+	Sensors map[byte]Liveness `json:"sensors,omitempty"`
+}
+
+// timeout returns how long the device may be silent before it is considered
+// offline.
+func (l *DeviceLiveness) timeout(factor float64) time.Duration {
+	if l.IntervalSeconds == 0 {
+		return livenessDefaultTimeout
+	}
+	timeout := time.Duration(factor * l.IntervalSeconds * float64(time.Second))
+	if timeout < livenessMinTimeout {
+		return livenessMinTimeout
+	}
+	return timeout
+}
+
+func (l *DeviceLiveness) clone() DeviceLiveness {
+	c := *l
+	c.Sensors = make(map[byte]Liveness, len(l.Sensors))
+	for id, sensor := range l.Sensors {
+		c.Sensors[id] = sensor
+	}
+	return c
+}
+
+// LivenessEventType describes a change of the online state of a device.
+type LivenessEventType string
+
+// Liveness changes
+const (
+	DeviceOnline  LivenessEventType = "device-online"
+	DeviceOffline LivenessEventType = "device-offline"
+)
+
+// LivenessEvent is emitted when a device goes online or offline.
+type LivenessEvent struct {
+	Type     LivenessEventType `json:"type"`
+	DeviceID string            `json:"deviceId"`
+	LastSeen time.Time         `json:"lastSeen"`
+	Time     time.Time         `json:"time"`
+}
+
+// LivenessTracker keeps the liveness of all devices in memory. A device is
+// considered offline if it has not reported for OfflineFactor times its
+// observed reporting interval.
+type LivenessTracker struct {
+	OfflineFactor float64
+
+	mutex     sync.Mutex
+	devices   map[string]*DeviceLiveness
+	recent    []LivenessEvent
+	listeners []func(LivenessEvent)
+	filename  string
+	dirty     bool
+}
+
+var liveness *LivenessTracker
+
+// LoadLivenessTracker creates a tracker and restores the liveness saved in the
+// given file, if it exists.
+func LoadLivenessTracker(filename string, offlineFactor float64) (*LivenessTracker, error) {
+	tracker := &LivenessTracker{OfflineFactor: offlineFactor, devices: make(map[string]*DeviceLiveness), filename: filename}
+	if filename == "" {
+		return tracker, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return tracker, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &tracker.devices); err != nil {
+		return nil, fmt.Errorf("liveness file '%s': %v", filename, err)
+	}
+	return tracker, nil
+}
+
+// Subscribe registers a listener for liveness events. Listeners are called
+// with the tracker mutex held and must not call back into the tracker.
+func (t *LivenessTracker) Subscribe(listener func(LivenessEvent)) {
+	t.mutex.Lock()
+	t.listeners = append(t.listeners, listener)
+	t.mutex.Unlock()
+}
+
+// RecordMessage records that a message concerning the device arrived.
+func (t *LivenessTracker) RecordMessage(deviceID string, at time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	device := t.device(deviceID)
+	device.record(at)
+	if !device.Online {
+		device.Online = true
+		t.emit(LivenessEvent{Type: DeviceOnline, DeviceID: deviceID, LastSeen: device.LastSeen, Time: at})
+	}
+	t.dirty = true
+}
+
+// RecordReading records a reading of a sensor measured at the given time.
+func (t *LivenessTracker) RecordReading(deviceID string, sensorID byte, value float64, at time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	device := t.device(deviceID)
+	sensor := device.Sensors[sensorID]
+	if !at.Before(sensor.LastSeen) {
+		sensor.LastValue = &value
+	}
+	sensor.record(at)
+	device.Sensors[sensorID] = sensor
+	t.dirty = true
+}
+
+// device returns the liveness of a device. The caller must hold the mutex.
+func (t *LivenessTracker) device(id string) *DeviceLiveness {
+	device, ok := t.devices[id]
+	if !ok {
+		device = &DeviceLiveness{}
+		t.devices[id] = device
+	}
+	if device.Sensors == nil {
+		device.Sensors = make(map[byte]Liveness)
+	}
+	return device
+}
+
+// Forget removes a device, e.g. after it was deleted.
+func (t *LivenessTracker) Forget(deviceID string) {
+	t.mutex.Lock()
+	delete(t.devices, deviceID)
+	t.dirty = true
+	t.mutex.Unlock()
+}
+
+// Get returns the liveness of a device.
+func (t *LivenessTracker) Get(deviceID string) (DeviceLiveness, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	device, ok := t.devices[deviceID]
+	if !ok {
+		return DeviceLiveness{}, false
+	}
+	return device.clone(), true
+}
+
+// RecentEvents returns the last liveness events.
+func (t *LivenessTracker) RecentEvents() []LivenessEvent {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]LivenessEvent(nil), t.recent...)
+}
+
+// Check marks all devices offline that have been silent for too long.
+func (t *LivenessTracker) Check(now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for id, device := range t.devices {
+		if device.Online && now.Sub(device.LastSeen) > device.timeout(t.OfflineFactor) {
+			device.Online = false
+			t.dirty = true
+			t.emit(LivenessEvent{Type: DeviceOffline, DeviceID: id, LastSeen: device.LastSeen, Time: now})
+		}
+	}
+}
+
+// emit records and publishes an event. The caller must hold the mutex.
+func (t *LivenessTracker) emit(event LivenessEvent) {
+	log.Printf("[liveness] device '%s' is %s (last seen %s)\n", event.DeviceID, event.Type[len("device-"):], event.LastSeen.Format(time.RFC3339))
+	t.recent = append(t.recent, event)
+	if len(t.recent) > livenessRecentEvents {
+		t.recent = t.recent[len(t.recent)-livenessRecentEvents:]
+	}
+	for _, listener := range t.listeners {
+		listener(event)
+	}
+}
+
+// Save writes the liveness of all devices to the file, if anything changed.
+// The changes stay pending if writing fails, so the next Save retries.
+func (t *LivenessTracker) Save() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.dirty || t.filename == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(t.devices, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := t.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, t.filename); err != nil {
+		return err
+	}
+	t.dirty = false
+	return nil
+}
+
+// startLivenessTracking checks the liveness of all devices and saves it
+// periodically. Deleted devices are forgotten.
+func startLivenessTracking(tracker *LivenessTracker, devices *DeviceRepository) {
+	devices.Subscribe(func(event DeviceEvent) {
+		if event.Type == DeviceDeleted {
+			tracker.Forget(event.Device.ID)
+		}
+	})
+	go func() {
+		check := time.NewTicker(livenessCheckInterval)
+		save := time.NewTicker(livenessSaveInterval)
+		for {
+			select {
+			case now := <-check.C:
+				tracker.Check(now)
+			case <-save.C:
+				if err := tracker.Save(); err != nil {
+					log.Println("[liveness] failed to write liveness file")
+					log.Println(err)
+				}
+			}
+		}
+	}()
+}
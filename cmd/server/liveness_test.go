@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLivenessOfflineDetection(t *testing.T) {
+	tracker, _ := LoadLivenessTracker("", 3)
+	var events []LivenessEvent
+	tracker.Subscribe(func(event LivenessEvent) {
+		events = append(events, event)
+	})
+	start := time.Unix(1546300800, 0)
+	for i := 0; i < 5; i++ {
+		tracker.RecordMessage("shredder", start.Add(time.Duration(i)*time.Minute))
+	}
+	last := start.Add(4 * time.Minute)
+
+	tracker.Check(last.Add(2 * time.Minute))
+	if l, _ := tracker.Get("shredder"); !l.Online || l.RatePerMinute != 1 {
+		t.Fatalf("expected online device with 1 message per minute, actual %+v", l)
+	}
+	tracker.Check(last.Add(4 * time.Minute))
+	if l, _ := tracker.Get("shredder"); l.Online {
+		t.Fatal("device silent for four intervals is still online")
+	}
+	tracker.RecordMessage("shredder", last.Add(5*time.Minute))
+
+	if len(events) != 3 || events[0].Type != DeviceOnline || events[1].Type != DeviceOffline || events[2].Type != DeviceOnline {
+		t.Fatalf("unexpected events %+v", events)
+	}
+}
+
+func TestLivenessPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "liveness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "liveness.json")
+	tracker, _ := LoadLivenessTracker(filename, 3)
+	tracker.RecordMessage("shredder", time.Unix(1546300800, 0))
+	tracker.RecordReading("shredder", 2, 21.5, time.Unix(1546300800, 0))
+	if err := tracker.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadLivenessTracker(filename, 3)
+
+	if err != nil {
+		t.Fatalf("LoadLivenessTracker returned err: %v", err)
+	}
+	l, ok := loaded.Get("shredder")
+	if !ok || l.Sensors[2].LastValue == nil || *l.Sensors[2].LastValue != 21.5 {
+		t.Fatalf("expected last value 21.5 of sensor 2, actual %+v", l)
+	}
+}
+
+func TestLivenessSaveRetriesAfterFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "liveness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "missing", "liveness.json")
+	tracker, _ := LoadLivenessTracker(filename, 3)
+	tracker.RecordMessage("shredder", time.Unix(1546300800, 0))
+	if err := tracker.Save(); err == nil {
+		t.Fatal("Save did not fail for missing directory")
+	}
+
+	os.Mkdir(filepath.Dir(filename), 0755)
+	if err := tracker.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filename); err != nil {
+		t.Fatalf("pending changes were not saved on retry: %v", err)
+	}
+}
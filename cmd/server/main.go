@@ -7,9 +7,14 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+	"github.com/iot-bp-project-2018/raspi-server/internal/measurement"
 	"github.com/iot-bp-project-2018/raspi-server/internal/mqttclient"
+	"github.com/iot-bp-project-2018/raspi-server/internal/rules"
 	"github.com/iot-bp-project-2018/raspi-server/internal/testbuilder"
 	log "github.com/sirupsen/logrus"
 )
@@ -18,23 +23,90 @@ var (
 	mqttFlag    = flag.String("mqtt", "tcp://localhost:1883", "MQTT broker URI (format is scheme://host:port)")
 	testFlag    = flag.String("test", "", "Test server against a certain kind of attack (manipulation, delay, impersonation, injection, duplication)")
 	verboseFlag = flag.Bool("verbose", false, "enable detailed logging")
+
+	secretsFlag       = flag.String("secrets", "env:RASPI_", "comma separated secret providers (env:PREFIX, dir:PATH, file:PATH)")
+	masterKeyFileFlag = flag.String("master-key-file", "", "read the master key for encrypted secrets files from `file`")
+
+	storageFlag            = flag.String("storage", "influx1:"+influxHost, "time series `storage` (influx1:URL, influx2:URL or embedded:DIRECTORY)")
+	storageFallbackFlag    = flag.String("storage-fallback", "", "`storage` to use for good if the time series storage cannot be reached on start, e.g. embedded:"+embeddedDataDirectory+"; by default points are queued until the storage is available")
+	retentionFlag          = flag.Duration("retention", 0, "remove data of the embedded storage after this `duration`, 0 keeps all data")
+	downsampleAfterFlag    = flag.Duration("downsample-after", 0, "downsample data of the embedded storage after this `duration`, 0 disables downsampling")
+	downsampleIntervalFlag = flag.Duration("downsample-interval", time.Hour, "`interval` of downsampled data of the embedded storage")
+
+	offlineFactorFlag = flag.Float64("offline-factor", 3, "mark devices offline after this multiple of their reporting interval without data")
 )
 
-func sensorDataHandler(sender string, data []byte) {
-	payload := SensorPayloadFromJSONBuffer(data)
-	// Collect data
-	fmt.Println(sender, payload)
-	sensorIDStr := fmt.Sprintf("%d", payload.SensorID)
-	collectMetric("datapoint", Fields{"value": payload.Value}, Tags{"device": sender, "sensor": sensorIDStr, "type": payload.Type, "unit": payload.Unit})
-	// Update device and sensor in device cache if necessary
-	d := getDevice(sender)
-	d.updateSensor(payload.SensorID, payload.Type, payload.Unit)
+// storeSensorPayloads writes all readings of one message as a single batch.
+// Values are stored in the canonical unit of their type, the unit sent by the
+// device is kept in the originalUnit tag. The value field holds the reading
+// corrected by the calibration of its sensor, the raw field the uncorrected
+// reading. Readings a gateway forwards for a
+// child device are stored for the child and tagged with the gateway. The
+// readings must have been checked with validateReading. Readings whose
+// calibrated value is not finite are quarantined.
+func storeSensorPayloads(sender string, messageTimestamp int64, payloads []SensorPayload) {
+	points := make([]Point, 0, len(payloads))
+	devices := make([]string, 0, len(payloads))
+	stored := make([]SensorPayload, 0, len(payloads))
+	for _, payload := range payloads {
+		readingTime := payload.Time(messageTimestamp)
+		raw, unit, err := normalizeReading(payload)
+		if err != nil {
+			log.WithFields(log.Fields{"sender": sender, "sensor": payload.SensorID}).Warn("Dropping reading that cannot be normalized: ", err)
+			continue
+		}
+		d, err := deviceStorage.Resolve(sender, payload)
+		if err != nil {
+			log.WithFields(log.Fields{"sender": sender, "device": payload.DeviceID}).Warn("Dropping reading of unknown device: ", err)
+			continue
+		}
+		value, err := d.calibration(payload.SensorID).Calibrate(raw)
+		if err != nil {
+			rejectReading(sender, payload, err)
+			continue
+		}
+		// Collect data
+		fmt.Println(sender, payload)
+		sensorIDStr := fmt.Sprintf("%d", payload.SensorID)
+		tags := Tags{"device": d.ID, "sensor": sensorIDStr, "type": payload.Type, "unit": unit, "originalUnit": payload.Unit}
+		if d.Gateway != "" {
+			tags["gateway"] = d.Gateway
+		}
+		points = append(points, Point{
+			Measurement: "datapoint",
+			Fields:      Fields{"value": value, "raw": raw},
+			Tags:        tags,
+			Time:        readingTime,
+		})
+		devices = append(devices, d.ID)
+		stored = append(stored, payload)
+	}
+	collectMetrics(points)
+	// Update sensors in device cache if necessary
+	now := time.Now()
+	seen := make(map[string]bool)
+	for i, payload := range stored {
+		if t, ok := measurement.Default.Type(payload.Type); ok {
+			deviceStorage.UpdateSensor(devices[i], payload.SensorID, payload.Type, t.CanonicalUnit, payload.Unit)
+		}
+		if !seen[devices[i]] {
+			liveness.RecordMessage(devices[i], now)
+			seen[devices[i]] = true
+		}
+		value := points[i].Fields["value"].(float64)
+		liveness.RecordReading(devices[i], payload.SensorID, value, points[i].Time)
+		alertEngine.Observe(rules.Sensor{DeviceID: devices[i], SensorID: payload.SensorID}, value, points[i].Time)
+	}
 }
 
 // @Todo: Convert server package to logrus.
 func main() {
 	flag.Parse()
 
+	if flag.Arg(0) == "export" {
+		os.Exit(runExport(flag.Args()[1:]))
+	}
+
 	if *verboseFlag {
 		log.SetLevel(log.DebugLevel)
 	}
@@ -49,7 +121,12 @@ func main() {
 
 	os.MkdirAll(configDirectory, 0755)
 
-	config, err := commproto.ParseConfiguration(networkFile)
+	if err := loadSecrets(); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	config, err := commproto.ParseConfigurationWithSecrets(networkFile, secretProvider)
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
@@ -60,12 +137,73 @@ func main() {
 		ps = testbuilder.Wrap(ps, *testFlag)
 	}
 
+	revocations, err := commproto.LoadRevocationList(revocationsFile)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	partnerRevocations = revocations
+
+	// Everything the message handlers depend on must be ready before the
+	// client is started.
+	deviceStorage, err = LoadDeviceRepository(devicesFile)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	liveness, err = LoadLivenessTracker(livenessFile, *offlineFactorFlag)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	startLivenessTracking(liveness, deviceStorage)
+
+	deviceConfigs, err = LoadDeviceConfigStore(deviceConfigsFile)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	startDeviceConfigs(deviceConfigs, deviceStorage, liveness)
+
+	openQuarantine()
+	startCommands()
+	loadTokens()
+	if err := initMetrics(); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	// Keep queued points, pending device changes and the liveness when the
+	// server is stopped.
+	{
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-signals
+			closeMetrics()
+			if err := deviceStorage.Flush(); err != nil {
+				log.Println("[devices] failed to write devices file:", err)
+			}
+			if err := liveness.Save(); err != nil {
+				log.Println("[liveness] failed to write liveness file:", err)
+			}
+			os.Exit(0)
+		}()
+	}
+
 	client := commproto.NewClient(config, ps)
-	client.RegisterCallback(sensorDataHandler)
+	client.SetRevocationList(revocations)
+	startAuditLog(client)
+	registerMessageHandlers(client)
+	// Alerts are sent with the client, so rules are evaluated only once it
+	// exists.
+	if err := startAlerting(client); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
 	client.Start()
+	startProvisioning(client, ps)
 
-	loadTokens()
-	loadDevices()
-	initMetrics()
 	startWebserver()
 }
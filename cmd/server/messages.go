@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+	"github.com/iot-bp-project-2018/raspi-server/internal/measurement"
+	"github.com/iot-bp-project-2018/raspi-server/internal/sensorpayload"
+)
+
+var protoClient *commproto.Client
+
+func registerMessageHandlers(client *commproto.Client) {
+	protoClient = client
+	client.RegisterHandler(commproto.MessageSensorData, sensorDataHandler)
+	client.RegisterHandler(commproto.MessagePing, pingHandler)
+	client.RegisterHandler(commproto.MessageStatus, statusHandler)
+	client.RegisterHandler(commproto.MessageError, errorHandler)
+	client.RegisterHandler(commproto.MessageCommandAck, commandAckHandler)
+	client.RegisterHandler(commproto.MessageConfigAck, configAckHandler)
+	client.RegisterHandler(commproto.MessageUntyped, untypedHandler)
+}
+
+// untypedHandler handles data sent without an envelope by older devices, which
+// either send sensor data or a plain "ping".
+func untypedHandler(message commproto.Message) {
+	if string(message.Body) == "ping" {
+		if err := protoClient.SendString(message.Sender, "pong"); err != nil {
+			log.Printf("[messages] failed to answer ping from '%s': %v\n", message.Sender, err)
+		}
+		return
+	}
+	if contentType := sensorpayload.DetectContentType(message.Body); contentType != "" {
+		message.ContentType = contentType
+		sensorDataHandler(message)
+		return
+	}
+	log.Printf("[messages] ignoring untyped message from '%s'\n", message.Sender)
+}
+
+func sensorDataHandler(message commproto.Message) {
+	readings, err := sensorpayload.Decode(message.ContentType, message.Body)
+	if err != nil {
+		rejectPayload(message.Sender, message.Body, err)
+		return
+	}
+	valid := make([]SensorPayload, 0, len(readings))
+	for _, reading := range readings {
+		// Readings of units that moved to another type, e.g. brightness in
+		// lx, are stored as that type.
+		reading.Type = measurement.Default.Migrate(reading.Type, reading.Unit)
+		// Devices are only created for readings that are valid.
+		if err := validateReading(reading, message.Timestamp); err != nil {
+			rejectReading(message.Sender, reading, err)
+			continue
+		}
+		if _, err := deviceStorage.Resolve(message.Sender, reading); err != nil {
+			rejectReading(message.Sender, reading, err)
+			continue
+		}
+		valid = append(valid, reading)
+	}
+	if len(valid) > 0 {
+		storeSensorPayloads(message.Sender, message.Timestamp, valid)
+	}
+}
+
+func pingHandler(message commproto.Message) {
+	err := protoClient.SendMessage(message.Sender, commproto.MessagePong, message.ContentType, message.Body)
+	if err != nil {
+		log.Printf("[messages] failed to answer ping from '%s': %v\n", message.Sender, err)
+	}
+}
+
+func statusHandler(message commproto.Message) {
+	log.Printf("[messages] status report from '%s': %s\n", message.Sender, message.Body)
+}
+
+func errorHandler(message commproto.Message) {
+	log.Printf("[messages] error report from '%s': %s\n", message.Sender, message.Body)
+}
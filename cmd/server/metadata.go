@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Metadata is user-editable information about a device or sensor.
+type Metadata struct {
+	Name     string   `json:"name,omitempty"`
+	Location string   `json:"location,omitempty"`
+	Room     string   `json:"room,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Notes    string   `json:"notes,omitempty"`
+}
+
+func (m Metadata) clone() Metadata {
+	m.Tags = append([]string(nil), m.Tags...)
+	return m
+}
+
+// normalize trims all fields, removes empty and duplicate tags and checks the
+// length limits.
+func (m Metadata) normalize() (Metadata, error) {
+	m.Name = strings.TrimSpace(m.Name)
+	m.Location = strings.TrimSpace(m.Location)
+	m.Room = strings.TrimSpace(m.Room)
+	m.Notes = strings.TrimSpace(m.Notes)
+	for field, value := range map[string]string{"name": m.Name, "location": m.Location, "room": m.Room} {
+		if utf8.RuneCountInString(value) > maxMetadataLength {
+			return Metadata{}, fmt.Errorf("%s is longer than %d characters", field, maxMetadataLength)
+		}
+	}
+	if utf8.RuneCountInString(m.Notes) > maxNotesLength {
+		return Metadata{}, fmt.Errorf("notes are longer than %d characters", maxNotesLength)
+	}
+
+	tags := make([]string, 0, len(m.Tags))
+	seen := make(map[string]bool)
+	for _, tag := range m.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxMetadataLength {
+			return Metadata{}, fmt.Errorf("tag '%s' is longer than %d characters", tag, maxMetadataLength)
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxTags {
+		return Metadata{}, fmt.Errorf("more than %d tags", maxTags)
+	}
+	m.Tags = tags
+	return m, nil
+}
+
+func (m Metadata) hasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// MetadataFilter selects sensors by the metadata of the sensor and its device.
+// Empty fields match everything. Location and room of a sensor default to
+// those of its device, and a sensor carries the tags of its device in
+// addition to its own.
+type MetadataFilter struct {
+	DeviceID string   `json:"deviceId,omitempty"`
+	Location string   `json:"location,omitempty"`
+	Room     string   `json:"room,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Type     string   `json:"type,omitempty"`
+}
+
+// Matches reports whether the sensor of the device is selected by the filter.
+func (filter MetadataFilter) Matches(device Device, sensor Sensor) bool {
+	if filter.DeviceID != "" && filter.DeviceID != device.ID {
+		return false
+	}
+	if filter.Type != "" && filter.Type != sensor.Type {
+		return false
+	}
+	location, room := sensor.Location, sensor.Room
+	if location == "" {
+		location = device.Location
+	}
+	if room == "" {
+		room = device.Room
+	}
+	if filter.Location != "" && !strings.EqualFold(filter.Location, location) {
+		return false
+	}
+	if filter.Room != "" && !strings.EqualFold(filter.Room, room) {
+		return false
+	}
+	for _, tag := range filter.Tags {
+		if !sensor.hasTag(tag) && !device.hasTag(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchesDevice reports whether any sensor of the device, or the device itself
+// if it has no sensors, is selected by the filter.
+func (filter MetadataFilter) MatchesDevice(device Device) bool {
+	if len(device.Sensors) == 0 {
+		return filter.Type == "" && filter.Matches(device, Sensor{})
+	}
+	for _, sensor := range device.Sensors {
+		if filter.Matches(device, *sensor) {
+			return true
+		}
+	}
+	return false
+}
+
+// SensorRef identifies a sensor of a device.
+type SensorRef struct {
+	DeviceID string `json:"deviceId"`
+	SensorID byte   `json:"sensorId"`
+}
+
+// selectSensors returns all sensors selected by the filter except retired
+// sensors.
+func selectSensors(filter MetadataFilter) []SensorRef {
+	var result []SensorRef
+	for _, device := range deviceStorage.Devices() {
+		for _, sensor := range device.Sensors {
+			if sensor.RetiredAt == nil && filter.Matches(device, *sensor) {
+				result = append(result, SensorRef{DeviceID: device.ID, SensorID: sensor.ID})
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMetadataFilter(t *testing.T) {
+	device := Device{ID: "shredder", Metadata: Metadata{Room: "Kitchen", Tags: []string{"ground-floor"}}}
+	fridge := Sensor{ID: 1, Type: "temperature", Metadata: Metadata{Room: "Fridge", Tags: []string{"cold"}}}
+	window := Sensor{ID: 2, Type: "temperature"}
+
+	cases := []struct {
+		filter   MetadataFilter
+		sensor   Sensor
+		expected bool
+	}{
+		{MetadataFilter{}, window, true},
+		{MetadataFilter{Room: "kitchen"}, window, true},
+		{MetadataFilter{Room: "kitchen"}, fridge, false},
+		{MetadataFilter{Tags: []string{"ground-floor", "cold"}}, fridge, true},
+		{MetadataFilter{Tags: []string{"cold"}}, window, false},
+		{MetadataFilter{Type: "humidity"}, window, false},
+		{MetadataFilter{DeviceID: "kronos"}, window, false},
+	}
+	for _, c := range cases {
+		if actual := c.filter.Matches(device, c.sensor); actual != c.expected {
+			t.Fatalf("filter %+v for sensor %d: expected %v, actual %v", c.filter, c.sensor.ID, c.expected, actual)
+		}
+	}
+}
+
+func TestSetMetadata(t *testing.T) {
+	repository := NewDeviceRepository("")
+	repository.Device("shredder")
+
+	err := repository.SetMetadata("shredder", Metadata{Name: " Shredder ", Tags: []string{"a", "", "a", "b"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, _ := repository.Get("shredder")
+	if device.Name != "Shredder" || len(device.Tags) != 2 {
+		t.Fatalf("metadata was not normalized: %+v", device.Metadata)
+	}
+	if err := repository.SetSensorMetadata("shredder", 1, Metadata{}); err == nil {
+		t.Fatal("SetSensorMetadata accepted unknown sensor")
+	}
+	if err := repository.SetName("kronos", "Kronos"); err == nil {
+		t.Fatal("SetName accepted unknown device")
+	}
+}
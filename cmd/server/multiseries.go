@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+	"github.com/iot-bp-project-2018/raspi-server/internal/storage"
+)
+
+// Combinations of the sensors of a series selector
+const (
+	CombineMean = "mean"
+	CombineMin  = "min"
+	CombineMax  = "max"
+	CombineSum  = "sum"
+)
+
+// QueriedSeries is one series of a multi-series query. Its data points have
+// the times of the response, values that are missing are null.
+type QueriedSeries struct {
+	Name       string      `json:"name"`
+	Sensors    []SensorRef `json:"sensors"`
+	Combine    string      `json:"combine,omitempty"`
+	Datapoints []DataPoint `json:"datapoints"`
+}
+
+// sensors returns the sensors selected by the selector.
+func (s SeriesSelector) sensors() ([]SensorRef, error) {
+	for _, sensor := range s.Sensors {
+		if !commproto.ValidAddress(sensor.DeviceID) {
+			return nil, fmt.Errorf("Bad device id '%s' in series '%s'", sensor.DeviceID, s.Name)
+		}
+	}
+	candidates := s.Sensors
+	if s.Filter != nil {
+		candidates = append(candidates[:len(candidates):len(candidates)], selectSensors(*s.Filter)...)
+	}
+	var sensors []SensorRef
+	seen := make(map[SensorRef]bool, len(candidates))
+	for _, sensor := range candidates {
+		if !seen[sensor] {
+			seen[sensor] = true
+			sensors = append(sensors, sensor)
+		}
+	}
+	if len(sensors) == 0 {
+		return nil, fmt.Errorf("Series '%s' selects no sensors", s.Name)
+	}
+	return sensors, nil
+}
+
+// sensorType returns the measurement type of a sensor, empty if it is not
+// known.
+func sensorType(ref SensorRef) string {
+	device, ok := deviceStorage.Get(ref.DeviceID)
+	if !ok {
+		return ""
+	}
+	for _, sensor := range device.Sensors {
+		if sensor.ID == ref.SensorID {
+			return sensor.Type
+		}
+	}
+	return ""
+}
+
+// checkCombinable ensures that the selector combines sensors of a single
+// known type.
+func (s SeriesSelector) checkCombinable(sensors []SensorRef) error {
+	switch s.Combine {
+	case "":
+		return nil
+	case CombineMean, CombineMin, CombineMax, CombineSum:
+	default:
+		return fmt.Errorf("Unknown combination '%s' in series '%s'", s.Combine, s.Name)
+	}
+	first := sensorType(sensors[0])
+	for _, sensor := range sensors {
+		if t := sensorType(sensor); t == "" || t != first {
+			return fmt.Errorf("Series '%s' combines sensors of different or unknown types", s.Name)
+		}
+	}
+	return nil
+}
+
+// combine combines the values of several sensors.
+func combine(combination string, values []float64) float64 {
+	result := values[0]
+	for _, value := range values[1:] {
+		switch combination {
+		case CombineMin:
+			if value < result {
+				result = value
+			}
+		case CombineMax:
+			if value > result {
+				result = value
+			}
+		default:
+			result += value
+		}
+	}
+	if combination == CombineMean {
+		result /= float64(len(values))
+	}
+	return result
+}
+
+// queryMultipleSeries runs a multi-series query. All series have a data point
+// for every time that any sensor has data for.
+func queryMultipleSeries(request MultiSeriesQueryRequest) ([]QueriedSeries, error) {
+	if len(request.Series) == 0 || len(request.Series) > maxSeriesSelectors {
+		return nil, fmt.Errorf("Between 1 and %d series must be selected", maxSeriesSelectors)
+	}
+	from, to := time.Unix(int64(request.BeginUnix), 0), time.Unix(int64(request.EndUnix), 0)
+
+	selected := make([][]SensorRef, len(request.Series))
+	queries := make(map[SensorRef]storage.Query)
+	for i, selector := range request.Series {
+		sensors, err := selector.sensors()
+		if err != nil {
+			return nil, err
+		}
+		if err := selector.checkCombinable(sensors); err != nil {
+			return nil, err
+		}
+		for _, sensor := range sensors {
+			if _, ok := queries[sensor]; ok {
+				continue
+			}
+			if len(queries) == maxFilteredSeries {
+				return nil, fmt.Errorf("Query selects more than %d sensors", maxFilteredSeries)
+			}
+			q, err := sensorQuery(sensor.DeviceID, int(sensor.SensorID), from, to, request.ResolutionSeconds, request.AggregationOptions)
+			if err != nil {
+				return nil, err
+			}
+			queries[sensor] = q
+		}
+		selected[i] = sensors
+	}
+
+	// Query every sensor once and align the results by time.
+	var template storage.Query
+	results := make(map[SensorRef]map[int64]Fields, len(queries))
+	times := make(map[int64]bool)
+	for sensor, q := range queries {
+		points, err := runQuery(q)
+		if err != nil {
+			return nil, err
+		}
+		template = q
+		results[sensor] = make(map[int64]Fields, len(points))
+		for _, point := range points {
+			at := point.Time.UnixNano()
+			results[sensor][at] = point.Fields
+			times[at] = true
+		}
+	}
+	ordered := make([]int64, 0, len(times))
+	for at := range times {
+		ordered = append(ordered, at)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i] < ordered[j] })
+
+	series := make([]QueriedSeries, 0, len(selected))
+	for i, selector := range request.Series {
+		if selector.Combine == "" {
+			for _, sensor := range selected[i] {
+				s := QueriedSeries{Name: selector.Name, Sensors: []SensorRef{sensor}, Datapoints: make([]DataPoint, len(ordered))}
+				for j, at := range ordered {
+					s.Datapoints[j] = dataPoint(template, time.Unix(0, at), results[sensor][at])
+				}
+				series = append(series, s)
+			}
+			continue
+		}
+		s := QueriedSeries{Name: selector.Name, Sensors: selected[i], Combine: selector.Combine, Datapoints: make([]DataPoint, len(ordered))}
+		for j, at := range ordered {
+			combined := Fields{}
+			for _, aggregate := range template.Aggregates {
+				var values []float64
+				for _, sensor := range selected[i] {
+					if value, ok := results[sensor][at][string(aggregate)].(float64); ok {
+						values = append(values, value)
+					}
+				}
+				if len(values) > 0 {
+					combined[string(aggregate)] = combine(selector.Combine, values)
+				}
+			}
+			s.Datapoints[j] = dataPoint(template, time.Unix(0, at), combined)
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueryMultipleSeries(t *testing.T) {
+	useEmbeddedStorage(t)
+	previous := deviceStorage
+	deviceStorage = NewDeviceRepository("")
+	defer func() { deviceStorage = previous }()
+	for _, id := range []string{"kitchen-1", "kitchen-2"} {
+		deviceStorage.Device(id)
+		deviceStorage.SetMetadata(id, Metadata{Room: "Kitchen"})
+		deviceStorage.UpdateSensor(id, 1, "temperature", "°C", "°C")
+		deviceStorage.UpdateSensor(id, 2, "humidity", "%", "%")
+	}
+	at := time.Unix(1546300800, 0)
+	reading := func(device string, sensor string, offset time.Duration, value float64) Point {
+		return Point{Measurement: "datapoint", Tags: Tags{"device": device, "sensor": sensor}, Fields: Fields{"value": value}, Time: at.Add(offset)}
+	}
+	collectMetrics([]Point{
+		reading("kitchen-1", "1", 0, 20),
+		reading("kitchen-2", "1", 0, 22),
+		reading("kitchen-2", "1", time.Minute, 24),
+		reading("kitchen-1", "2", 0, 50),
+	})
+	ingestQueue.Flush()
+
+	request := MultiSeriesQueryRequest{
+		Series: []SeriesSelector{
+			{Name: "kitchen", Filter: &MetadataFilter{Room: "kitchen", Type: "temperature"}, Combine: CombineMean},
+			{Name: "humidity", Sensors: []SensorRef{{DeviceID: "kitchen-1", SensorID: 2}}},
+		},
+		BeginUnix:          int(at.Unix()),
+		EndUnix:            int(at.Add(2 * time.Minute).Unix()),
+		ResolutionSeconds:  60,
+		AggregationOptions: AggregationOptions{Fill: "none"},
+	}
+	series, err := queryMultipleSeries(request)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 2 || len(series[0].Sensors) != 2 {
+		t.Fatalf("unexpected series %+v", series)
+	}
+	kitchen, humidity := series[0].Datapoints, series[1].Datapoints
+	if len(kitchen) != 2 || len(humidity) != 2 {
+		t.Fatalf("series are not aligned: %v, %v", kitchen, humidity)
+	}
+	if kitchen[0]["mean"] != 21.0 || kitchen[1]["mean"] != 24.0 || humidity[0]["mean"] != 50.0 || humidity[1]["mean"] != nil {
+		t.Fatalf("unexpected values %v, %v", kitchen, humidity)
+	}
+
+	request.Series = []SeriesSelector{{Name: "mixed", Filter: &MetadataFilter{Room: "kitchen"}, Combine: CombineMean}}
+	if _, err := queryMultipleSeries(request); err == nil {
+		t.Fatal("expected error for combining sensors of different types")
+	}
+}
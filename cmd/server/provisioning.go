@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+	"github.com/iot-bp-project-2018/raspi-server/internal/provisioning"
+)
+
+// PendingDevice is a device that announced itself and waits for approval.
+type PendingDevice struct {
+	Address     string    `json:"address"`
+	Info        string    `json:"info"`
+	AnnouncedAt time.Time `json:"announcedAt"`
+	nonce       []byte
+}
+
+var provisioningState struct {
+	mutex     sync.Mutex
+	ps        commproto.PubSubClient
+	bootstrap *commproto.PartnerConfiguration
+	expires   time.Time
+	pending   map[string]*PendingDevice
+	// granted keeps the grants of approved devices, so that a grant lost in
+	// transit can be delivered again when the device repeats its announcement.
+	granted map[string]*grantedDevice
+}
+
+type grantedDevice struct {
+	nonce    []byte
+	datagram []byte
+}
+
+func startProvisioning(client *commproto.Client, ps commproto.PubSubClient) {
+	provisioningState.ps = ps
+	provisioningState.pending = make(map[string]*PendingDevice)
+	provisioningState.granted = make(map[string]*grantedDevice)
+	ps.Subscribe(provisioning.Channel(client.HostAddress()), onProvisioningAnnouncement)
+}
+
+// openProvisioningWindow generates a new bootstrap secret, which replaces any
+// previous one and is valid for bootstrapLifetime.
+func openProvisioningWindow() (commproto.PartnerConfiguration, time.Time, error) {
+	bootstrap, err := commproto.GeneratePartnerConfiguration()
+	if err != nil {
+		return bootstrap, time.Time{}, err
+	}
+	provisioningState.mutex.Lock()
+	defer provisioningState.mutex.Unlock()
+	provisioningState.bootstrap = &bootstrap
+	provisioningState.expires = time.Now().Add(bootstrapLifetime)
+	provisioningState.pending = make(map[string]*PendingDevice)
+	provisioningState.granted = make(map[string]*grantedDevice)
+	log.Println("[provisioning] provisioning window opened until", provisioningState.expires.Format(time.RFC3339))
+	return bootstrap, provisioningState.expires, nil
+}
+
+// currentBootstrap returns the bootstrap secret if the provisioning window is
+// open. The caller must hold provisioningState.mutex.
+func currentBootstrap() (commproto.PartnerConfiguration, bool) {
+	if provisioningState.bootstrap == nil {
+		return commproto.PartnerConfiguration{}, false
+	}
+	if time.Now().After(provisioningState.expires) {
+		provisioningState.bootstrap = nil
+		provisioningState.pending = make(map[string]*PendingDevice)
+		provisioningState.granted = make(map[string]*grantedDevice)
+		log.Println("[provisioning] provisioning window expired")
+		return commproto.PartnerConfiguration{}, false
+	}
+	return *provisioningState.bootstrap, true
+}
+
+func onProvisioningAnnouncement(_ string, datagram []byte) {
+	provisioningState.mutex.Lock()
+	defer provisioningState.mutex.Unlock()
+
+	bootstrap, ok := currentBootstrap()
+	if !ok {
+		log.Println("[provisioning] ignoring announcement, provisioning window is closed")
+		return
+	}
+
+	var announcement provisioning.Announcement
+	address, err := provisioning.Disassemble(datagram, &announcement, bootstrap)
+	if err != nil {
+		log.Printf("[provisioning] invalid announcement from '%s': %v\n", address, err)
+		return
+	}
+	if len(announcement.Nonce) != commproto.NonceSize {
+		log.Printf("[provisioning] announcement from '%s' has invalid nonce\n", address)
+		return
+	}
+	if granted, ok := provisioningState.granted[address]; ok && bytes.Equal(granted.nonce, announcement.Nonce) {
+		provisioningState.ps.Publish(provisioning.Channel(address), granted.datagram)
+		log.Printf("[provisioning] repeated grant for device '%s'\n", address)
+		return
+	}
+	if _, known := protoClient.Configuration().Partners[address]; known || address == protoClient.HostAddress() {
+		log.Printf("[provisioning] ignoring announcement from already known address '%s'\n", address)
+		return
+	}
+
+	if _, found := provisioningState.pending[address]; !found {
+		log.Printf("[provisioning] device '%s' announced itself (%s)\n", address, announcement.Info)
+	}
+	provisioningState.pending[address] = &PendingDevice{
+		Address:     address,
+		Info:        announcement.Info,
+		AnnouncedAt: time.Now(),
+		nonce:       announcement.Nonce,
+	}
+}
+
+func getPendingDevices() []*PendingDevice {
+	provisioningState.mutex.Lock()
+	defer provisioningState.mutex.Unlock()
+	result := make([]*PendingDevice, 0)
+	if _, ok := currentBootstrap(); !ok {
+		return result
+	}
+	for _, device := range provisioningState.pending {
+		result = append(result, device)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].AnnouncedAt.Before(result[j].AnnouncedAt)
+	})
+	return result
+}
+
+func rejectPendingDevice(address string) error {
+	provisioningState.mutex.Lock()
+	defer provisioningState.mutex.Unlock()
+	if _, ok := provisioningState.pending[address]; !ok {
+		return errors.New("no pending device with this address")
+	}
+	delete(provisioningState.pending, address)
+	log.Printf("[provisioning] device '%s' rejected\n", address)
+	return nil
+}
+
+// approvePendingDevice generates fresh secrets for a pending device, adds it
+// to the network configuration and delivers the secrets to the device. If
+// requireButton is set, the pairing button has to be pressed before the
+// context expires.
+func approvePendingDevice(ctx context.Context, address string, requireButton bool) error {
+	if requireButton && !HardwareWaitForPairingButton(ctx) {
+		return errors.New("Timeout")
+	}
+
+	provisioningState.mutex.Lock()
+	defer provisioningState.mutex.Unlock()
+
+	bootstrap, ok := currentBootstrap()
+	if !ok {
+		return errors.New("provisioning window is closed")
+	}
+	device, ok := provisioningState.pending[address]
+	if !ok {
+		return errors.New("no pending device with this address")
+	}
+
+	client := protoClient
+	// The secrets of an existing partner must not be replaced.
+	if _, ok := client.Configuration().Partners[address]; ok {
+		return fmt.Errorf("partner '%s' already exists", address)
+	}
+	partner, err := commproto.GeneratePartnerConfiguration()
+	if err != nil {
+		return err
+	}
+	partner, err = protectPartnerSecrets(address, partner)
+	if err != nil {
+		log.Println("[provisioning] failed to store secrets")
+		log.Println(err)
+		return errors.New("could not store secrets")
+	}
+	if err := client.AddPartner(address, partner); err != nil {
+		forgetPartnerSecrets(partner)
+		return err
+	}
+	config := client.Configuration()
+	if err := commproto.SaveConfiguration(networkFile, config); err != nil {
+		log.Println("[provisioning] failed to write network file")
+		log.Println(err)
+		client.RemovePartner(address)
+		forgetPartnerSecrets(partner)
+		return errors.New("could not save network configuration")
+	}
+
+	grant := provisioning.Grant{
+		Nonce:      device.nonce,
+		Key:        partner.Key,
+		Passphrase: partner.Passphrase,
+		TimeServer: config.HostTimeServer,
+	}
+	datagram, err := provisioning.Assemble(client.HostAddress(), grant, bootstrap)
+	if err != nil {
+		return err
+	}
+	provisioningState.ps.Publish(provisioning.Channel(address), datagram)
+	provisioningState.granted[address] = &grantedDevice{nonce: device.nonce, datagram: datagram}
+	delete(provisioningState.pending, address)
+	log.Printf("[provisioning] device '%s' approved and added to network configuration\n", address)
+	return nil
+}
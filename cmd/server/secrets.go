@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+	"github.com/iot-bp-project-2018/raspi-server/internal/secrets"
+)
+
+var secretProvider secrets.Chain
+
+// loadSecrets sets up the secret provider from the -secrets flag. If systemd
+// passes credentials to the server, they are consulted first.
+func loadSecrets() error {
+	chain, err := secrets.Parse(*secretsFlag, masterKey)
+	if err != nil {
+		return err
+	}
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+		chain = append(secrets.Chain{secrets.Directory{Path: dir}}, chain...)
+	}
+	secretProvider = chain
+	return nil
+}
+
+// masterKey returns the key used to unlock encrypted secrets files, read from
+// the -master-key-file flag or the RASPI_MASTER_PASSPHRASE variable.
+func masterKey() ([]byte, error) {
+	if *masterKeyFileFlag != "" {
+		data, err := ioutil.ReadFile(*masterKeyFileFlag)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(data), "\r\n")), nil
+	}
+	if passphrase := os.Getenv(masterPassphraseVariable); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	return nil, errors.New("encrypted secrets file requires -master-key-file or " + masterPassphraseVariable)
+}
+
+// lookupSecret returns the secret or an empty string if it is not available.
+func lookupSecret(name string) string {
+	value, err := secretProvider.Secret(name)
+	if err == secrets.ErrNotFound {
+		log.Printf("[secrets] secret '%s' not found\n", name)
+		return ""
+	}
+	if err != nil {
+		log.Printf("[secrets] failed to read secret '%s': %v\n", name, err)
+		return ""
+	}
+	return string(value)
+}
+
+// protectPartnerSecrets moves the key and passphrase of a partner into the
+// first writable secret provider, if any, and replaces them by references, so
+// that they are not written to the network file in plaintext.
+func protectPartnerSecrets(address string, partner commproto.PartnerConfiguration) (commproto.PartnerConfiguration, error) {
+	writable, ok := secretProvider.Writable()
+	if !ok {
+		log.Printf("[secrets] no writable secret provider, secrets of '%s' are stored in the network file\n", address)
+		return partner, nil
+	}
+	keySecret, passphraseSecret := address+"-key", address+"-passphrase"
+	if err := writable.SetSecret(keySecret, []byte(hex.EncodeToString(partner.Key))); err != nil {
+		return partner, err
+	}
+	if err := writable.SetSecret(passphraseSecret, []byte(partner.Passphrase)); err != nil {
+		writable.DeleteSecret(keySecret)
+		return partner, err
+	}
+	partner.KeySecret = keySecret
+	partner.PassphraseSecret = passphraseSecret
+	return partner, nil
+}
+
+// forgetPartnerSecrets removes the secrets stored by protectPartnerSecrets,
+// e.g. if the partner could not be added after all.
+func forgetPartnerSecrets(partner commproto.PartnerConfiguration) {
+	writable, ok := secretProvider.Writable()
+	if !ok {
+		return
+	}
+	for _, name := range []string{partner.KeySecret, partner.PassphraseSecret} {
+		if name == "" {
+			continue
+		}
+		if err := writable.DeleteSecret(name); err != nil && err != secrets.ErrNotFound {
+			log.Printf("[secrets] failed to remove secret '%s': %v\n", name, err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+// This file implements maintenance of the stored sensor data when devices are
+// deleted, merged, sensors are retired or recalibrated.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/calibration"
+	"github.com/iot-bp-project-2018/raspi-server/internal/storage"
+)
+
+// SeriesAction selects what happens to the stored data of a device or sensor
+// that is deleted, retired or merged.
+type SeriesAction string
+
+// Series actions
+const (
+	// SeriesKeep leaves the data untouched. It is the default.
+	SeriesKeep SeriesAction = "keep"
+	// SeriesPurge deletes the data.
+	SeriesPurge SeriesAction = "purge"
+	// SeriesRelabel moves the data to another device or sensor.
+	SeriesRelabel SeriesAction = "relabel"
+)
+
+func (action SeriesAction) validate() error {
+	switch action {
+	case "", SeriesKeep, SeriesPurge, SeriesRelabel:
+		return nil
+	default:
+		return fmt.Errorf("unknown series action '%s'", action)
+	}
+}
+
+// applySeriesAction purges the series matching the tags or relabels them by
+// replacing the tags in relabel.
+func applySeriesAction(action SeriesAction, match Tags, relabel Tags) error {
+	switch action {
+	case "", SeriesKeep:
+		return nil
+	case SeriesPurge:
+		if err := flushQueued(); err != nil {
+			return err
+		}
+		return purgeSeries(match, endOfTime)
+	case SeriesRelabel:
+		return relabelSeries(match, relabel)
+	default:
+		return fmt.Errorf("unknown series action '%s'", action)
+	}
+}
+
+// errNoStorage is returned by maintenance functions before the storage is
+// opened.
+var errNoStorage = errors.New("storage not available")
+
+// writePoints writes the points in batches.
+func writePoints(points []Point) error {
+	for start := 0; start < len(points); start += relabelBatchSize {
+		end := start + relabelBatchSize
+		if end > len(points) {
+			end = len(points)
+		}
+		if err := dataStore.Write(points[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rawPoints returns all stored sensor data matching the tags between from
+// (inclusive) and to (exclusive).
+func rawPoints(match Tags, from, to time.Time) ([]Point, error) {
+	if dataStore == nil {
+		return nil, errNoStorage
+	}
+	return dataStore.Query(storage.Query{Measurement: "datapoint", Match: match, From: from, To: to})
+}
+
+// flushQueued writes the queued points, so that series maintenance also
+// covers readings that were received but not yet written.
+func flushQueued() error {
+	if ingestQueue == nil {
+		return nil
+	}
+	if err := ingestQueue.Flush(); err != nil {
+		return fmt.Errorf("failed to write queued points: %v", err)
+	}
+	return nil
+}
+
+// endOfTime is after all stored points.
+var endOfTime = time.Unix(0, math.MaxInt64)
+
+// purgeSeries deletes the sensor data matching the tags measured before the
+// time.
+func purgeSeries(match Tags, before time.Time) error {
+	if dataStore == nil {
+		return errNoStorage
+	}
+	err := dataStore.Delete("datapoint", match, before)
+	if err == nil {
+		log.Printf("[storage] purged series matching %v before %v\n", match, before)
+	}
+	return err
+}
+
+// forEachWindow passes the stored sensor data matching the tags between from
+// (inclusive) and to (exclusive) to process in time windows of seriesWindow,
+// so that only one window is held in memory. Time without data is skipped by
+// starting the next window at the next stored point. Readings are not stored
+// in the future, so the range after the current time is a single window.
+func forEachWindow(match Tags, from, to time.Time, process func(points []Point) error) error {
+	if dataStore == nil {
+		return errNoStorage
+	}
+	now := time.Now()
+	for start := from; start.Before(to); {
+		first, ok, err := dataStore.First("datapoint", match, start)
+		if err != nil || !ok {
+			return err
+		}
+		if first.After(start) {
+			start = first
+		}
+		for start.Before(to) {
+			end := start.Add(seriesWindow)
+			if end.After(now) || end.After(to) {
+				end = to
+			}
+			points, err := rawPoints(match, start, end)
+			if err != nil {
+				return err
+			}
+			start = end
+			if len(points) == 0 {
+				break
+			}
+			if err := process(points); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// relabelSeries rewrites the sensor data matching the tags with the tags in
+// relabel replaced. Stored points cannot change their tags, so the points are
+// read, written with the new tags and deleted. Only points measured before the
+// relabeling started are moved, readings of the old series stored meanwhile
+// are kept. Queued points are written first, and once more before the last
+// maxReadingAge is relabeled again to include late readings.
+func relabelSeries(match Tags, relabel Tags) error {
+	cutoff := time.Now()
+	count := 0
+	move := func(points []Point) error {
+		for _, point := range points {
+			for key, value := range relabel {
+				point.Tags[key] = value
+			}
+		}
+		count += len(points)
+		return writePoints(points)
+	}
+	if err := flushQueued(); err != nil {
+		return err
+	}
+	if err := forEachWindow(match, time.Unix(0, 0), cutoff, move); err != nil {
+		return err
+	}
+	if err := flushQueued(); err != nil {
+		return err
+	}
+	if err := forEachWindow(match, cutoff.Add(-maxReadingAge), cutoff, move); err != nil {
+		return err
+	}
+	log.Printf("[storage] relabeled %d points matching %v\n", count, match)
+	return purgeSeries(match, cutoff)
+}
+
+// recalibrateSeries recomputes the calibrated values of all sensor data
+// matching the tags between from (inclusive) and to (exclusive) from their raw
+// values in time windows. Points stored before raw values were kept are
+// treated as raw. Rewriting a point with the same tags and time replaces it.
+// Points whose calibrated value would not be finite are left unchanged and
+// counted as rejected.
+func recalibrateSeries(match Tags, pipeline calibration.Pipeline, from, to time.Time) (recalibrated int, rejected int, err error) {
+	if err := flushQueued(); err != nil {
+		return 0, 0, err
+	}
+	err = forEachWindow(match, from, to, func(points []Point) error {
+		changed := points[:0]
+		for _, point := range points {
+			raw, ok := point.Fields["raw"].(float64)
+			if !ok {
+				raw, ok = point.Fields["value"].(float64)
+			}
+			if !ok {
+				continue
+			}
+			value, err := pipeline.Calibrate(raw)
+			if err != nil {
+				rejected++
+				continue
+			}
+			point.Fields["raw"] = raw
+			point.Fields["value"] = value
+			changed = append(changed, point)
+		}
+		recalibrated += len(changed)
+		return writePoints(changed)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	log.Printf("[storage] recalibrated %d points matching %v, rejected %d\n", recalibrated, match, rejected)
+	return recalibrated, rejected, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/calibration"
+	"github.com/iot-bp-project-2018/raspi-server/internal/ingest"
+	"github.com/iot-bp-project-2018/raspi-server/internal/storage"
+)
+
+// useEmbeddedStorage replaces the storage by an empty embedded store for the
+// duration of a test.
+func useEmbeddedStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.OpenEmbedded(dir, storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataStore = store
+	queue, err := ingest.New(store, ingest.Options{FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingestQueue = queue
+	t.Cleanup(func() {
+		queue.Close()
+		store.Close()
+		os.RemoveAll(dir)
+		dataStore, ingestQueue = nil, nil
+	})
+}
+
+func TestRelabelSeries(t *testing.T) {
+	useEmbeddedStorage(t)
+	at := time.Unix(1546300800, 0)
+	collectMetrics([]Point{
+		{Measurement: "datapoint", Tags: Tags{"device": "typo", "sensor": "1"}, Fields: Fields{"value": 21.5, "raw": 23.0}, Time: at},
+		{Measurement: "datapoint", Tags: Tags{"device": "shredder", "sensor": "1"}, Fields: Fields{"value": 20.0}, Time: at.Add(time.Second)},
+		{Measurement: "datapoint", Tags: Tags{"device": "typo", "sensor": "1"}, Fields: Fields{"value": 19.0}, Time: at.Add(72 * time.Hour)},
+	})
+	ingestQueue.Flush()
+
+	if err := applySeriesAction(SeriesRelabel, Tags{"device": "typo"}, Tags{"device": "shredder"}); err != nil {
+		t.Fatal(err)
+	}
+
+	points, _ := rawPoints(Tags{"sensor": "1"}, at, at.Add(time.Minute))
+	if len(points) != 2 {
+		t.Fatalf("expected 2 points, actual %d", len(points))
+	}
+	for _, point := range points {
+		if point.Tags["device"] != "shredder" {
+			t.Fatalf("point was not relabeled: %+v", point)
+		}
+	}
+	if points, _ := rawPoints(Tags{"device": "shredder"}, at.Add(time.Hour), at.Add(96*time.Hour)); len(points) != 1 {
+		t.Fatalf("point of a later window was not relabeled: %+v", points)
+	}
+	if err := applySeriesAction(SeriesPurge, Tags{"device": "shredder"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if points, _ := rawPoints(Tags{"sensor": "1"}, at, at.Add(time.Minute)); len(points) != 0 {
+		t.Fatalf("purged points are still stored: %+v", points)
+	}
+}
+
+func TestRelabelKeepsLaterReadings(t *testing.T) {
+	useEmbeddedStorage(t)
+	at := time.Unix(1546300800, 0)
+	// stored while the relabeling runs
+	later := time.Now().Add(time.Minute)
+	collectMetrics([]Point{
+		{Measurement: "datapoint", Tags: Tags{"device": "typo", "sensor": "1"}, Fields: Fields{"value": 21.5}, Time: at},
+		{Measurement: "datapoint", Tags: Tags{"device": "typo", "sensor": "1"}, Fields: Fields{"value": 19.0}, Time: later},
+	})
+
+	if err := relabelSeries(Tags{"device": "typo"}, Tags{"device": "shredder"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if points, _ := rawPoints(Tags{"device": "shredder"}, at, later.Add(time.Second)); len(points) != 1 || !points[0].Time.Equal(at) {
+		t.Fatalf("unexpected relabeled points %+v", points)
+	}
+	if points, _ := rawPoints(Tags{"device": "typo"}, at, later.Add(time.Second)); len(points) != 1 || !points[0].Time.Equal(later) {
+		t.Fatalf("reading stored during the relabeling was not kept: %+v", points)
+	}
+}
+
+func TestRecalibrateSeries(t *testing.T) {
+	useEmbeddedStorage(t)
+	at := time.Unix(1546300800, 0)
+	collectMetrics([]Point{
+		{Measurement: "datapoint", Tags: Tags{"device": "shredder", "sensor": "1"}, Fields: Fields{"value": 21.5, "raw": 23.0}, Time: at},
+		// stored before raw values were kept
+		{Measurement: "datapoint", Tags: Tags{"device": "shredder", "sensor": "1"}, Fields: Fields{"value": 22.0}, Time: at.Add(time.Minute)},
+		{Measurement: "datapoint", Tags: Tags{"device": "shredder", "sensor": "1"}, Fields: Fields{"value": 1e200, "raw": 1e200}, Time: at.Add(48 * time.Hour)},
+	})
+	ingestQueue.Flush()
+
+	pipeline := calibration.Pipeline{{Type: calibration.Offset, Value: -1}, {Type: calibration.Scale, Value: 1e200}}
+	count, rejected, err := recalibrateSeries(Tags{"device": "shredder", "sensor": "1"}, pipeline, at, at.Add(72*time.Hour))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	points, _ := rawPoints(Tags{"device": "shredder"}, at, at.Add(72*time.Hour))
+	if count != 2 || rejected != 1 || len(points) != 3 {
+		t.Fatalf("expected 2 recalibrated and 1 rejected point, actual %d and %d of %d", count, rejected, len(points))
+	}
+	if points[0].Fields["value"] != 22e200 || points[1].Fields["value"] != 21e200 || points[1].Fields["raw"] != 22.0 || points[2].Fields["value"] != 1e200 {
+		t.Fatalf("unexpected recalibrated points %+v", points)
+	}
+}
+
+// countingStore counts the queries.
+type countingStore struct {
+	storage.Storage
+	queries int
+}
+
+func (s *countingStore) Query(q storage.Query) ([]Point, error) {
+	s.queries++
+	return s.Storage.Query(q)
+}
+
+func TestSeriesWindowsStartAtFirstPoint(t *testing.T) {
+	useEmbeddedStorage(t)
+	at := time.Unix(1546300800, 0)
+	collectMetrics([]Point{
+		{Measurement: "datapoint", Tags: Tags{"device": "typo", "sensor": "1"}, Fields: Fields{"value": 21.5}, Time: at},
+		{Measurement: "datapoint", Tags: Tags{"device": "typo", "sensor": "1"}, Fields: Fields{"value": 19.0}, Time: at.Add(36 * time.Hour)},
+	})
+	ingestQueue.Flush()
+	store := &countingStore{Storage: dataStore}
+	dataStore = store
+
+	if err := relabelSeries(Tags{"device": "typo"}, Tags{"device": "shredder"}); err != nil {
+		t.Fatal(err)
+	}
+	// One window for each point and one to find that no point is left
+	if store.queries != 3 {
+		t.Fatalf("relabeling queried %d windows", store.queries)
+	}
+	if points, _ := rawPoints(Tags{"device": "shredder"}, at, at.Add(48*time.Hour)); len(points) != 2 {
+		t.Fatalf("expected 2 relabeled points, actual %d", len(points))
+	}
+	store.queries = 0
+	if _, _, err := recalibrateSeries(Tags{"device": "nothing"}, nil, time.Unix(0, 0), time.Now()); err != nil || store.queries != 0 {
+		t.Fatalf("recalibrating a series without data queried %d windows: %v", store.queries, err)
+	}
+}
+
+// unwritableStore fails all writes.
+type unwritableStore struct {
+	storage.Storage
+}
+
+func (unwritableStore) Write(points []Point) error {
+	return errors.New("connection refused")
+}
+
+func TestSeriesActionsWriteQueuedPoints(t *testing.T) {
+	useEmbeddedStorage(t)
+	at := time.Unix(1546300800, 0)
+	collectMetrics([]Point{{Measurement: "datapoint", Tags: Tags{"device": "shredder", "sensor": "1"}, Fields: Fields{"value": 21.5}, Time: at}})
+
+	if err := applySeriesAction(SeriesPurge, Tags{"device": "shredder"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	ingestQueue.Flush()
+	if points, _ := rawPoints(Tags{"device": "shredder"}, at, at.Add(time.Minute)); len(points) != 0 {
+		t.Fatalf("queued point was not purged: %+v", points)
+	}
+
+	queue, err := ingest.New(unwritableStore{dataStore}, ingest.Options{FlushInterval: time.Hour, MinBackoff: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	stored := ingestQueue
+	ingestQueue = queue
+	defer func() { ingestQueue = stored }()
+	dataStore.Write([]Point{{Measurement: "datapoint", Tags: Tags{"device": "shredder", "sensor": "1"}, Fields: Fields{"value": 20.0}, Time: at}})
+	collectMetrics([]Point{{Measurement: "datapoint", Tags: Tags{"device": "shredder", "sensor": "1"}, Fields: Fields{"value": 22.0}, Time: at.Add(time.Second)}})
+
+	if err := applySeriesAction(SeriesPurge, Tags{"device": "shredder"}, nil); err == nil {
+		t.Fatal("purge succeeded although queued points could not be written")
+	}
+	if _, _, err := recalibrateSeries(Tags{"device": "shredder"}, nil, at, at.Add(time.Hour)); err == nil {
+		t.Fatal("recalibration succeeded although queued points could not be written")
+	}
+	if points, _ := rawPoints(Tags{"device": "shredder"}, at, at.Add(time.Minute)); len(points) != 1 {
+		t.Fatalf("failed purge changed the stored data: %+v", points)
+	}
+}
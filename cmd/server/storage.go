@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/ingest"
+	"github.com/iot-bp-project-2018/raspi-server/internal/storage"
+)
+
+var dataStore storage.Storage
+
+// ingestQueue writes collected points to dataStore in the background.
+var ingestQueue *ingest.Queue
+
+// initMetrics opens the storage selected with the -storage flag. If it cannot
+// be reached, points are queued and spilled until it is available. Only if the
+// -storage-fallback flag is set, the storage it selects is used instead until
+// the server is restarted; points written to it are not moved back.
+func initMetrics() error {
+	store, err := openStorage(*storageFlag)
+	if err != nil {
+		return err
+	}
+	err = store.Ping()
+	switch {
+	case err == nil:
+		dataStore = store
+	case *storageFallbackFlag == "":
+		log.Println("[storage] storage cannot be reached, points are queued until it is available:", err)
+		dataStore = store
+	default:
+		log.Printf("[storage] storage cannot be reached, using %s instead: %v", *storageFallbackFlag, err)
+		store.Close()
+		fallback, err := openStorage(*storageFallbackFlag)
+		if err != nil {
+			return err
+		}
+		dataStore = fallback
+	}
+	return startIngest()
+}
+
+// startIngest starts the queue that writes collected points.
+func startIngest() error {
+	queue, err := ingest.New(dataStore, ingest.Options{SpillFile: ingestSpillFile})
+	if err != nil {
+		return err
+	}
+	ingestQueue = queue
+	return nil
+}
+
+// closeMetrics writes or spills the queued points and closes the storage.
+func closeMetrics() {
+	if ingestQueue != nil {
+		if err := ingestQueue.Close(); err != nil {
+			log.Println("[storage] failed to keep queued points:", err)
+		}
+	}
+	if dataStore != nil {
+		if err := dataStore.Close(); err != nil {
+			log.Println("[storage] failed to close storage:", err)
+		}
+	}
+}
+
+// openStorage opens a storage with the credentials and settings it needs.
+func openStorage(spec string) (storage.Storage, error) {
+	return storage.Open(spec, storageOptions(spec))
+}
+
+// storageOptions returns the credentials and settings of a storage.
+func storageOptions(spec string) storage.Options {
+	options := storage.Options{
+		Database:           influxDatabase,
+		Username:           influxUser,
+		Organization:       influxOrganization,
+		Retention:          *retentionFlag,
+		DownsampleAfter:    *downsampleAfterFlag,
+		DownsampleInterval: *downsampleIntervalFlag,
+		CompactInterval:    embeddedCompactInterval,
+	}
+	switch {
+	case strings.HasPrefix(spec, "influx1:"):
+		options.Password = lookupSecret(influxPasswordSecret)
+	case strings.HasPrefix(spec, "influx2:"):
+		options.Token = lookupSecret(influxTokenSecret)
+	}
+	return options
+}
+
+// Fields ...
+type Fields = storage.Fields
+
+// Tags ...
+type Tags = storage.Tags
+
+// Point is a single data point.
+type Point = storage.Point
+
+// collectMetrics queues the points for writing. It does not wait for the
+// storage.
+func collectMetrics(points []Point) {
+	if ingestQueue == nil || len(points) == 0 {
+		return
+	}
+	if err := ingestQueue.Add(points); err != nil {
+		log.Println("[storage] failed to queue points:", err)
+	}
+}
+
+// validateDataQuery checks the time range and resolution of a data query
+// against the limits of the server.
+func validateDataQuery(from, to time.Time, resolutionSeconds int) error {
+	if !from.Before(to) {
+		return errors.New("Begin of the time range must be before its end")
+	}
+	if to.Sub(from) > maxQueryRange {
+		return fmt.Errorf("Time range exceeds %d days", maxQueryRange/(24*time.Hour))
+	}
+	if resolutionSeconds < int(minQueryResolution/time.Second) || int64(resolutionSeconds) > int64(maxQueryRange/time.Second) {
+		return fmt.Errorf("Resolution must be between %d and %d seconds", minQueryResolution/time.Second, maxQueryRange/time.Second)
+	}
+	if buckets := to.Sub(from) / (time.Duration(resolutionSeconds) * time.Second); buckets > maxQueryBuckets {
+		return fmt.Errorf("Query selects %d values, at most %d are allowed", buckets, maxQueryBuckets)
+	}
+	return nil
+}
+
+// DataPoint holds the time and the aggregates of one interval of a data
+// query, named after the aggregate. Aggregates without value are null.
+type DataPoint map[string]interface{}
+
+// columns returns the names of the values of the data points.
+func (o AggregationOptions) columns() []string {
+	if len(o.Aggregates) == 0 {
+		return []string{"time", string(storage.Mean)}
+	}
+	return append([]string{"time"}, o.Aggregates...)
+}
+
+// apply adds the options to a query.
+func (o AggregationOptions) apply(q *storage.Query) error {
+	if len(o.Aggregates) > maxQueryAggregates {
+		return fmt.Errorf("At most %d aggregates are allowed", maxQueryAggregates)
+	}
+	q.Aggregates = []storage.Aggregate{storage.Mean}
+	if len(o.Aggregates) > 0 {
+		q.Aggregates = make([]storage.Aggregate, len(o.Aggregates))
+		for i, aggregate := range o.Aggregates {
+			q.Aggregates[i] = storage.Aggregate(aggregate)
+		}
+	}
+	q.Fill = storage.Fill(o.Fill)
+	q.Location = time.UTC
+	if o.Timezone != "" {
+		location, err := time.LoadLocation(o.Timezone)
+		if err != nil || o.Timezone == "Local" {
+			return fmt.Errorf("Unknown timezone '%s'", o.Timezone)
+		}
+		q.Location = location
+	}
+	return nil
+}
+
+// sensorQuery builds and validates the data query of a sensor.
+func sensorQuery(deviceID string, sensorID int, from, to time.Time, resolutionSeconds int, options AggregationOptions) (storage.Query, error) {
+	if err := validateDataQuery(from, to, resolutionSeconds); err != nil {
+		return storage.Query{}, err
+	}
+	q := storage.Query{
+		Measurement: "datapoint",
+		Match:       Tags{"device": deviceID, "sensor": strconv.Itoa(sensorID)},
+		From:        from,
+		To:          to,
+		Field:       "value",
+		Interval:    time.Duration(resolutionSeconds) * time.Second,
+	}
+	if err := options.apply(&q); err != nil {
+		return storage.Query{}, err
+	}
+	return q, q.Validate()
+}
+
+// runQuery runs a validated query. Errors of the storage are logged and not
+// passed on to clients.
+func runQuery(q storage.Query) ([]Point, error) {
+	if dataStore == nil {
+		return nil, errNoStorage
+	}
+	points, err := dataStore.Query(q)
+	if err != nil {
+		log.Println("[storage] data query failed:", err)
+		return nil, errors.New("Data query failed")
+	}
+	return points, nil
+}
+
+// dataPoint returns the time and the aggregates of a query result.
+func dataPoint(q storage.Query, at time.Time, fields Fields) DataPoint {
+	point := DataPoint{"time": at.In(q.Location).Format(time.RFC3339Nano)}
+	for _, aggregate := range q.Aggregates {
+		point[string(aggregate)] = fields[string(aggregate)]
+	}
+	return point
+}
+
+// queryMetrics returns the aggregates of a sensor in intervals of
+// resolutionSeconds.
+func queryMetrics(deviceID string, sensorID int, from, to time.Time, resolutionSeconds int, options AggregationOptions) ([]DataPoint, error) {
+	q, err := sensorQuery(deviceID, sensorID, from, to, resolutionSeconds, options)
+	if err != nil {
+		return nil, err
+	}
+	points, err := runQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]DataPoint, len(points))
+	for i, point := range points {
+		result[i] = dataPoint(q, point.Time, point.Fields)
+	}
+	return result, nil
+}
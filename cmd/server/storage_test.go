@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateDataQuery(t *testing.T) {
+	from := time.Unix(1546300800, 0)
+	tests := []struct {
+		to         time.Time
+		resolution int
+		valid      bool
+	}{
+		{from.Add(time.Hour), 60, true},
+		{from, 60, false},
+		{from.Add(time.Hour), 0, false},
+		{from.Add(time.Hour), -60, false},
+		{from.Add(maxQueryRange + time.Hour), 86400, false},
+		{from.Add(30 * 24 * time.Hour), 1, false},
+	}
+	for _, test := range tests {
+		err := validateDataQuery(from, test.to, test.resolution)
+		if (err == nil) != test.valid {
+			t.Errorf("%v with resolution %d: unexpected result %v", test.to.Sub(from), test.resolution, err)
+		}
+	}
+}
+
+func TestQueryMetrics(t *testing.T) {
+	useEmbeddedStorage(t)
+	at := time.Unix(1546300800, 0)
+	collectMetrics([]Point{
+		{Measurement: "datapoint", Tags: Tags{"device": "shredder-2.local", "sensor": "1"}, Fields: Fields{"value": 1.0}, Time: at},
+		{Measurement: "datapoint", Tags: Tags{"device": "shredder-2.local", "sensor": "1"}, Fields: Fields{"value": 3.0}, Time: at.Add(time.Second)},
+	})
+	ingestQueue.Flush()
+
+	options := AggregationOptions{Aggregates: []string{"max", "count", "p50"}, Fill: "zero", Timezone: "UTC"}
+	rows, err := queryMetrics("shredder-2.local", 1, at, at.Add(2*time.Minute), 60, options)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0]["max"] != 3.0 || rows[0]["count"] != 2.0 || rows[0]["p50"] != 1.0 || rows[1]["max"] != 0.0 {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+	if rows[0]["time"] != "2019-01-01T00:00:00Z" {
+		t.Fatalf("unexpected time %v", rows[0]["time"])
+	}
+	for _, options := range []AggregationOptions{{Aggregates: []string{"p101"}}, {Fill: "random"}, {Timezone: "Mars/Olympus"}} {
+		if _, err := queryMetrics("shredder-2.local", 1, at, at.Add(time.Hour), 60, options); err == nil {
+			t.Fatalf("expected error for %+v", options)
+		}
+	}
+}
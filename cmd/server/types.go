@@ -2,21 +2,26 @@ package main
 
 import (
 	"encoding/json"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/calibration"
+	"github.com/iot-bp-project-2018/raspi-server/internal/deviceconfig"
+	"github.com/iot-bp-project-2018/raspi-server/internal/sensorpayload"
 )
 
-// SensorPayload contains all the fields sent by one sensor packet
-type SensorPayload struct {
-	SensorID byte    `json:"sensor_id"`
-	Value    float32 `json:"value"`
-	Type     string  `json:"type"`
-	Unit     string  `json:"unit"`
-}
+// SensorPayload contains all the fields of one sensor reading. A sensor packet
+// can contain several readings.
+type SensorPayload = sensorpayload.Reading
 
-// SensorPayloadFromJSONBuffer decodes a json byte array into SensorPayload
-func SensorPayloadFromJSONBuffer(buffer []byte) SensorPayload {
-	p := SensorPayload{}
-	json.Unmarshal(buffer, &p)
-	return p
+// AggregationOptions select how data queries combine the values in each
+// interval of the resolution. Aggregates are mean (the default), median, min,
+// max, sum, count, first, last, stddev, derivative (per second), integral (in
+// value-seconds) and percentiles like p95. Fill is null (the default), none,
+// zero, previous or linear. Intervals are aligned in Timezone, e.g.
+// Europe/Berlin, and UTC if it is empty.
+type AggregationOptions struct {
+	Aggregates []string `json:"aggregates"`
+	Fill       string   `json:"fill"`
+	Timezone   string   `json:"timezone"`
 }
 
 // DataQueryRequest requests data from the database
@@ -26,6 +31,7 @@ type DataQueryRequest struct {
 	BeginUnix         int    `json:"beginUnix"`
 	EndUnix           int    `json:"endUnix"`
 	ResolutionSeconds int    `json:"resolutionSeconds"`
+	AggregationOptions
 }
 
 // RelativeDataQueryRequest requests data from the database
@@ -35,4 +41,150 @@ type RelativeDataQueryRequest struct {
 	BeginRelativeSeconds int    `json:"beginRelativeSeconds"`
 	EndRelativeSeconds   int    `json:"endRelativeSeconds"`
 	ResolutionSeconds    int    `json:"resolutionSeconds"`
+	AggregationOptions
+}
+
+// ProvisioningRequest approves or rejects a device waiting for provisioning
+type ProvisioningRequest struct {
+	Address       string `json:"address"`
+	RequireButton bool   `json:"requireButton"`
+}
+
+// RevocationRequest revokes or restores a communication partner
+type RevocationRequest struct {
+	Address string `json:"address"`
+	Reason  string `json:"reason"`
+}
+
+// DeviceNameRequest changes the display name of a device
+type DeviceNameRequest struct {
+	DeviceID string `json:"deviceId"`
+	Name     string `json:"name"`
+}
+
+// DeviceMetadataRequest replaces the metadata of a device
+type DeviceMetadataRequest struct {
+	DeviceID string   `json:"deviceId"`
+	Metadata Metadata `json:"metadata"`
+}
+
+// SensorMetadataRequest replaces the metadata of a sensor
+type SensorMetadataRequest struct {
+	DeviceID string   `json:"deviceId"`
+	SensorID int      `json:"sensorId"`
+	Metadata Metadata `json:"metadata"`
+}
+
+// FilteredDataQueryRequest requests data of all sensors selected by a filter
+type FilteredDataQueryRequest struct {
+	Filter            MetadataFilter `json:"filter"`
+	BeginUnix         int            `json:"beginUnix"`
+	EndUnix           int            `json:"endUnix"`
+	ResolutionSeconds int            `json:"resolutionSeconds"`
+	AggregationOptions
+}
+
+// SeriesSelector selects sensors for a multi-series query, either listed in
+// Sensors or by a metadata filter. Every sensor yields a series unless Combine
+// is set, which combines the values of all sensors into a single series: mean,
+// min, max or sum, e.g. the mean temperature of a room.
+type SeriesSelector struct {
+	Name    string          `json:"name"`
+	Sensors []SensorRef     `json:"sensors,omitempty"`
+	Filter  *MetadataFilter `json:"filter,omitempty"`
+	Combine string          `json:"combine,omitempty"`
+}
+
+// MultiSeriesQueryRequest requests the data of several series with the same
+// time intervals
+type MultiSeriesQueryRequest struct {
+	Series            []SeriesSelector `json:"series"`
+	BeginUnix         int              `json:"beginUnix"`
+	EndUnix           int              `json:"endUnix"`
+	ResolutionSeconds int              `json:"resolutionSeconds"`
+	AggregationOptions
+}
+
+// DeleteDeviceRequest deletes a device. With the relabel series action, its
+// data is moved to the device RelabelTo.
+type DeleteDeviceRequest struct {
+	DeviceID  string       `json:"deviceId"`
+	Series    SeriesAction `json:"series"`
+	RelabelTo string       `json:"relabelTo"`
+}
+
+// RetireSensorRequest retires a sensor or restores a retired sensor. With the
+// relabel series action, its data is moved to the sensor RelabelTo of the
+// same device.
+type RetireSensorRequest struct {
+	DeviceID  string       `json:"deviceId"`
+	SensorID  int          `json:"sensorId"`
+	Retired   bool         `json:"retired"`
+	Series    SeriesAction `json:"series"`
+	RelabelTo int          `json:"relabelTo"`
+}
+
+// MergeDevicesRequest merges the source device into the target device. With
+// the relabel series action, the data of the source is moved to the target.
+type MergeDevicesRequest struct {
+	SourceID string       `json:"sourceId"`
+	TargetID string       `json:"targetId"`
+	Series   SeriesAction `json:"series"`
+}
+
+// DeleteRuleRequest deletes an alert rule
+type DeleteRuleRequest struct {
+	ID string `json:"id"`
+}
+
+// CommandRequest sends a command to a device
+type CommandRequest struct {
+	DeviceID string          `json:"deviceId"`
+	Command  string          `json:"command"`
+	Actuator *byte           `json:"actuator"`
+	Value    json.RawMessage `json:"value"`
+}
+
+// ActuatorsRequest replaces the actuator definitions of a device
+type ActuatorsRequest struct {
+	DeviceID  string     `json:"deviceId"`
+	Actuators []Actuator `json:"actuators"`
+}
+
+// DeviceConfigRequest replaces the desired configuration of a device
+type DeviceConfigRequest struct {
+	DeviceID        string                       `json:"deviceId"`
+	IntervalSeconds int                          `json:"intervalSeconds"`
+	Sensors         map[byte]deviceconfig.Sensor `json:"sensors"`
+}
+
+// CalibrationRequest replaces the calibration of a sensor
+type CalibrationRequest struct {
+	DeviceID    string               `json:"deviceId"`
+	SensorID    int                  `json:"sensorId"`
+	Calibration calibration.Pipeline `json:"calibration"`
+}
+
+// RecalibrationRequest recomputes the calibrated values of a sensor stored
+// between BeginUnix and EndUnix with its current calibration. An EndUnix of 0
+// stands for now.
+type RecalibrationRequest struct {
+	DeviceID  string `json:"deviceId"`
+	SensorID  int    `json:"sensorId"`
+	BeginUnix int    `json:"beginUnix"`
+	EndUnix   int    `json:"endUnix"`
+}
+
+// ExportRequest streams the readings of whole devices, single sensors and the
+// sensors selected by Filter between BeginUnix and EndUnix in Format: csv,
+// ndjson or lineprotocol. Times are formatted in Timezone, UTC if it is
+// empty.
+type ExportRequest struct {
+	Devices   []string        `json:"devices,omitempty"`
+	Sensors   []SensorRef     `json:"sensors,omitempty"`
+	Filter    *MetadataFilter `json:"filter,omitempty"`
+	BeginUnix int             `json:"beginUnix"`
+	EndUnix   int             `json:"endUnix"`
+	Format    string          `json:"format"`
+	Timezone  string          `json:"timezone"`
 }
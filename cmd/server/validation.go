@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+	"github.com/iot-bp-project-2018/raspi-server/internal/measurement"
+	"github.com/iot-bp-project-2018/raspi-server/internal/sensorpayload"
+	"github.com/iot-bp-project-2018/raspi-server/internal/util/rotatefile"
+)
+
+// validateReading checks a decoded reading against the registry of known
+// measurement types and its measurement time against the timestamp of the
+// message that carries it.
+func validateReading(reading SensorPayload, messageTimestamp int64) error {
+	if reading.DeviceID != "" && (len(reading.DeviceID) > maxDeviceIDLength || !commproto.ValidAddress(reading.DeviceID)) {
+		return fmt.Errorf("invalid device id '%s'", reading.DeviceID)
+	}
+	messageTime := time.Unix(0, messageTimestamp)
+	readingTime := reading.Time(messageTimestamp)
+	if readingTime.After(messageTime.Add(readingClockTolerance)) {
+		return fmt.Errorf("reading time %v is in the future", readingTime)
+	}
+	if readingTime.Before(messageTime.Add(-maxReadingAge)) {
+		return fmt.Errorf("reading time %v is outdated", readingTime)
+	}
+	_, _, err := normalizeReading(reading)
+	return err
+}
+
+// normalizeReading converts the value of a reading into the canonical unit of
+// its measurement type.
+func normalizeReading(reading SensorPayload) (value float64, unit string, err error) {
+	if math.IsNaN(reading.Value) || math.IsInf(reading.Value, 0) {
+		return 0, "", fmt.Errorf("value %v is not a number", reading.Value)
+	}
+	return measurement.Default.Normalize(reading.Type, reading.Unit, reading.Value)
+}
+
+// QuarantineEntry is written to the quarantine log for every rejected
+// payload or reading.
+type QuarantineEntry struct {
+	Time    time.Time      `json:"time"`
+	Sender  string         `json:"sender"`
+	Code    string         `json:"code"`
+	Error   string         `json:"error"`
+	Reading *SensorPayload `json:"reading,omitempty"`
+	Payload []byte         `json:"payload,omitempty"`
+}
+
+var quarantine struct {
+	mutex    sync.Mutex
+	file     *rotatefile.File
+	total    int
+	bySender map[string]int
+}
+
+func openQuarantine() {
+	quarantine.bySender = make(map[string]int)
+	file, err := rotatefile.Open(quarantineFile, quarantineMaxSize, quarantineKeep)
+	if err != nil {
+		log.Println("[validation] failed to open quarantine log, rejected readings are only counted")
+		log.Println(err)
+		return
+	}
+	quarantine.file = file
+}
+
+// rejectPayload quarantines a payload that could not be decoded.
+func rejectPayload(sender string, payload []byte, err error) {
+	entry := QuarantineEntry{Sender: sender, Code: "malformed-payload", Error: err.Error(), Payload: payload}
+	quarantineEntry(entry)
+	sendRejection(sender, sensorpayload.Rejection{Code: entry.Code, Message: entry.Error})
+}
+
+// rejectReading quarantines a single invalid reading.
+func rejectReading(sender string, reading SensorPayload, err error) {
+	entry := QuarantineEntry{Sender: sender, Code: "invalid-reading", Error: err.Error(), Reading: &reading}
+	quarantineEntry(entry)
+	sensorID := reading.SensorID
+	sendRejection(sender, sensorpayload.Rejection{Code: entry.Code, Message: entry.Error, SensorID: &sensorID})
+}
+
+func quarantineEntry(entry QuarantineEntry) {
+	entry.Time = time.Now()
+	log.Printf("[validation] rejected sensor data from '%s': %s\n", entry.Sender, entry.Error)
+
+	quarantine.mutex.Lock()
+	defer quarantine.mutex.Unlock()
+	quarantine.total++
+	quarantine.bySender[entry.Sender]++
+	if quarantine.file != nil {
+		if err := quarantine.file.WriteJSON(entry); err != nil {
+			log.Println("[validation] failed to write quarantine log:", err)
+		}
+	}
+}
+
+func sendRejection(sender string, rejection sensorpayload.Rejection) {
+	body, err := json.Marshal(rejection)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if err := protoClient.SendMessage(sender, commproto.MessageError, commproto.ContentTypeJSON, body); err != nil {
+		log.Printf("[validation] failed to send rejection to '%s': %v\n", sender, err)
+	}
+}
+
+// getQuarantineStats returns the total number of rejections and the number of
+// rejections per sender.
+func getQuarantineStats() (total int, bySender map[string]int) {
+	quarantine.mutex.Lock()
+	defer quarantine.mutex.Unlock()
+	bySender = make(map[string]int, len(quarantine.bySender))
+	for sender, count := range quarantine.bySender {
+		bySender[sender] = count
+	}
+	return quarantine.total, bySender
+}
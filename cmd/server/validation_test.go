@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateReading(t *testing.T) {
+	now := time.Unix(1546300800, 0).UnixNano()
+	valid := SensorPayload{DeviceID: "FFFF", SensorID: 1, Value: 21.5, Type: "temperature", Unit: "°C"}
+	if err := validateReading(valid, now); err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range []func(r *SensorPayload){
+		func(r *SensorPayload) { r.Timestamp = now + int64(time.Minute) },
+		func(r *SensorPayload) { r.Timestamp = now - int64(maxReadingAge) - 1 },
+		func(r *SensorPayload) { r.Unit = "%" },
+		func(r *SensorPayload) { r.DeviceID = "bad\nid" },
+	} {
+		reading := valid
+		change(&reading)
+		if err := validateReading(reading, now); err == nil {
+			t.Errorf("invalid reading was accepted: %+v", reading)
+		}
+	}
+}
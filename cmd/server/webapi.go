@@ -3,12 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
-	"regexp"
+	"strconv"
 	"sync/atomic"
 	"time"
 
+	"github.com/iot-bp-project-2018/raspi-server/internal/command"
+	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+	"github.com/iot-bp-project-2018/raspi-server/internal/deviceconfig"
+	"github.com/iot-bp-project-2018/raspi-server/internal/measurement"
+	"github.com/iot-bp-project-2018/raspi-server/internal/rules"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 )
@@ -16,7 +22,7 @@ import (
 type generic map[string]interface{}
 
 var authorizationLock int32
-var alphanumeric = regexp.MustCompile("^[a-zA-Z0-9_]+$")
+var partnerRevocations *commproto.RevocationList
 
 func startWebserver() {
 	e := echo.New()
@@ -27,9 +33,40 @@ func startWebserver() {
 	e.GET("/api/status", getStatus)
 	e.GET("/api/register", getDeviceToken)
 	e.GET("/api/getDevices", getDevices)
+	e.GET("/api/getLivenessEvents", getLivenessEvents)
 	e.POST("/api/queryData", queryData)
 	e.POST("/api/queryDataRelative", queryDataRelative)
+	e.POST("/api/queryFilteredData", queryFilteredData)
+	e.POST("/api/queryMultipleSeries", queryMultipleSeriesHandler)
+	e.POST("/api/exportData", exportData)
 	e.POST("/api/updateDeviceName", postUpdateDeviceName)
+	e.POST("/api/updateDeviceMetadata", postUpdateDeviceMetadata)
+	e.POST("/api/updateSensorMetadata", postUpdateSensorMetadata)
+	e.POST("/api/deleteDevice", postDeleteDevice)
+	e.POST("/api/retireSensor", postRetireSensor)
+	e.POST("/api/updateCalibration", postUpdateCalibration)
+	e.POST("/api/recalibrateSensor", postRecalibrateSensor)
+	e.POST("/api/mergeDevices", postMergeDevices)
+	e.POST("/api/updateActuators", postUpdateActuators)
+	e.POST("/api/sendCommand", postSendCommand)
+	e.GET("/api/getCommands", getCommands)
+	e.GET("/api/getDeviceConfigs", getDeviceConfigs)
+	e.POST("/api/updateDeviceConfig", postUpdateDeviceConfig)
+	e.GET("/api/startProvisioning", getStartProvisioning)
+	e.GET("/api/getPendingDevices", getPendingDevicesHandler)
+	e.POST("/api/approveDevice", postApproveDevice)
+	e.POST("/api/rejectDevice", postRejectDevice)
+	e.GET("/api/getRevocations", getRevocations)
+	e.POST("/api/revokePartner", postRevokePartner)
+	e.POST("/api/restorePartner", postRestorePartner)
+	e.GET("/api/getSecurityEvents", getSecurityEvents)
+	e.GET("/api/getQuarantineStats", getQuarantineStatsHandler)
+	e.GET("/api/getIngestStats", getIngestStats)
+	e.GET("/api/getMeasurementTypes", getMeasurementTypes)
+	e.GET("/api/getRules", getRules)
+	e.POST("/api/saveRule", postSaveRule)
+	e.POST("/api/deleteRule", postDeleteRule)
+	e.GET("/api/getAlerts", getAlerts)
 	e.Static("/", "static")
 	log.Println("[webapi] started http server on " + webserverEndpoint)
 	e.Logger.Fatal(e.Start(webserverEndpoint))
@@ -77,7 +114,47 @@ func getDevices(c echo.Context) error {
 	if !authorized {
 		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
 	}
-	return c.JSON(http.StatusOK, generic{"devices": deviceStorage.Devices})
+	filter := MetadataFilter{
+		Location: c.QueryParam("location"),
+		Room:     c.QueryParam("room"),
+		Type:     c.QueryParam("type"),
+		Tags:     c.QueryParams()["tag"],
+	}
+	showRetired := c.QueryParam("retired") == "true"
+	selected := []DeviceStatus{}
+	for _, device := range deviceStorage.Devices() {
+		if !showRetired {
+			sensors := device.Sensors[:0]
+			for _, sensor := range device.Sensors {
+				if sensor.RetiredAt == nil {
+					sensors = append(sensors, sensor)
+				}
+			}
+			device.Sensors = sensors
+		}
+		if filter.MatchesDevice(device) {
+			status := DeviceStatus{Device: device}
+			if l, ok := liveness.Get(device.ID); ok {
+				status.Liveness = &l
+			}
+			selected = append(selected, status)
+		}
+	}
+	return c.JSON(http.StatusOK, generic{"devices": selected})
+}
+
+// DeviceStatus is a device together with its liveness.
+type DeviceStatus struct {
+	Device
+	Liveness *DeviceLiveness `json:"liveness,omitempty"`
+}
+
+func getLivenessEvents(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	return c.JSON(http.StatusOK, generic{"events": liveness.RecentEvents()})
 }
 
 func queryData(c echo.Context) error {
@@ -90,12 +167,15 @@ func queryData(c echo.Context) error {
 	if err != nil {
 		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
 	}
-	if !alphanumeric.MatchString(request.DeviceID) {
+	if !commproto.ValidAddress(request.DeviceID) {
 		return c.JSON(http.StatusOK, generic{"err": "Bad device id field in request"})
 	}
 	from, to := time.Unix(int64(request.BeginUnix), 0), time.Unix(int64(request.EndUnix), 0)
-	res := queryMetrics(request.DeviceID, request.SensorID, from, to, request.ResolutionSeconds)
-	return c.JSON(http.StatusOK, generic{"datapoints": res})
+	res, err := queryMetrics(request.DeviceID, request.SensorID, from, to, request.ResolutionSeconds, request.AggregationOptions)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	return c.JSON(http.StatusOK, generic{"columns": request.columns(), "datapoints": res})
 }
 
 func queryDataRelative(c echo.Context) error {
@@ -108,16 +188,579 @@ func queryDataRelative(c echo.Context) error {
 	if err != nil {
 		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
 	}
-	if !alphanumeric.MatchString(request.DeviceID) {
+	if !commproto.ValidAddress(request.DeviceID) {
 		return c.JSON(http.StatusOK, generic{"err": "Bad device id field in request"})
 	}
 	now := time.Now()
 	from := now.Add(time.Second * time.Duration(request.BeginRelativeSeconds))
 	to := now.Add(time.Second * time.Duration(request.EndRelativeSeconds))
-	res := queryMetrics(request.DeviceID, request.SensorID, from, to, request.ResolutionSeconds)
-	return c.JSON(http.StatusOK, generic{"datapoints": res, "relativeTime": now})
+	res, err := queryMetrics(request.DeviceID, request.SensorID, from, to, request.ResolutionSeconds, request.AggregationOptions)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	return c.JSON(http.StatusOK, generic{"columns": request.columns(), "datapoints": res, "relativeTime": now})
+}
+
+// FilteredSeries contains the data of one sensor selected by a filter.
+type FilteredSeries struct {
+	SensorRef
+	Datapoints []DataPoint `json:"datapoints"`
+}
+
+func queryFilteredData(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := FilteredDataQueryRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	sensors := selectSensors(request.Filter)
+	if len(sensors) > maxFilteredSeries {
+		return c.JSON(http.StatusOK, generic{"err": fmt.Sprintf("Filter selects more than %d sensors", maxFilteredSeries)})
+	}
+	from, to := time.Unix(int64(request.BeginUnix), 0), time.Unix(int64(request.EndUnix), 0)
+	if err := validateDataQuery(from, to, request.ResolutionSeconds); err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	series := make([]FilteredSeries, 0, len(sensors))
+	for _, sensor := range sensors {
+		res, err := queryMetrics(sensor.DeviceID, int(sensor.SensorID), from, to, request.ResolutionSeconds, request.AggregationOptions)
+		if err != nil {
+			return c.JSON(http.StatusOK, generic{"err": err.Error()})
+		}
+		series = append(series, FilteredSeries{SensorRef: sensor, Datapoints: res})
+	}
+	return c.JSON(http.StatusOK, generic{"columns": request.columns(), "series": series})
+}
+
+func queryMultipleSeriesHandler(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := MultiSeriesQueryRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	series, err := queryMultipleSeries(request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	return c.JSON(http.StatusOK, generic{"columns": request.columns(), "series": series})
+}
+
+// exportData streams the selected readings. Errors after the export started
+// cannot be reported in the response, which ends early instead.
+func exportData(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := ExportRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	format, location, queries, err := request.prepare()
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	if dataStore == nil {
+		return c.JSON(http.StatusOK, generic{"err": errNoStorage.Error()})
+	}
+	// Readings that are still queued belong to the export.
+	if err := flushQueued(); err != nil {
+		log.Println("[webapi] export:", err)
+		return c.JSON(http.StatusOK, generic{"err": "Could not write queued readings"})
+	}
+	response := c.Response()
+	response.Header().Set(echo.HeaderContentType, format.ContentType())
+	response.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", "export"+format.Extension()))
+	response.WriteHeader(http.StatusOK)
+	if count, err := exportReadings(response, format, location, queries); err != nil {
+		log.Printf("[webapi] export failed after %d readings: %v\n", count, err)
+	}
+	return nil
 }
 
 func postUpdateDeviceName(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := DeviceNameRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	if err := deviceStorage.SetName(request.DeviceID, request.Name); err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	return c.JSON(http.StatusOK, generic{"err": nil})
+}
+
+func postUpdateDeviceMetadata(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := DeviceMetadataRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	if err := deviceStorage.SetMetadata(request.DeviceID, request.Metadata); err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	device, _ := deviceStorage.Get(request.DeviceID)
+	return c.JSON(http.StatusOK, generic{"err": nil, "device": device})
+}
+
+func postUpdateSensorMetadata(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := SensorMetadataRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	if request.SensorID < 0 || request.SensorID > 255 {
+		return c.JSON(http.StatusOK, generic{"err": "Bad sensor id field in request"})
+	}
+	if err := deviceStorage.SetSensorMetadata(request.DeviceID, byte(request.SensorID), request.Metadata); err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	device, _ := deviceStorage.Get(request.DeviceID)
+	return c.JSON(http.StatusOK, generic{"err": nil, "device": device})
+}
+
+func getStartProvisioning(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	bootstrap, expires, err := openProvisioningWindow()
+	if err != nil {
+		log.Println("[webapi] failed to generate bootstrap secret:", err)
+		return c.JSON(http.StatusOK, generic{"err": "Could not generate bootstrap secret"})
+	}
+	return c.JSON(http.StatusOK, generic{"server": protoClient.HostAddress(), "bootstrap": bootstrap, "expires": expires})
+}
+
+func getPendingDevicesHandler(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	return c.JSON(http.StatusOK, generic{"devices": getPendingDevices()})
+}
+
+func postApproveDevice(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := ProvisioningRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	if request.RequireButton {
+		if !atomic.CompareAndSwapInt32(&authorizationLock, 0, 1) {
+			return c.JSON(http.StatusOK, generic{"err": "Another authorization process is already running"})
+		}
+		defer atomic.StoreInt32(&authorizationLock, 0)
+	}
+	timeout, cancel := context.WithTimeout(context.Background(), buttonTimeout)
+	defer cancel()
+	if err := approvePendingDevice(timeout, request.Address, request.RequireButton); err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	return c.JSON(http.StatusOK, generic{"err": nil})
+}
+
+func postRejectDevice(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := ProvisioningRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	if err := rejectPendingDevice(request.Address); err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	return c.JSON(http.StatusOK, generic{"err": nil})
+}
+
+func getRevocations(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	return c.JSON(http.StatusOK, generic{"revocations": partnerRevocations.Revocations()})
+}
+
+func postRevokePartner(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := RevocationRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	revocation, err := partnerRevocations.Revoke(request.Address, request.Reason)
+	if err != nil {
+		log.Println("[webapi] failed to revoke partner:", err)
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	log.Printf("[webapi] partner '%s' revoked (%s)\n", request.Address, request.Reason)
+	return c.JSON(http.StatusOK, generic{"err": nil, "revocation": revocation})
+}
+
+func postRestorePartner(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := RevocationRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	if err := partnerRevocations.Restore(request.Address); err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	log.Printf("[webapi] partner '%s' restored\n", request.Address)
 	return c.JSON(http.StatusOK, generic{"err": nil})
 }
+
+func getSecurityEvents(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	summaries, recent, alerts := getSecurityReport()
+	return c.JSON(http.StatusOK, generic{"summaries": summaries, "recent": recent, "alerts": alerts})
+}
+
+func getQuarantineStatsHandler(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	total, bySender := getQuarantineStats()
+	return c.JSON(http.StatusOK, generic{"total": total, "senders": bySender})
+}
+
+func getIngestStats(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	if ingestQueue == nil {
+		return c.JSON(http.StatusOK, generic{"err": errNoStorage.Error()})
+	}
+	return c.JSON(http.StatusOK, generic{"stats": ingestQueue.Stats()})
+}
+
+func getMeasurementTypes(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	return c.JSON(http.StatusOK, generic{"types": measurement.Default.Types()})
+}
+
+func postDeleteDevice(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := DeleteDeviceRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	if err := request.Series.validate(); err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	if _, ok := deviceStorage.Get(request.DeviceID); !ok {
+		return c.JSON(http.StatusOK, generic{"err": "Unknown device"})
+	}
+	if request.Series == SeriesRelabel {
+		if _, ok := deviceStorage.Get(request.RelabelTo); !ok || request.RelabelTo == request.DeviceID {
+			return c.JSON(http.StatusOK, generic{"err": "Bad relabelTo field in request"})
+		}
+	}
+	// The stored data must not change if the device cannot be deleted.
+	if err := deviceStorage.CheckDelete(request.DeviceID); err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	err = applySeriesAction(request.Series, Tags{"device": request.DeviceID}, Tags{"device": request.RelabelTo})
+	if err != nil {
+		log.Println("[webapi] failed to update series of deleted device:", err)
+		return c.JSON(http.StatusOK, generic{"err": "Could not update stored data"})
+	}
+	if err := deviceStorage.Delete(request.DeviceID); err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	return c.JSON(http.StatusOK, generic{"err": nil})
+}
+
+func postRetireSensor(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := RetireSensorRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	if err := request.Series.validate(); err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	if request.SensorID < 0 || request.SensorID > 255 {
+		return c.JSON(http.StatusOK, generic{"err": "Bad sensor id field in request"})
+	}
+	// Stored data is only changed when a sensor is retired, not when it is
+	// brought back.
+	if !request.Retired && request.Series != "" && request.Series != SeriesKeep {
+		return c.JSON(http.StatusOK, generic{"err": "Series actions require retiring the sensor"})
+	}
+	if request.Series == SeriesRelabel && (request.RelabelTo < 0 || request.RelabelTo > 255 || request.RelabelTo == request.SensorID) {
+		return c.JSON(http.StatusOK, generic{"err": "Bad relabelTo field in request"})
+	}
+	// Validate the sensors before touching stored data.
+	device, ok := deviceStorage.Get(request.DeviceID)
+	if !ok || !device.hasSensor(byte(request.SensorID)) {
+		return c.JSON(http.StatusOK, generic{"err": "Unknown sensor"})
+	}
+	if request.Series == SeriesRelabel && !device.hasSensor(byte(request.RelabelTo)) {
+		return c.JSON(http.StatusOK, generic{"err": "Unknown relabelTo sensor"})
+	}
+	match := Tags{"device": request.DeviceID, "sensor": strconv.Itoa(request.SensorID)}
+	err = applySeriesAction(request.Series, match, Tags{"sensor": strconv.Itoa(request.RelabelTo)})
+	if err != nil {
+		log.Println("[webapi] failed to update series of retired sensor:", err)
+		return c.JSON(http.StatusOK, generic{"err": "Could not update stored data"})
+	}
+	if err := deviceStorage.RetireSensor(request.DeviceID, byte(request.SensorID), request.Retired); err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	return c.JSON(http.StatusOK, generic{"err": nil})
+}
+
+func postUpdateCalibration(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := CalibrationRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	if request.SensorID < 0 || request.SensorID > 255 {
+		return c.JSON(http.StatusOK, generic{"err": "Bad sensor id field in request"})
+	}
+	if err := deviceStorage.SetCalibration(request.DeviceID, byte(request.SensorID), request.Calibration); err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	device, _ := deviceStorage.Get(request.DeviceID)
+	return c.JSON(http.StatusOK, generic{"err": nil, "device": device})
+}
+
+func postRecalibrateSensor(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := RecalibrationRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	if request.SensorID < 0 || request.SensorID > 255 {
+		return c.JSON(http.StatusOK, generic{"err": "Bad sensor id field in request"})
+	}
+	device, ok := deviceStorage.Get(request.DeviceID)
+	if !ok || !device.hasSensor(byte(request.SensorID)) {
+		return c.JSON(http.StatusOK, generic{"err": "Unknown sensor"})
+	}
+	from, to := time.Unix(int64(request.BeginUnix), 0), time.Now()
+	if request.EndUnix != 0 {
+		to = time.Unix(int64(request.EndUnix), 0)
+	}
+	match := Tags{"device": request.DeviceID, "sensor": strconv.Itoa(request.SensorID)}
+	count, rejected, err := recalibrateSeries(match, device.calibration(byte(request.SensorID)), from, to)
+	if err != nil {
+		log.Println("[webapi] failed to recalibrate series:", err)
+		return c.JSON(http.StatusOK, generic{"err": "Could not update stored data"})
+	}
+	return c.JSON(http.StatusOK, generic{"err": nil, "points": count, "rejected": rejected})
+}
+
+func postMergeDevices(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := MergeDevicesRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	if err := request.Series.validate(); err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	_, sourceOK := deviceStorage.Get(request.SourceID)
+	_, targetOK := deviceStorage.Get(request.TargetID)
+	if !sourceOK || !targetOK || request.SourceID == request.TargetID {
+		return c.JSON(http.StatusOK, generic{"err": "Bad device id field in request"})
+	}
+	// The stored data must not change if the devices cannot be merged.
+	if err := deviceStorage.CheckMerge(request.SourceID, request.TargetID); err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	err = applySeriesAction(request.Series, Tags{"device": request.SourceID}, Tags{"device": request.TargetID})
+	if err != nil {
+		log.Println("[webapi] failed to update series of merged device:", err)
+		return c.JSON(http.StatusOK, generic{"err": "Could not update stored data"})
+	}
+	device, err := deviceStorage.Merge(request.SourceID, request.TargetID)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	return c.JSON(http.StatusOK, generic{"err": nil, "device": device})
+}
+
+func getRules(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	return c.JSON(http.StatusOK, generic{"rules": alertEngine.Rules(), "notifiers": alertEngine.Notifiers()})
+}
+
+func postSaveRule(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := rules.Rule{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	rule, err := alertEngine.SetRule(request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	log.Printf("[webapi] alert rule '%s' saved\n", rule.Name)
+	return c.JSON(http.StatusOK, generic{"err": nil, "rule": rule})
+}
+
+func postDeleteRule(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := DeleteRuleRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	if err := alertEngine.DeleteRule(request.ID); err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	return c.JSON(http.StatusOK, generic{"err": nil})
+}
+
+func getAlerts(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	return c.JSON(http.StatusOK, generic{"alerts": alertEngine.RecentAlerts()})
+}
+
+func postUpdateActuators(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := ActuatorsRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	if err := deviceStorage.SetActuators(request.DeviceID, request.Actuators); err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	device, _ := deviceStorage.Get(request.DeviceID)
+	return c.JSON(http.StatusOK, generic{"err": nil, "device": device})
+}
+
+func postSendCommand(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := CommandRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	cmd := command.Command{Name: request.Command, Actuator: request.Actuator, Value: request.Value}
+	record, err := issueCommand(request.DeviceID, cmd)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	return c.JSON(http.StatusOK, generic{"err": nil, "command": record})
+}
+
+func getCommands(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	return c.JSON(http.StatusOK, generic{"commands": getCommandHistory(c.QueryParam("deviceId"))})
+}
+
+func getDeviceConfigs(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	return c.JSON(http.StatusOK, generic{"configs": deviceConfigs.States()})
+}
+
+func postUpdateDeviceConfig(c echo.Context) error {
+	authorized := checkAuthorization(c)
+	if !authorized {
+		return c.JSON(http.StatusOK, generic{"err": "Unauthorized"})
+	}
+	request := DeviceConfigRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": "Could not decode request"})
+	}
+	config := deviceconfig.Config{IntervalSeconds: request.IntervalSeconds, Sensors: request.Sensors}
+	state, err := setDeviceConfig(request.DeviceID, config)
+	if err != nil {
+		return c.JSON(http.StatusOK, generic{"err": err.Error()})
+	}
+	return c.JSON(http.StatusOK, generic{"err": nil, "config": state})
+}
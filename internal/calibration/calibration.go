@@ -0,0 +1,172 @@
+// Package calibration corrects sensor readings with a pipeline of
+// transformation steps, e.g. an offset for a sensor that reads 1.5 °C high.
+package calibration
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// StepType is the kind of transformation a step performs.
+type StepType string
+
+// Step types
+const (
+	// Offset adds Value.
+	Offset StepType = "offset"
+	// Scale multiplies by Value.
+	Scale StepType = "scale"
+	// Polynomial evaluates the polynomial with the Coefficients, lowest
+	// degree first, e.g. [c0, c1, c2] computes c0 + c1*x + c2*x².
+	Polynomial StepType = "polynomial"
+	// Lookup interpolates linearly between the points of Table. Values
+	// outside of the table are extrapolated from the nearest two points.
+	Lookup StepType = "lookup"
+	// Clamp limits the value to Min and Max, each of which is optional.
+	Clamp StepType = "clamp"
+)
+
+// MaxSteps is the maximum length of a pipeline.
+const MaxSteps = 20
+
+// MaxTableSize is the maximum number of points of a lookup table and
+// coefficients of a polynomial.
+const MaxTableSize = 256
+
+// TablePoint maps a value In to a value Out.
+type TablePoint struct {
+	In  float64 `json:"in"`
+	Out float64 `json:"out"`
+}
+
+// Step is a single transformation.
+type Step struct {
+	Type         StepType     `json:"type"`
+	Value        float64      `json:"value,omitempty"`
+	Coefficients []float64    `json:"coefficients,omitempty"`
+	Table        []TablePoint `json:"table,omitempty"`
+	Min          *float64     `json:"min,omitempty"`
+	Max          *float64     `json:"max,omitempty"`
+}
+
+func finite(values ...float64) bool {
+	for _, value := range values {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Step) validate() error {
+	switch s.Type {
+	case Offset, Scale:
+		if !finite(s.Value) {
+			return errors.New("invalid value")
+		}
+	case Polynomial:
+		if len(s.Coefficients) == 0 || len(s.Coefficients) > MaxTableSize {
+			return fmt.Errorf("polynomial requires between 1 and %d coefficients", MaxTableSize)
+		}
+		if !finite(s.Coefficients...) {
+			return errors.New("invalid coefficient")
+		}
+	case Lookup:
+		if len(s.Table) < 2 || len(s.Table) > MaxTableSize {
+			return fmt.Errorf("lookup table requires between 2 and %d points", MaxTableSize)
+		}
+		for i, point := range s.Table {
+			if !finite(point.In, point.Out) {
+				return fmt.Errorf("invalid table point %d", i+1)
+			}
+			if i > 0 && point.In <= s.Table[i-1].In {
+				return errors.New("lookup table must be sorted by strictly increasing input")
+			}
+		}
+	case Clamp:
+		if s.Min == nil && s.Max == nil {
+			return errors.New("clamp requires min or max")
+		}
+		if (s.Min != nil && !finite(*s.Min)) || (s.Max != nil && !finite(*s.Max)) {
+			return errors.New("invalid limit")
+		}
+		if s.Min != nil && s.Max != nil && *s.Min > *s.Max {
+			return errors.New("min is greater than max")
+		}
+	default:
+		return fmt.Errorf("unknown step type '%s'", s.Type)
+	}
+	return nil
+}
+
+func (s Step) apply(value float64) float64 {
+	switch s.Type {
+	case Offset:
+		return value + s.Value
+	case Scale:
+		return value * s.Value
+	case Polynomial:
+		// Horner's method
+		result := 0.0
+		for i := len(s.Coefficients) - 1; i >= 0; i-- {
+			result = result*value + s.Coefficients[i]
+		}
+		return result
+	case Lookup:
+		i := sort.Search(len(s.Table), func(i int) bool { return s.Table[i].In >= value })
+		if i == 0 {
+			i = 1
+		} else if i == len(s.Table) {
+			i = len(s.Table) - 1
+		}
+		a, b := s.Table[i-1], s.Table[i]
+		return a.Out + (value-a.In)*(b.Out-a.Out)/(b.In-a.In)
+	case Clamp:
+		if s.Min != nil && value < *s.Min {
+			value = *s.Min
+		}
+		if s.Max != nil && value > *s.Max {
+			value = *s.Max
+		}
+		return value
+	default:
+		return value
+	}
+}
+
+// Pipeline applies its steps in order. The empty pipeline leaves values
+// unchanged.
+type Pipeline []Step
+
+// Validate checks all steps.
+func (p Pipeline) Validate() error {
+	if len(p) > MaxSteps {
+		return fmt.Errorf("pipeline has more than %d steps", MaxSteps)
+	}
+	for i, step := range p {
+		if err := step.validate(); err != nil {
+			return fmt.Errorf("step %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Apply transforms a raw value.
+func (p Pipeline) Apply(value float64) float64 {
+	for _, step := range p {
+		value = step.apply(value)
+	}
+	return value
+}
+
+// Calibrate transforms a raw value like Apply and fails if the result is not
+// finite, e.g. when a polynomial overflows for an extreme reading.
+func (p Pipeline) Calibrate(value float64) (float64, error) {
+	result := p.Apply(value)
+	if !finite(result) {
+		return 0, fmt.Errorf("calibration of %v results in %v", value, result)
+	}
+	return result, nil
+}
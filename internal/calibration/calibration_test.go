@@ -0,0 +1,87 @@
+package calibration
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	max := 30.0
+	pipeline := Pipeline{
+		{Type: Offset, Value: -1.5},
+		{Type: Scale, Value: 2},
+		{Type: Clamp, Max: &max},
+	}
+	testCases := []struct{ in, out float64 }{
+		{11.5, 20},
+		{20, 30},
+		{-0.5, -4},
+	}
+	for _, testCase := range testCases {
+		if out := pipeline.Apply(testCase.in); out != testCase.out {
+			t.Fatalf("expected %v for %v, actual %v", testCase.out, testCase.in, out)
+		}
+	}
+}
+
+func TestCalibrateRejectsNonFinite(t *testing.T) {
+	pipeline := Pipeline{{Type: Polynomial, Coefficients: []float64{0, 0, 0, 1e300}}}
+
+	if _, err := pipeline.Calibrate(1e10); err == nil {
+		t.Fatal("Calibrate accepted an infinite result")
+	}
+	if value, err := pipeline.Calibrate(1); err != nil || value != 1e300 {
+		t.Fatalf("expected 1e300, actual %v (err: %v)", value, err)
+	}
+}
+
+func TestPolynomial(t *testing.T) {
+	step := Step{Type: Polynomial, Coefficients: []float64{1, 2, 3}}
+
+	if out := step.apply(2); out != 17 {
+		t.Fatalf("expected 17, actual %v", out)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	step := Step{Type: Lookup, Table: []TablePoint{{0, 0}, {10, 100}, {20, 150}}}
+	testCases := []struct{ in, out float64 }{
+		{5, 50},
+		{10, 100},
+		{15, 125},
+		{-1, -10},
+		{30, 200},
+	}
+	for _, testCase := range testCases {
+		if out := step.apply(testCase.in); math.Abs(out-testCase.out) > 1e-9 {
+			t.Fatalf("expected %v for %v, actual %v", testCase.out, testCase.in, out)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	min, max := 10.0, 0.0
+	invalid := []Pipeline{
+		{{Type: "log"}},
+		{{Type: Offset, Value: math.Inf(1)}},
+		{{Type: Polynomial}},
+		{{Type: Lookup, Table: []TablePoint{{1, 0}, {1, 2}}}},
+		{{Type: Clamp}},
+		{{Type: Clamp, Min: &min, Max: &max}},
+	}
+	for _, pipeline := range invalid {
+		if err := pipeline.Validate(); err == nil {
+			t.Fatalf("Validate accepted %+v", pipeline)
+		}
+	}
+
+	var pipeline Pipeline
+	err := json.Unmarshal([]byte(`[{"type":"offset","value":-1.5},{"type":"lookup","table":[{"in":0,"out":1},{"in":1,"out":3}]}]`), &pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pipeline.Validate(); err != nil {
+		t.Fatalf("Validate rejected valid pipeline: %v", err)
+	}
+}
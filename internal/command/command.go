@@ -0,0 +1,88 @@
+// Package command defines the commands the server sends to devices as
+// commproto.MessageCommand and the acknowledgements devices send back as
+// commproto.MessageCommandAck. Both are encoded as JSON.
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Known commands
+const (
+	// SetRelay switches the relay Actuator on or off. The value is a boolean.
+	SetRelay = "set-relay"
+	// SetInterval changes the reporting interval. The value is the interval
+	// in seconds.
+	SetInterval = "set-interval"
+	// Reboot restarts the device. It has no value.
+	Reboot = "reboot"
+)
+
+// MaxInterval is the longest reporting interval that can be set.
+const MaxInterval = 24 * time.Hour
+
+// Command is sent to a device.
+type Command struct {
+	ID string `json:"id"`
+	// DeviceID is the child device a gateway should forward the command to.
+	// It is empty for commands to the receiving device itself.
+	DeviceID string          `json:"device_id,omitempty"`
+	Name     string          `json:"command"`
+	Actuator *byte           `json:"actuator,omitempty"`
+	Value    json.RawMessage `json:"value,omitempty"`
+}
+
+// Validate checks that the command is known and has a valid value.
+func (c Command) Validate() error {
+	if c.ID == "" {
+		return errors.New("missing command id")
+	}
+	switch c.Name {
+	case SetRelay:
+		if c.Actuator == nil {
+			return errors.New("missing actuator")
+		}
+		_, err := c.Relay()
+		return err
+	case SetInterval:
+		_, err := c.Interval()
+		return err
+	case Reboot:
+		if len(c.Value) != 0 {
+			return errors.New("reboot takes no value")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown command '%s'", c.Name)
+	}
+}
+
+// Relay returns the value of a SetRelay command.
+func (c Command) Relay() (on bool, err error) {
+	if err := json.Unmarshal(c.Value, &on); err != nil {
+		return false, errors.New("value must be a boolean")
+	}
+	return on, nil
+}
+
+// Interval returns the value of a SetInterval command.
+func (c Command) Interval() (time.Duration, error) {
+	var seconds int
+	if err := json.Unmarshal(c.Value, &seconds); err != nil {
+		return 0, errors.New("value must be an integer number of seconds")
+	}
+	if seconds <= 0 || int64(seconds) > int64(MaxInterval/time.Second) {
+		return 0, fmt.Errorf("interval must be between 1s and %v", MaxInterval)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// Ack is sent back by the device after executing a command.
+type Ack struct {
+	ID    string `json:"id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
@@ -0,0 +1,45 @@
+package command
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	relay := byte(1)
+	valid := []Command{
+		{ID: "1", Name: SetRelay, Actuator: &relay, Value: json.RawMessage("true")},
+		{ID: "2", Name: SetInterval, Value: json.RawMessage("30")},
+		{ID: "3", Name: Reboot},
+	}
+	for _, c := range valid {
+		if err := c.Validate(); err != nil {
+			t.Fatalf("Validate rejected %s: %v", c.Name, err)
+		}
+	}
+	invalid := []Command{
+		{Name: Reboot},
+		{ID: "1", Name: SetRelay, Value: json.RawMessage("true")},
+		{ID: "2", Name: SetRelay, Actuator: &relay, Value: json.RawMessage("1")},
+		{ID: "3", Name: SetInterval, Value: json.RawMessage("0")},
+		{ID: "4", Name: "self-destruct"},
+	}
+	for _, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Fatalf("Validate accepted %+v", c)
+		}
+	}
+}
+
+func TestInterval(t *testing.T) {
+	interval, err := Command{ID: "1", Name: SetInterval, Value: json.RawMessage("90")}.Interval()
+
+	if err != nil || interval != 90*time.Second {
+		t.Fatalf("expected 1m30s, actual %v (err: %v)", interval, err)
+	}
+	// The nanoseconds of this interval overflow to 290ms.
+	if interval, err := (Command{ID: "2", Name: SetInterval, Value: json.RawMessage("18446744074")}).Interval(); err == nil {
+		t.Fatalf("overflowing interval was accepted as %v", interval)
+	}
+}
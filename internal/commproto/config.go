@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"strings"
 )
 
 type ClientConfiguration struct {
@@ -16,8 +18,18 @@ type ClientConfiguration struct {
 }
 
 type PartnerConfiguration struct {
-	Key        ConfigurationKey `json:"key"`
-	Passphrase string           `json:"passphrase"`
+	Key        ConfigurationKey `json:"key,omitempty"`
+	Passphrase string           `json:"passphrase,omitempty"`
+	// KeySecret and PassphraseSecret name secrets that are looked up with a
+	// SecretProvider instead of storing key and passphrase in the file itself.
+	KeySecret        string `json:"key-secret,omitempty"`
+	PassphraseSecret string `json:"passphrase-secret,omitempty"`
+}
+
+// SecretProvider looks up secrets by name. It is implemented by the providers
+// of the secrets package.
+type SecretProvider interface {
+	Secret(name string) ([]byte, error)
 }
 
 type ConfigurationKey []byte
@@ -66,21 +78,85 @@ func (config *ClientConfiguration) Validate() error {
 	}
 
 	for name, partner := range config.Partners {
-		if len(partner.Key) == 0 {
-			return fmt.Errorf("missing 'key' for partner '%s'", name)
+		if err := validatePartner(name, partner); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validatePartner(name string, partner PartnerConfiguration) error {
+	if !ValidAddress(name) {
+		return fmt.Errorf("invalid partner address '%s'", name)
+	}
+	if len(partner.Key) == 0 {
+		return fmt.Errorf("missing 'key' for partner '%s'", name)
+	}
+	if len(partner.Key) != KeySize {
+		return fmt.Errorf("'key' for partner '%s' has wrong length (expected %d but was %d)", name, KeySize, len(partner.Key))
+	}
+	if partner.Passphrase == "" {
+		return fmt.Errorf("missing 'passphrase' for partner '%s'", name)
+	}
+	return nil
+}
+
+// GeneratePartnerConfiguration creates fresh random secrets for a partner.
+func GeneratePartnerConfiguration() (PartnerConfiguration, error) {
+	key, err := GenerateSecureRandomByteArray(KeySize)
+	if err != nil {
+		return PartnerConfiguration{}, err
+	}
+	passphrase, err := GenerateSecureRandomByteArray(24)
+	if err != nil {
+		return PartnerConfiguration{}, err
+	}
+	return PartnerConfiguration{Key: key, Passphrase: hex.EncodeToString(passphrase)}, nil
+}
+
+// ResolveSecrets replaces the key and passphrase of all partners that
+// reference a secret with the value obtained from the provider. Keys are
+// expected in hexadecimal notation.
+func (config *ClientConfiguration) ResolveSecrets(secrets SecretProvider) error {
+	for name, partner := range config.Partners {
+		if partner.KeySecret == "" && partner.PassphraseSecret == "" {
+			continue
 		}
-		if len(partner.Key) != KeySize {
-			return fmt.Errorf("'key' for partner '%s' has wrong length (expected %d but was %d)", name, KeySize, len(partner.Key))
+		if secrets == nil {
+			return fmt.Errorf("partner '%s' references a secret, but no secret provider is configured", name)
 		}
-		if partner.Passphrase == "" {
-			return fmt.Errorf("missing 'passphrase' for partner '%s'", name)
+		if partner.KeySecret != "" {
+			value, err := secrets.Secret(partner.KeySecret)
+			if err != nil {
+				return fmt.Errorf("'key-secret' for partner '%s': %v", name, err)
+			}
+			key, err := hex.DecodeString(strings.TrimSpace(string(value)))
+			if err != nil {
+				return fmt.Errorf("'key-secret' for partner '%s': %v", name, err)
+			}
+			partner.Key = key
 		}
+		if partner.PassphraseSecret != "" {
+			value, err := secrets.Secret(partner.PassphraseSecret)
+			if err != nil {
+				return fmt.Errorf("'passphrase-secret' for partner '%s': %v", name, err)
+			}
+			partner.Passphrase = string(value)
+		}
+		config.Partners[name] = partner
 	}
-
 	return nil
 }
 
 func ParseConfiguration(filename string) (*ClientConfiguration, error) {
+	return ParseConfigurationWithSecrets(filename, nil)
+}
+
+// ParseConfigurationWithSecrets parses the configuration file and resolves
+// the secrets referenced by partners using the provider, which may be nil if
+// no secrets are referenced.
+func ParseConfigurationWithSecrets(filename string, secrets SecretProvider) (*ClientConfiguration, error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
@@ -91,9 +167,39 @@ func ParseConfiguration(filename string) (*ClientConfiguration, error) {
 		return nil, fmt.Errorf("config file '%s': %v", filename, err)
 	}
 
+	if err := config.ResolveSecrets(secrets); err != nil {
+		return nil, fmt.Errorf("config file '%s': %v", filename, err)
+	}
+
 	if err := config.Validate(); err != nil {
 		return nil, fmt.Errorf("config file '%s': %v", filename, err)
 	}
 
 	return &config, nil
 }
+
+// SaveConfiguration writes the configuration to the given file. The file is
+// replaced atomically, so a crash never leaves a truncated configuration.
+// Keys and passphrases that reference a secret are not written.
+func SaveConfiguration(filename string, config *ClientConfiguration) error {
+	stripped := *config
+	stripped.Partners = make(map[string]PartnerConfiguration, len(config.Partners))
+	for name, partner := range config.Partners {
+		if partner.KeySecret != "" {
+			partner.Key = nil
+		}
+		if partner.PassphraseSecret != "" {
+			partner.Passphrase = ""
+		}
+		stripped.Partners[name] = partner
+	}
+	data, err := json.MarshalIndent(&stripped, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -9,6 +9,8 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"errors"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
@@ -26,6 +28,24 @@ const (
 	macSize           = sha256.Size
 )
 
+// MaxAddressLength is the maximum length of an address in bytes.
+const MaxAddressLength = 255
+
+// ValidAddress tells whether an address can be used by the protocol. It must
+// be valid UTF-8 without control characters and at most MaxAddressLength bytes
+// long.
+func ValidAddress(address string) bool {
+	if address == "" || len(address) > MaxAddressLength || !utf8.ValidString(address) {
+		return false
+	}
+	for _, r := range address {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
 // ExtractAddress returns the address that is stored at the beginning of the message.
 func ExtractAddress(message []byte) (address string, ok bool) {
 	if len(message) == 0 {
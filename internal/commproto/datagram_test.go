@@ -3,6 +3,7 @@ package commproto
 import (
 	"bytes"
 	"encoding/hex"
+	"strings"
 	"testing"
 )
 
@@ -40,6 +41,19 @@ func TestExtractAddressValid(t *testing.T) {
 	}
 }
 
+func TestValidAddress(t *testing.T) {
+	for _, address := range []string{"master", "shredder-2.local", "küche"} {
+		if !ValidAddress(address) {
+			t.Fatalf("ValidAddress rejected '%s'", address)
+		}
+	}
+	for _, address := range []string{"", "line\nbreak", "\xff", strings.Repeat("a", 256)} {
+		if ValidAddress(address) {
+			t.Fatalf("ValidAddress accepted %q", address)
+		}
+	}
+}
+
 func TestAssembleDatagram(t *testing.T) {
 	address := "master"
 	iv := decodeHex("00110011001100110011001100110011")
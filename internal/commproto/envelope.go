@@ -0,0 +1,106 @@
+package commproto
+
+// This file handles the envelope that carries the type of a message inside
+// the encrypted data of a datagram.
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Well-known message types.
+const (
+	// MessageUntyped is the type of data that was sent without an envelope.
+	MessageUntyped = ""
+	// MessageSensorData carries sensor readings.
+	MessageSensorData = "sensor-data"
+	// MessagePing requests a MessagePong with the same body.
+	MessagePing = "ping"
+	MessagePong = "pong"
+	// MessageCommand carries a command for an actuator or the device itself.
+	MessageCommand = "command"
+	// MessageCommandAck acknowledges or rejects a MessageCommand.
+	MessageCommandAck = "command-ack"
+	// MessageConfig carries the desired configuration of a device.
+	MessageConfig = "config"
+	// MessageConfigAck acknowledges or rejects a MessageConfig.
+	MessageConfigAck = "config-ack"
+	// MessageStatus carries a status report of a device.
+	MessageStatus = "status"
+	// MessageError reports that a previous message was rejected.
+	MessageError = "error"
+	// MessageAlert carries an alert raised by the server.
+	MessageAlert = "alert"
+)
+
+// Well-known content types.
+const (
+	ContentTypeJSON = "application/json"
+	ContentTypeText = "text/plain"
+)
+
+// envelopeMarker starts every envelope. Untyped data like JSON or text never
+// starts with a zero byte, which keeps both formats distinguishable.
+const envelopeMarker = 0x00
+
+// Message is a received message with its envelope already removed.
+type Message struct {
+	Sender      string
+	Type        string
+	ContentType string
+	Body        []byte
+	// Timestamp is the timestamp of the datagram in nanoseconds.
+	Timestamp int64
+}
+
+// MessageHandler handles received messages of one type.
+type MessageHandler func(message Message)
+
+// EncodeEnvelope wraps the body in an envelope carrying the message type and
+// content type.
+func EncodeEnvelope(messageType, contentType string, body []byte) []byte {
+	if messageType == "" || len(messageType) > 255 {
+		panic("invalid message type")
+	}
+	if len(contentType) > 255 {
+		panic("content type too long")
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteByte(envelopeMarker)
+	buffer.WriteByte(byte(len(messageType)))
+	buffer.WriteString(messageType)
+	buffer.WriteByte(byte(len(contentType)))
+	buffer.WriteString(contentType)
+	buffer.Write(body)
+	return buffer.Bytes()
+}
+
+// DecodeEnvelope extracts message type, content type and body from the data.
+// Data without an envelope is returned as body of type MessageUntyped with an
+// empty content type.
+func DecodeEnvelope(data []byte) (messageType, contentType string, body []byte, err error) {
+	if len(data) == 0 || data[0] != envelopeMarker {
+		return MessageUntyped, "", data, nil
+	}
+
+	rest := data[1:]
+	messageType, rest, ok := readShortString(rest)
+	if !ok || messageType == "" {
+		return "", "", nil, errors.New("invalid envelope")
+	}
+	contentType, rest, ok = readShortString(rest)
+	if !ok {
+		return "", "", nil, errors.New("invalid envelope")
+	}
+	return messageType, contentType, rest, nil
+}
+
+// readShortString reads a string prefixed by its length in one byte.
+func readShortString(data []byte) (s string, rest []byte, ok bool) {
+	if len(data) == 0 || len(data) < 1+int(data[0]) {
+		return "", nil, false
+	}
+	length := int(data[0])
+	return string(data[1 : 1+length]), data[1+length:], true
+}
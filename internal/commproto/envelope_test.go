@@ -0,0 +1,39 @@
+package commproto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	body := []byte(`{"value":21.5}`)
+
+	messageType, contentType, decoded, err := DecodeEnvelope(EncodeEnvelope(MessageSensorData, ContentTypeJSON, body))
+
+	if err != nil {
+		t.Fatalf("DecodeEnvelope returned err for valid envelope: %v", err)
+	}
+	if messageType != MessageSensorData || contentType != ContentTypeJSON || !bytes.Equal(decoded, body) {
+		t.Fatalf("DecodeEnvelope: unexpected result ('%s', '%s', '%s')", messageType, contentType, decoded)
+	}
+}
+
+func TestDecodeEnvelopeUntyped(t *testing.T) {
+	body := []byte(`{"value":21.5}`)
+
+	messageType, _, decoded, err := DecodeEnvelope(body)
+
+	if err != nil || messageType != MessageUntyped || !bytes.Equal(decoded, body) {
+		t.Fatalf("DecodeEnvelope did not pass through untyped data ('%s', '%s', %v)", messageType, decoded, err)
+	}
+}
+
+func TestDecodeEnvelopeTruncated(t *testing.T) {
+	data := EncodeEnvelope(MessageSensorData, ContentTypeJSON, nil)
+
+	_, _, _, err := DecodeEnvelope(data[:len(data)-1])
+
+	if err == nil {
+		t.Fatal("DecodeEnvelope failed to report truncated envelope")
+	}
+}
@@ -35,8 +35,10 @@ type PubSubClient interface {
 type PubSubCallback func(channel string, data []byte)
 
 type Client struct {
-	config ClientConfiguration
-	ps     PubSubClient
+	// configMutex protects config.Partners, which can change at runtime.
+	configMutex sync.RWMutex
+	config      ClientConfiguration
+	ps          PubSubClient
 
 	lastSentTimestampMutex sync.Mutex
 	lastSentTimestamps     map[string]int64
@@ -46,9 +48,15 @@ type Client struct {
 
 	timeClient *timeClient
 
-	callbacks []DatagramCallback
+	revocations *RevocationList
+
+	callbacks         []DatagramCallback
+	handlers          map[string][]MessageHandler
+	securityCallbacks []SecurityEventCallback
 }
 
+// DatagramCallback receives the raw data of every datagram, including the
+// envelope of typed messages.
 type DatagramCallback func(sender string, data []byte)
 
 func NewClient(config *ClientConfiguration, ps PubSubClient) *Client {
@@ -57,6 +65,13 @@ func NewClient(config *ClientConfiguration, ps PubSubClient) *Client {
 		ps:                     ps,
 		lastSentTimestamps:     make(map[string]int64),
 		lastReceivedTimestamps: make(map[string]int64),
+		handlers:               make(map[string][]MessageHandler),
+	}
+	// Copy the partners so that AddPartner and RemovePartner do not modify the
+	// configuration owned by the caller.
+	client.config.Partners = make(map[string]PartnerConfiguration, len(config.Partners))
+	for address, partner := range config.Partners {
+		client.config.Partners[address] = partner
 	}
 	if serverAddress := config.UseTimeServer; serverAddress != "" {
 		serverConfig, ok := config.Partners[serverAddress]
@@ -80,6 +95,92 @@ func (client *Client) RegisterCallback(callback DatagramCallback) {
 	client.callbacks = append(client.callbacks, callback)
 }
 
+// RegisterHandler registers a handler for messages of the given type. Data
+// sent without an envelope is dispatched to the handlers of MessageUntyped.
+// It must be called before Start.
+func (client *Client) RegisterHandler(messageType string, handler MessageHandler) {
+	if handler == nil {
+		panic("nil handler")
+	}
+	client.handlers[messageType] = append(client.handlers[messageType], handler)
+}
+
+// Configuration returns a copy of the current configuration of the client,
+// including all partners that were added or removed at runtime.
+func (client *Client) Configuration() *ClientConfiguration {
+	client.configMutex.RLock()
+	defer client.configMutex.RUnlock()
+	config := client.config
+	config.Partners = make(map[string]PartnerConfiguration, len(client.config.Partners))
+	for address, partner := range client.config.Partners {
+		config.Partners[address] = partner
+	}
+	return &config
+}
+
+// AddPartner adds a new communication partner at runtime. It is an error to
+// add a partner whose address is already known.
+func (client *Client) AddPartner(address string, partner PartnerConfiguration) error {
+	if err := validatePartner(address, partner); err != nil {
+		return err
+	}
+	client.configMutex.Lock()
+	defer client.configMutex.Unlock()
+	if _, ok := client.config.Partners[address]; ok {
+		return fmt.Errorf("partner '%s' already exists", address)
+	}
+	client.config.Partners[address] = partner
+	return nil
+}
+
+// RemovePartner removes a communication partner at runtime. The time server
+// partner cannot be removed.
+func (client *Client) RemovePartner(address string) error {
+	client.configMutex.Lock()
+	defer client.configMutex.Unlock()
+	if _, ok := client.config.Partners[address]; !ok {
+		return fmt.Errorf("unknown partner: %s", address)
+	}
+	if address == client.config.UseTimeServer {
+		return fmt.Errorf("cannot remove time server partner '%s'", address)
+	}
+	delete(client.config.Partners, address)
+	return nil
+}
+
+// HostAddress returns the address of this host.
+func (client *Client) HostAddress() string {
+	return client.config.HostAddress
+}
+
+// SetRevocationList sets the list of revoked partners. Datagrams and time
+// requests from revoked partners are rejected and no datagrams are sent to
+// them. It must be called before Start.
+func (client *Client) SetRevocationList(list *RevocationList) {
+	client.revocations = list
+}
+
+// isRevoked checks the revocation list and reports a security event if the
+// partner is revoked.
+func (client *Client) isRevoked(partner, channel string) bool {
+	if client.revocations == nil {
+		return false
+	}
+	revocation, revoked := client.revocations.IsRevoked(partner)
+	if revoked {
+		detail := fmt.Sprintf("revoked at %s: %s", revocation.RevokedAt.Format(time.RFC3339), revocation.Reason)
+		client.reportSecurityEvent(EventRevokedPartner, partner, channel, detail)
+	}
+	return revoked
+}
+
+func (client *Client) partner(address string) (partner PartnerConfiguration, ok bool) {
+	client.configMutex.RLock()
+	partner, ok = client.config.Partners[address]
+	client.configMutex.RUnlock()
+	return
+}
+
 func (client *Client) Start() {
 	if client.config.HostTimeServer {
 		log.Debug("Starting time server")
@@ -96,19 +197,23 @@ func (client *Client) onTimeRequest(channel string, request []byte) {
 
 	partner, ok := ExtractAddress(request)
 	if !ok {
-		log.Warn("Time server received invalid message")
+		client.reportSecurityEvent(EventMalformedMessage, "", channel, "time request")
+		return
+	}
+
+	if client.isRevoked(partner, channel) {
 		return
 	}
 
-	partnerConfig, ok := client.config.Partners[partner]
+	partnerConfig, ok := client.partner(partner)
 	if !ok {
-		log.WithFields(log.Fields{"sender": partner}).Info("Ignoring time request from unknown sender")
+		client.reportSecurityEvent(EventUnknownSender, partner, channel, "time request")
 		return
 	}
 
 	nonce, err := DisassembleTimeRequest(request, partner, partnerConfig.Passphrase)
 	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Warn("Received invalid time request")
+		client.reportSecurityEvent(EventInvalidMessage, partner, channel, "time request: "+err.Error())
 		return
 	}
 
@@ -118,22 +223,26 @@ func (client *Client) onTimeRequest(channel string, request []byte) {
 	log.WithFields(log.Fields{"receiver": partner, "timestamp": timestamp}).Debug("Time server sent time")
 }
 
-func (client *Client) onDatagram(_ string, datagram []byte) {
+func (client *Client) onDatagram(channel string, datagram []byte) {
 	sender, ok := ExtractAddress(datagram)
 	if !ok {
-		log.Warn("Received invalid datagram")
+		client.reportSecurityEvent(EventMalformedMessage, "", channel, "datagram")
+		return
+	}
+
+	if client.isRevoked(sender, channel) {
 		return
 	}
 
-	senderConfig, ok := client.config.Partners[sender]
+	senderConfig, ok := client.partner(sender)
 	if !ok {
-		log.WithFields(log.Fields{"sender": sender}).Info("Ignoring datagram from unknown sender")
+		client.reportSecurityEvent(EventUnknownSender, sender, channel, "datagram")
 		return
 	}
 
 	timestamp, data, err := DisassembleDatagram(datagram, sender, senderConfig.Key, senderConfig.Passphrase)
 	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Warn("Received invalid datagram")
+		client.reportSecurityEvent(EventInvalidMessage, sender, channel, "datagram: "+err.Error())
 		return
 	}
 
@@ -144,7 +253,7 @@ func (client *Client) onDatagram(_ string, datagram []byte) {
 	}
 
 	if delta := timestamp - current; delta < -1000000000 /* ns */ || delta > 1000000000 /* ns */ { // @Hardcoded
-		log.WithFields(log.Fields{"delta": delta}).Warn("Received datagram with invalid timestamp")
+		client.reportSecurityEvent(EventStaleTimestamp, sender, channel, fmt.Sprintf("delta %v", time.Duration(delta)))
 		return
 	}
 
@@ -160,7 +269,7 @@ func (client *Client) onDatagram(_ string, datagram []byte) {
 	}
 
 	if !timestampOk {
-		log.Warn("Received datagram with invalid timestamp")
+		client.reportSecurityEvent(EventReplay, sender, channel, "timestamp not newer than previous datagram")
 		return
 	}
 
@@ -168,6 +277,32 @@ func (client *Client) onDatagram(_ string, datagram []byte) {
 	for _, callback := range client.callbacks {
 		callback(sender, data)
 	}
+
+	messageType, contentType, body, err := DecodeEnvelope(data)
+	if err != nil {
+		log.WithFields(log.Fields{"sender": sender, "err": err}).Warn("Received datagram with invalid envelope")
+		return
+	}
+	handlers := client.handlers[messageType]
+	if len(handlers) == 0 {
+		log.WithFields(log.Fields{"sender": sender, "type": messageType}).Debug("No handler for message type")
+		return
+	}
+	message := Message{
+		Sender:      sender,
+		Type:        messageType,
+		ContentType: contentType,
+		Body:        body,
+		Timestamp:   timestamp,
+	}
+	for _, handler := range handlers {
+		handler(message)
+	}
+}
+
+// SendMessage sends a typed message to the receiver.
+func (client *Client) SendMessage(receiver, messageType, contentType string, body []byte) error {
+	return client.Send(receiver, EncodeEnvelope(messageType, contentType, body))
 }
 
 func (client *Client) SendString(receiver string, data string) error {
@@ -175,11 +310,17 @@ func (client *Client) SendString(receiver string, data string) error {
 }
 
 func (client *Client) Send(receiver string, data []byte) error {
-	receiverConfig, ok := client.config.Partners[receiver]
+	receiverConfig, ok := client.partner(receiver)
 	if !ok {
 		return fmt.Errorf("unknown receiver: %s", receiver)
 	}
 
+	if client.revocations != nil {
+		if _, revoked := client.revocations.IsRevoked(receiver); revoked {
+			return fmt.Errorf("receiver is revoked: %s", receiver)
+		}
+	}
+
 	timestamp, err := client.getTime()
 	if err != nil {
 		return fmt.Errorf("failed to get time: %v", err)
@@ -0,0 +1,145 @@
+package commproto
+
+// This file manages revoked partners.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Revocation records why and when a partner was revoked.
+type Revocation struct {
+	Address   string    `json:"address"`
+	Reason    string    `json:"reason"`
+	RevokedAt time.Time `json:"revoked-at"`
+}
+
+// RevocationList is a concurrency-safe list of revoked partners. Datagrams and
+// time requests from revoked partners are rejected by the Client. If the list
+// was loaded from a file, every change is written back to that file.
+type RevocationList struct {
+	mutex       sync.RWMutex
+	revocations map[string]Revocation
+	filename    string
+}
+
+// NewRevocationList creates an empty revocation list that is not backed by a
+// file.
+func NewRevocationList() *RevocationList {
+	return &RevocationList{revocations: make(map[string]Revocation)}
+}
+
+// LoadRevocationList loads the revocation list from the given file. A missing
+// file results in an empty list, which will be created on the first change.
+func LoadRevocationList(filename string) (*RevocationList, error) {
+	list := NewRevocationList()
+	list.filename = filename
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return list, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var revocations []Revocation
+	if err := json.Unmarshal(data, &revocations); err != nil {
+		return nil, fmt.Errorf("revocation file '%s': %v", filename, err)
+	}
+	for _, revocation := range revocations {
+		list.revocations[revocation.Address] = revocation
+	}
+	return list, nil
+}
+
+// Revoke adds the partner to the list. Revoking an already revoked partner
+// updates the reason and timestamp. The list is left unchanged if it cannot be
+// saved.
+func (list *RevocationList) Revoke(address, reason string) (Revocation, error) {
+	if address == "" {
+		return Revocation{}, errors.New("missing address")
+	}
+	revocation := Revocation{Address: address, Reason: reason, RevokedAt: time.Now()}
+
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	previous, revoked := list.revocations[address]
+	list.revocations[address] = revocation
+	if err := list.save(); err != nil {
+		if revoked {
+			list.revocations[address] = previous
+		} else {
+			delete(list.revocations, address)
+		}
+		return Revocation{}, err
+	}
+	return revocation, nil
+}
+
+// Restore removes the partner from the list. The partner stays revoked if the
+// list cannot be saved.
+func (list *RevocationList) Restore(address string) error {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	revocation, ok := list.revocations[address]
+	if !ok {
+		return fmt.Errorf("partner '%s' is not revoked", address)
+	}
+	delete(list.revocations, address)
+	if err := list.save(); err != nil {
+		list.revocations[address] = revocation
+		return err
+	}
+	return nil
+}
+
+// IsRevoked reports whether the partner is revoked.
+func (list *RevocationList) IsRevoked(address string) (revocation Revocation, revoked bool) {
+	list.mutex.RLock()
+	revocation, revoked = list.revocations[address]
+	list.mutex.RUnlock()
+	return
+}
+
+// Revocations returns all revocations ordered by time.
+func (list *RevocationList) Revocations() []Revocation {
+	list.mutex.RLock()
+	defer list.mutex.RUnlock()
+	return list.sorted()
+}
+
+// sorted returns all revocations ordered by time. The caller must hold the
+// mutex.
+func (list *RevocationList) sorted() []Revocation {
+	result := make([]Revocation, 0, len(list.revocations))
+	for _, revocation := range list.revocations {
+		result = append(result, revocation)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].RevokedAt.Before(result[j].RevokedAt)
+	})
+	return result
+}
+
+// save writes the list to its file, if any. The caller must hold the mutex.
+func (list *RevocationList) save() error {
+	if list.filename == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(list.sorted(), "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := list.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, list.filename)
+}
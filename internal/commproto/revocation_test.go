@@ -0,0 +1,108 @@
+package commproto
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type nopPubSub struct{}
+
+func (nopPubSub) Disconnect()                                       {}
+func (nopPubSub) Subscribe(channel string, callback PubSubCallback) {}
+func (nopPubSub) Unsubscribe(channel string)                        {}
+func (nopPubSub) Publish(channel string, data []byte)               {}
+
+func TestRevocationListPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "commproto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "revocations.json")
+
+	list, err := LoadRevocationList(filename)
+	if err != nil {
+		t.Fatalf("LoadRevocationList returned err for missing file: %v", err)
+	}
+	if _, err := list.Revoke("shredder", "stolen"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := list.Revoke("kalliope", "decommissioned"); err != nil {
+		t.Fatal(err)
+	}
+	if err := list.Restore("kalliope"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadRevocationList(filename)
+
+	if err != nil {
+		t.Fatalf("LoadRevocationList returned err: %v", err)
+	}
+	revocation, revoked := loaded.IsRevoked("shredder")
+	if !revoked || revocation.Reason != "stolen" {
+		t.Fatalf("expected 'shredder' to be revoked as stolen, but was %+v", revocation)
+	}
+	if _, revoked := loaded.IsRevoked("kalliope"); revoked {
+		t.Fatal("restored partner 'kalliope' is still revoked")
+	}
+}
+
+func TestRevocationListUnchangedOnSaveFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "commproto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	list, _ := LoadRevocationList(filepath.Join(dir, "missing", "revocations.json"))
+
+	if _, err := list.Revoke("shredder", "stolen"); err == nil {
+		t.Fatal("Revoke did not fail for missing directory")
+	}
+	if _, revoked := list.IsRevoked("shredder"); revoked {
+		t.Fatal("partner is revoked although the list was not saved")
+	}
+
+	list.filename = ""
+	list.Revoke("shredder", "stolen")
+	list.filename = filepath.Join(dir, "missing", "revocations.json")
+	if err := list.Restore("shredder"); err == nil {
+		t.Fatal("Restore did not fail for missing directory")
+	}
+	if _, revoked := list.IsRevoked("shredder"); !revoked {
+		t.Fatal("partner is restored although the list was not saved")
+	}
+}
+
+func TestClientRejectsRevokedSender(t *testing.T) {
+	key := decodeHex("00112233445566778899aabbccddeeff")
+	config := &ClientConfiguration{
+		HostAddress: "master",
+		Partners: map[string]PartnerConfiguration{
+			"good": {Key: key, Passphrase: "good"},
+			"evil": {Key: key, Passphrase: "evil"},
+		},
+	}
+	client := NewClient(config, nopPubSub{})
+	client.SetRevocationList(NewRevocationList())
+	client.revocations.Revoke("evil", "stolen")
+	var senders []string
+	client.RegisterCallback(func(sender string, data []byte) {
+		senders = append(senders, sender)
+	})
+	iv := make([]byte, IVSize)
+	timestamp := time.Now().UnixNano()
+
+	client.onDatagram("master/inbox", AssembleDatagram("evil", iv, timestamp, []byte("data"), key, "evil"))
+	client.onDatagram("master/inbox", AssembleDatagram("good", iv, timestamp, []byte("data"), key, "good"))
+
+	if len(senders) != 1 || senders[0] != "good" {
+		t.Fatalf("expected only 'good' to be accepted, but was %v", senders)
+	}
+	if err := client.Send("evil", []byte("data")); err == nil {
+		t.Fatal("Send did not refuse revoked receiver")
+	}
+}
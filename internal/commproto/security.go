@@ -0,0 +1,71 @@
+package commproto
+
+// This file defines the security events reported when messages are rejected.
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SecurityEventType classifies the reason a message was rejected.
+type SecurityEventType string
+
+const (
+	// The message is too short to contain an address.
+	EventMalformedMessage SecurityEventType = "malformed-message"
+	// The sender is not a configured partner.
+	EventUnknownSender SecurityEventType = "unknown-sender"
+	// The sender is on the revocation list.
+	EventRevokedPartner SecurityEventType = "revoked-partner"
+	// The MAC, padding or length of the message is invalid.
+	EventInvalidMessage SecurityEventType = "invalid-message"
+	// The timestamp of the datagram is too far from the current time.
+	EventStaleTimestamp SecurityEventType = "stale-timestamp"
+	// The timestamp of the datagram is not newer than the previous one.
+	EventReplay SecurityEventType = "replay"
+)
+
+// SecurityEvent describes a rejected message.
+type SecurityEvent struct {
+	Type    SecurityEventType `json:"type"`
+	Partner string            `json:"partner"`
+	Channel string            `json:"channel"`
+	Time    time.Time         `json:"time"`
+	Detail  string            `json:"detail,omitempty"`
+}
+
+// SecurityEventCallback is called for every rejected message. It is called
+// synchronously from the receiving goroutine and should return quickly.
+type SecurityEventCallback func(event SecurityEvent)
+
+// RegisterSecurityCallback registers a callback for security events. It must
+// be called before Start.
+func (client *Client) RegisterSecurityCallback(callback SecurityEventCallback) {
+	if callback == nil {
+		panic("nil callback")
+	}
+	client.securityCallbacks = append(client.securityCallbacks, callback)
+}
+
+// reportSecurityEvent logs the event and passes it to the registered
+// callbacks.
+func (client *Client) reportSecurityEvent(eventType SecurityEventType, partner, channel, detail string) {
+	event := SecurityEvent{
+		Type:    eventType,
+		Partner: partner,
+		Channel: channel,
+		Time:    time.Now(),
+		Detail:  detail,
+	}
+	log.WithFields(log.Fields{
+		"event":   "security",
+		"type":    event.Type,
+		"partner": event.Partner,
+		"channel": event.Channel,
+		"detail":  event.Detail,
+	}).Warn("Rejected message")
+	for _, callback := range client.securityCallbacks {
+		callback(event)
+	}
+}
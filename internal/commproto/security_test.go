@@ -0,0 +1,44 @@
+package commproto
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClientReportsSecurityEvents(t *testing.T) {
+	key := decodeHex("00112233445566778899aabbccddeeff")
+	config := &ClientConfiguration{
+		HostAddress: "master",
+		Partners: map[string]PartnerConfiguration{
+			"client": {Key: key, Passphrase: "passphrase"},
+		},
+	}
+	client := NewClient(config, nopPubSub{})
+	var events []SecurityEventType
+	client.RegisterSecurityCallback(func(event SecurityEvent) {
+		if event.Channel != "master/inbox" {
+			t.Errorf("expected channel 'master/inbox', actual '%s'", event.Channel)
+		}
+		events = append(events, event.Type)
+	})
+	iv := make([]byte, IVSize)
+	now := time.Now().UnixNano()
+	datagram := AssembleDatagram("client", iv, now, []byte("data"), key, "passphrase")
+
+	client.onDatagram("master/inbox", nil)
+	client.onDatagram("master/inbox", AssembleDatagram("stranger", iv, now, []byte("data"), key, "passphrase"))
+	client.onDatagram("master/inbox", AssembleDatagram("client", iv, now, []byte("data"), key, "wrong"))
+	client.onDatagram("master/inbox", AssembleDatagram("client", iv, now-int64(time.Minute), []byte("data"), key, "passphrase"))
+	client.onDatagram("master/inbox", append([]byte(nil), datagram...))
+	client.onDatagram("master/inbox", append([]byte(nil), datagram...))
+
+	expected := []SecurityEventType{EventMalformedMessage, EventUnknownSender, EventInvalidMessage, EventStaleTimestamp, EventReplay}
+	if len(events) != len(expected) {
+		t.Fatalf("expected events %v, actual %v", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("expected events %v, actual %v", expected, events)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Package deviceconfig defines the configuration the server pushes to devices
+// as commproto.MessageConfig and the acknowledgements devices send back as
+// commproto.MessageConfigAck. Both are encoded as JSON.
+package deviceconfig
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/command"
+)
+
+// Sensor configures a single sensor of a device.
+type Sensor struct {
+	Disabled bool `json:"disabled,omitempty"`
+	// Offset and Scale calibrate the raw value before it is reported as
+	// raw * Scale + Offset. A Scale of 0 is treated as 1.
+	Offset float64 `json:"offset,omitempty"`
+	Scale  float64 `json:"scale,omitempty"`
+}
+
+// Calibrate applies the calibration to a raw value.
+func (s Sensor) Calibrate(value float64) float64 {
+	if s.Scale != 0 {
+		value *= s.Scale
+	}
+	return value + s.Offset
+}
+
+// Config is the desired configuration of a device. Sensors that are not listed
+// are enabled and not calibrated.
+type Config struct {
+	// Version increases with every change, which lets the server tell
+	// whether a device applied the latest configuration.
+	Version uint64 `json:"version"`
+	// DeviceID is the child device a gateway should apply the configuration
+	// to. It is empty for the receiving device itself.
+	DeviceID string `json:"device_id,omitempty"`
+	// IntervalSeconds is the reporting interval. 0 keeps the default of the
+	// device.
+	IntervalSeconds int             `json:"interval_seconds,omitempty"`
+	Sensors         map[byte]Sensor `json:"sensors,omitempty"`
+}
+
+// Validate checks the interval and calibrations.
+func (c Config) Validate() error {
+	// The seconds are compared before they are converted, which could
+	// overflow.
+	if c.IntervalSeconds < 0 || int64(c.IntervalSeconds) > int64(command.MaxInterval/time.Second) {
+		return fmt.Errorf("interval must be 0 (default) or between 1s and %v", command.MaxInterval)
+	}
+	for id, sensor := range c.Sensors {
+		for _, value := range []float64{sensor.Offset, sensor.Scale} {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return fmt.Errorf("sensor %d: invalid calibration", id)
+			}
+		}
+	}
+	if c.Version == 0 {
+		return errors.New("missing version")
+	}
+	return nil
+}
+
+// Interval returns the reporting interval, or 0 if the device should keep its
+// default.
+func (c Config) Interval() time.Duration {
+	return time.Duration(c.IntervalSeconds) * time.Second
+}
+
+// Enabled tells whether a sensor should report.
+func (c Config) Enabled(sensorID byte) bool {
+	return !c.Sensors[sensorID].Disabled
+}
+
+// Calibrate applies the calibration of a sensor to a raw value.
+func (c Config) Calibrate(sensorID byte, value float64) float64 {
+	return c.Sensors[sensorID].Calibrate(value)
+}
+
+// Ack is sent back by the device after applying a configuration.
+type Ack struct {
+	Version  uint64 `json:"version"`
+	DeviceID string `json:"device_id,omitempty"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+}
@@ -0,0 +1,55 @@
+package deviceconfig
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := Config{Version: 1, IntervalSeconds: 30, Sensors: map[byte]Sensor{1: {Offset: -0.5, Scale: 1.02}}}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Validate rejected valid config: %v", err)
+	}
+	invalid := []Config{
+		{IntervalSeconds: 30},
+		{Version: 1, IntervalSeconds: -1},
+		{Version: 1, IntervalSeconds: 2 * 24 * 60 * 60},
+		{Version: 1, IntervalSeconds: 9300000000},
+		{Version: 1, Sensors: map[byte]Sensor{1: {Offset: math.NaN()}}},
+	}
+	for _, config := range invalid {
+		if err := config.Validate(); err == nil {
+			t.Fatalf("Validate accepted %+v", config)
+		}
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	config := Config{Version: 1, Sensors: map[byte]Sensor{1: {Offset: 1, Scale: 2}, 2: {Offset: -0.5}, 3: {Disabled: true}}}
+
+	if value := config.Calibrate(1, 10); value != 21 {
+		t.Fatalf("expected 21, actual %v", value)
+	}
+	if value := config.Calibrate(2, 10); value != 9.5 {
+		t.Fatalf("expected 9.5, actual %v", value)
+	}
+	if value := config.Calibrate(4, 10); value != 10 {
+		t.Fatalf("unlisted sensor was calibrated to %v", value)
+	}
+	if config.Enabled(3) || !config.Enabled(4) {
+		t.Fatal("Enabled does not match the configuration")
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	data, err := json.Marshal(Config{Version: 3, DeviceID: "FFFF", Sensors: map[byte]Sensor{2: {Disabled: true}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"version":3,"device_id":"FFFF","sensors":{"2":{"disabled":true}}}`
+	if string(data) != expected {
+		t.Fatalf("expected %s, actual %s", expected, data)
+	}
+}
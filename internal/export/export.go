@@ -0,0 +1,270 @@
+// Package export streams stored points as CSV, JSON Lines or InfluxDB line
+// protocol. Points are queried and written in time chunks, so exports of long
+// time ranges need only the memory of one chunk.
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/storage"
+)
+
+// Format is the format of an export.
+type Format string
+
+// Formats
+const (
+	// CSV writes a header followed by one row per point.
+	CSV Format = "csv"
+	// JSONLines writes one JSON object per line.
+	JSONLines Format = "ndjson"
+	// LineProtocol writes InfluxDB line protocol with nanosecond timestamps,
+	// which can be imported into InfluxDB as is.
+	LineProtocol Format = "lineprotocol"
+)
+
+// Valid tells whether the format is known.
+func (f Format) Valid() bool {
+	switch f {
+	case CSV, JSONLines, LineProtocol:
+		return true
+	}
+	return false
+}
+
+// ContentType returns the MIME type of the format.
+func (f Format) ContentType() string {
+	switch f {
+	case CSV:
+		return "text/csv; charset=utf-8"
+	case JSONLines:
+		return "application/x-ndjson"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+// Extension returns the usual file name extension of the format.
+func (f Format) Extension() string {
+	switch f {
+	case CSV:
+		return ".csv"
+	case JSONLines:
+		return ".ndjson"
+	default:
+		return ".lp"
+	}
+}
+
+// Options select the columns of CSV and JSON Lines exports. Line protocol
+// always contains all tags and fields.
+type Options struct {
+	// Tags and Fields are exported in this order after the time. Values a
+	// point does not have are empty in CSV and null in JSON Lines.
+	Tags   []string
+	Fields []string
+	// Location is the time zone of the times, UTC if it is nil.
+	Location *time.Location
+}
+
+// flusher is implemented by writers that buffer data, e.g. HTTP responses.
+type flusher interface {
+	Flush()
+}
+
+// Writer writes points in one format.
+type Writer struct {
+	format  Format
+	options Options
+	out     io.Writer
+	buffer  *bufio.Writer
+	csv     *csv.Writer
+	header  bool
+}
+
+// NewWriter creates a writer of the format. Written points are buffered until
+// Flush is called.
+func NewWriter(w io.Writer, format Format, options Options) (*Writer, error) {
+	if !format.Valid() {
+		return nil, fmt.Errorf("unknown export format '%s'", format)
+	}
+	if options.Location == nil {
+		options.Location = time.UTC
+	}
+	writer := &Writer{format: format, options: options, out: w, buffer: bufio.NewWriter(w)}
+	if format == CSV {
+		writer.csv = csv.NewWriter(writer.buffer)
+	}
+	return writer, nil
+}
+
+// formatValue formats a tag or field value for CSV.
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Write writes the points.
+func (w *Writer) Write(points []storage.Point) error {
+	switch w.format {
+	case LineProtocol:
+		data, err := storage.EncodeLineProtocol(points)
+		if err != nil {
+			return err
+		}
+		_, err = w.buffer.Write(data)
+		return err
+	case CSV:
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+		for _, point := range points {
+			record := make([]string, 0, 1+len(w.options.Tags)+len(w.options.Fields))
+			record = append(record, point.Time.In(w.options.Location).Format(time.RFC3339Nano))
+			for _, tag := range w.options.Tags {
+				record = append(record, point.Tags[tag])
+			}
+			for _, field := range w.options.Fields {
+				record = append(record, formatValue(point.Fields[field]))
+			}
+			if err := w.csv.Write(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		for _, point := range points {
+			object := make(map[string]interface{}, 1+len(w.options.Tags)+len(w.options.Fields))
+			object["time"] = point.Time.In(w.options.Location).Format(time.RFC3339Nano)
+			for _, tag := range w.options.Tags {
+				if value, ok := point.Tags[tag]; ok {
+					object[tag] = value
+				} else {
+					object[tag] = nil
+				}
+			}
+			for _, field := range w.options.Fields {
+				object[field] = point.Fields[field]
+			}
+			data, err := json.Marshal(object)
+			if err != nil {
+				return err
+			}
+			data = append(data, '\n')
+			if _, err := w.buffer.Write(data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// writeHeader writes the CSV header once.
+func (w *Writer) writeHeader() error {
+	if w.header {
+		return nil
+	}
+	w.header = true
+	header := append([]string{"time"}, w.options.Tags...)
+	return w.csv.Write(append(header, w.options.Fields...))
+}
+
+// Flush writes the buffered points to the underlying writer and flushes it
+// if it buffers data itself. A CSV export without points consists of the
+// header.
+func (w *Writer) Flush() error {
+	if w.csv != nil {
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if err := w.buffer.Flush(); err != nil {
+		return err
+	}
+	if f, ok := w.out.(flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// Querier queries stored points, see storage.Storage.
+type Querier interface {
+	Query(q storage.Query) ([]storage.Point, error)
+}
+
+// Export queries the raw points of the queries in chunks of the time range
+// and writes each chunk ordered by time before querying the next one. The
+// queries must not aggregate. Export returns the number of points written.
+func Export(w *Writer, store Querier, queries []storage.Query, chunk time.Duration) (int, error) {
+	if chunk <= 0 {
+		return 0, fmt.Errorf("invalid chunk duration %v", chunk)
+	}
+	if len(queries) == 0 {
+		return 0, w.Flush()
+	}
+	from, to := queries[0].From, queries[0].To
+	for _, q := range queries {
+		if len(q.Aggregates) > 0 {
+			return 0, fmt.Errorf("cannot export aggregates of '%s'", q.Measurement)
+		}
+		if q.From.Before(from) {
+			from = q.From
+		}
+		if q.To.After(to) {
+			to = q.To
+		}
+	}
+
+	count := 0
+	for start := from; start.Before(to); start = start.Add(chunk) {
+		end := start.Add(chunk)
+		if end.After(to) {
+			end = to
+		}
+		var points []storage.Point
+		for _, q := range queries {
+			if !q.From.Before(end) || !q.To.After(start) {
+				continue
+			}
+			if q.From.Before(start) {
+				q.From = start
+			}
+			if q.To.After(end) {
+				q.To = end
+			}
+			result, err := store.Query(q)
+			if err != nil {
+				return count, err
+			}
+			points = append(points, result...)
+		}
+		sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+		if err := w.Write(points); err != nil {
+			return count, err
+		}
+		if err := w.Flush(); err != nil {
+			return count, err
+		}
+		count += len(points)
+	}
+	return count, nil
+}
@@ -0,0 +1,101 @@
+package export
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/storage"
+)
+
+// fakeStore returns the points in the time range of a query and records the
+// queries.
+type fakeStore struct {
+	points  []storage.Point
+	queries []storage.Query
+}
+
+func (s *fakeStore) Query(q storage.Query) ([]storage.Point, error) {
+	s.queries = append(s.queries, q)
+	var result []storage.Point
+	for _, point := range s.points {
+		if point.Tags["device"] == q.Match["device"] && !point.Time.Before(q.From) && point.Time.Before(q.To) {
+			result = append(result, point)
+		}
+	}
+	return result, nil
+}
+
+func reading(device string, at int64, value float64) storage.Point {
+	return storage.Point{
+		Measurement: "datapoint",
+		Tags:        storage.Tags{"device": device, "sensor": "1"},
+		Fields:      storage.Fields{"value": value},
+		Time:        time.Unix(at, 0),
+	}
+}
+
+var testOptions = Options{Tags: []string{"device", "sensor", "unit"}, Fields: []string{"value"}}
+
+func TestFormats(t *testing.T) {
+	points := []storage.Point{reading("kitchen", 0, 21.5), reading("cellar, north", 60, -3)}
+	tests := []struct {
+		format   Format
+		expected string
+	}{
+		{CSV, "time,device,sensor,unit,value\n1970-01-01T00:00:00Z,kitchen,1,,21.5\n1970-01-01T00:01:00Z,\"cellar, north\",1,,-3\n"},
+		{JSONLines, `{"device":"kitchen","sensor":"1","time":"1970-01-01T00:00:00Z","unit":null,"value":21.5}` + "\n" +
+			`{"device":"cellar, north","sensor":"1","time":"1970-01-01T00:01:00Z","unit":null,"value":-3}` + "\n"},
+		{LineProtocol, "datapoint,device=kitchen,sensor=1 value=21.5 0\ndatapoint,device=cellar\\,\\ north,sensor=1 value=-3 60000000000\n"},
+	}
+	for _, test := range tests {
+		var buffer bytes.Buffer
+		w, err := NewWriter(&buffer, test.format, testOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Write(points); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if buffer.String() != test.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.format, test.expected, buffer.String())
+		}
+	}
+	if _, err := NewWriter(&bytes.Buffer{}, "xml", testOptions); err == nil {
+		t.Error("unknown format was accepted")
+	}
+}
+
+func TestExportInChunks(t *testing.T) {
+	store := &fakeStore{points: []storage.Point{
+		reading("a", 10, 1), reading("a", 100, 2), reading("a", 250, 3),
+		reading("b", 50, 4), reading("b", 150, 5),
+	}}
+	queries := []storage.Query{
+		{Measurement: "datapoint", Match: storage.Tags{"device": "a"}, From: time.Unix(0, 0), To: time.Unix(300, 0)},
+		{Measurement: "datapoint", Match: storage.Tags{"device": "b"}, From: time.Unix(100, 0), To: time.Unix(200, 0)},
+	}
+	var buffer bytes.Buffer
+	w, _ := NewWriter(&buffer, CSV, Options{Fields: []string{"value"}, Location: time.UTC})
+	count, err := Export(w, store, queries, 100*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "time,value\n1970-01-01T00:00:10Z,1\n1970-01-01T00:01:40Z,2\n1970-01-01T00:02:30Z,5\n1970-01-01T00:04:10Z,3\n"
+	if count != 4 || buffer.String() != expected {
+		t.Fatalf("unexpected export of %d points:\n%s", count, buffer.String())
+	}
+	// The second query only overlaps the second chunk.
+	if len(store.queries) != 4 {
+		t.Fatalf("expected 4 queries, got %d", len(store.queries))
+	}
+	for _, q := range store.queries {
+		if q.To.Sub(q.From) > 100*time.Second {
+			t.Errorf("query from %v to %v exceeds the chunk", q.From, q.To)
+		}
+	}
+}
@@ -0,0 +1,542 @@
+// Package ingest decouples receiving data points from writing them to the
+// storage. Points are queued in memory and written in batches by a background
+// goroutine. Failed writes are retried with exponential backoff; while the
+// storage is unavailable, points beyond the memory limit are spilled to a file
+// of limited size and written once the storage is back.
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// Writer is the storage the queue writes to.
+type Writer interface {
+	Write(points []storage.Point) error
+}
+
+// Options configure the queue. Zero values are replaced by the defaults.
+type Options struct {
+	// BatchSize is the maximum number of points written at once. A batch is
+	// written as soon as it is full.
+	BatchSize int
+	// FlushInterval is the maximum time points wait in the queue.
+	FlushInterval time.Duration
+	// MaxPending is the number of points kept in memory while the storage is
+	// unavailable. Older points are spilled or, without spill file, dropped.
+	MaxPending int
+	// SpillFile receives points beyond MaxPending. Empty disables spilling.
+	SpillFile string
+	// MaxSpilled is the number of points kept in the spill file. Further
+	// points are dropped.
+	MaxSpilled int
+	// MinBackoff and MaxBackoff limit the delay between retries.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Defaults for Options
+const (
+	DefaultBatchSize     = 500
+	DefaultFlushInterval = time.Second
+	DefaultMaxPending    = 10000
+	DefaultMaxSpilled    = 1000000
+	DefaultMinBackoff    = time.Second
+	DefaultMaxBackoff    = time.Minute
+)
+
+// Stats describe the state of the queue.
+type Stats struct {
+	// Pending is the number of points in memory.
+	Pending int `json:"pending"`
+	// Spilled is the number of points in the spill file.
+	Spilled int `json:"spilled"`
+	// Written, Dropped, Rejected and Failures count points written, points
+	// dropped, points the storage rejected and failed writes since start.
+	Written  uint64 `json:"written"`
+	Dropped  uint64 `json:"dropped"`
+	Rejected uint64 `json:"rejected"`
+	Failures uint64 `json:"failures"`
+	// Retrying is set while the storage is unavailable.
+	Retrying    bool      `json:"retrying"`
+	NextAttempt time.Time `json:"nextAttempt,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastWrite   time.Time `json:"lastWrite,omitempty"`
+}
+
+// ErrClosed is returned when points are added to a closed queue.
+var ErrClosed = errors.New("ingest queue is closed")
+
+// Queue buffers points and writes them in batches. It is safe for concurrent
+// use.
+type Queue struct {
+	writer  Writer
+	options Options
+
+	mutex   sync.Mutex
+	pending []storage.Point
+	stats   Stats
+	// failures is the number of consecutive failed writes.
+	failures int
+	closed   bool
+	// spillOffset is the offset of the first point in the spill file that
+	// was not written yet. Written points are only removed from the file
+	// when it is written completely or the queue is closed.
+	spillOffset int64
+
+	wake    chan struct{}
+	flushes chan chan error
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// New creates a queue and starts writing. Points left in the spill file by an
+// earlier run are written first.
+func New(writer Writer, options Options) (*Queue, error) {
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultBatchSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultFlushInterval
+	}
+	if options.MaxPending <= 0 {
+		options.MaxPending = DefaultMaxPending
+	}
+	if options.MaxSpilled <= 0 {
+		options.MaxSpilled = DefaultMaxSpilled
+	}
+	if options.MinBackoff <= 0 {
+		options.MinBackoff = DefaultMinBackoff
+	}
+	if options.MaxBackoff < options.MinBackoff {
+		options.MaxBackoff = DefaultMaxBackoff
+		if options.MaxBackoff < options.MinBackoff {
+			options.MaxBackoff = options.MinBackoff
+		}
+	}
+	q := &Queue{
+		writer:  writer,
+		options: options,
+		wake:    make(chan struct{}, 1),
+		flushes: make(chan chan error),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if options.SpillFile != "" {
+		if err := os.MkdirAll(filepath.Dir(options.SpillFile), 0755); err != nil {
+			return nil, err
+		}
+		spilled, err := countLines(options.SpillFile)
+		if err != nil {
+			return nil, err
+		}
+		q.stats.Spilled = spilled
+		if spilled > 0 {
+			log.WithFields(log.Fields{"file": options.SpillFile, "points": spilled}).Info("Found spilled points")
+		}
+	}
+	go q.run()
+	return q, nil
+}
+
+// Add queues points. It never blocks on the storage. Points that cannot be
+// encoded are dropped.
+func (q *Queue) Add(points []storage.Point) error {
+	valid := points[:0:0]
+	for _, point := range points {
+		if _, err := storage.EncodeLineProtocol([]storage.Point{point}); err != nil {
+			log.WithFields(log.Fields{"measurement": point.Measurement, "tags": point.Tags, "err": err}).Warn("Dropping invalid point")
+			q.mutex.Lock()
+			q.stats.Dropped++
+			q.mutex.Unlock()
+			continue
+		}
+		valid = append(valid, point)
+	}
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return ErrClosed
+	}
+	q.pending = append(q.pending, valid...)
+	full := len(q.pending) >= q.options.BatchSize
+	q.mutex.Unlock()
+	if full {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Stats returns the current state of the queue.
+func (q *Queue) Stats() Stats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	stats := q.stats
+	stats.Pending = len(q.pending)
+	stats.Retrying = q.failures > 0
+	return stats
+}
+
+// Flush writes all queued points now, ignoring the backoff, and returns the
+// error of the failed write, if any.
+func (q *Queue) Flush() error {
+	done := make(chan error)
+	select {
+	case q.flushes <- done:
+		return <-done
+	case <-q.stopped:
+		return ErrClosed
+	}
+}
+
+// Close stops the queue after a last attempt to write the queued points.
+// Points that could not be written are spilled and the points already written
+// are removed from the spill file.
+func (q *Queue) Close() error {
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.mutex.Unlock()
+	close(q.stop)
+	<-q.stopped
+
+	if err := q.write(); err == nil {
+		return nil
+	}
+	q.mutex.Lock()
+	points := q.pending
+	q.pending = nil
+	q.mutex.Unlock()
+	if err := q.spill(points); err != nil {
+		return err
+	}
+	return q.trimSpilled()
+}
+
+func (q *Queue) run() {
+	defer close(q.stopped)
+	ticker := time.NewTicker(q.options.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.flush()
+		case <-q.wake:
+			q.flush()
+		case done := <-q.flushes:
+			done <- q.write()
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// flush writes the queued points unless a retry is not yet due. Only the run
+// goroutine calls it.
+func (q *Queue) flush() {
+	q.mutex.Lock()
+	due := q.failures == 0 || !time.Now().Before(q.stats.NextAttempt)
+	q.mutex.Unlock()
+	if !due {
+		q.limit()
+		return
+	}
+	q.write()
+}
+
+// write writes the spilled and then the queued points in batches. On failure
+// the points stay queued and the next attempt is delayed. Points the storage
+// rejects are dropped instead of retried.
+func (q *Queue) write() error {
+	if err := q.writeSpilled(); err != nil {
+		q.failed(err)
+		q.limit()
+		return err
+	}
+	for {
+		q.mutex.Lock()
+		size := len(q.pending)
+		if size > q.options.BatchSize {
+			size = q.options.BatchSize
+		}
+		batch := q.pending[:size:size]
+		q.mutex.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := q.writeBatch(batch); err != nil {
+			q.failed(err)
+			q.limit()
+			return err
+		}
+		q.mutex.Lock()
+		q.pending = q.pending[size:]
+		q.mutex.Unlock()
+	}
+}
+
+// writeBatch writes a batch. If the storage rejects it, its points are written
+// one by one and those the storage rejects are dropped, so that a single bad
+// point does not block the queue. Only other errors are returned.
+func (q *Queue) writeBatch(points []storage.Point) error {
+	err := q.writer.Write(points)
+	switch {
+	case err == nil:
+		q.succeeded(len(points))
+		return nil
+	case !storage.IsRejected(err):
+		return err
+	case len(points) == 1:
+		q.rejected(points[0], err)
+		return nil
+	}
+	for _, point := range points {
+		err := q.writer.Write([]storage.Point{point})
+		switch {
+		case err == nil:
+			q.succeeded(1)
+		case storage.IsRejected(err):
+			q.rejected(point, err)
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *Queue) rejected(point storage.Point, err error) {
+	log.WithFields(log.Fields{"measurement": point.Measurement, "tags": point.Tags, "time": point.Time, "err": err}).Warn("Dropping point rejected by the storage")
+	q.mutex.Lock()
+	q.stats.Rejected++
+	q.mutex.Unlock()
+}
+
+func (q *Queue) failed(err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.failures++
+	q.stats.Failures++
+	q.stats.LastError = err.Error()
+	backoff := q.options.MaxBackoff
+	if q.failures < 32 {
+		if delay := q.options.MinBackoff << uint(q.failures-1); delay > 0 && delay < backoff {
+			backoff = delay
+		}
+	}
+	q.stats.NextAttempt = time.Now().Add(backoff)
+	log.WithFields(log.Fields{"err": err, "retry": backoff, "pending": len(q.pending), "spilled": q.stats.Spilled}).Warn("Writing points failed")
+}
+
+func (q *Queue) succeeded(count int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.failures > 0 {
+		log.WithFields(log.Fields{"failures": q.failures}).Info("Writing points succeeded again")
+	}
+	q.failures = 0
+	q.stats.NextAttempt = time.Time{}
+	q.stats.Written += uint64(count)
+	q.stats.LastWrite = time.Now()
+}
+
+// limit moves the oldest points beyond MaxPending out of memory.
+func (q *Queue) limit() {
+	q.mutex.Lock()
+	excess := len(q.pending) - q.options.MaxPending
+	if excess <= 0 {
+		q.mutex.Unlock()
+		return
+	}
+	points := q.pending[:excess:excess]
+	q.pending = q.pending[excess:]
+	q.mutex.Unlock()
+	if err := q.spill(points); err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("Spilling points failed")
+	}
+}
+
+// spill appends points to the spill file or drops them if spilling is
+// disabled or fails. Points beyond MaxSpilled are dropped.
+func (q *Queue) spill(points []storage.Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	q.mutex.Lock()
+	room := q.options.MaxSpilled - q.stats.Spilled
+	if room < 0 {
+		room = 0
+	}
+	if len(points) > room {
+		log.WithFields(log.Fields{"file": q.options.SpillFile, "points": len(points) - room}).Warn("Spill file is full, dropping points")
+		q.stats.Dropped += uint64(len(points) - room)
+		points = points[:room]
+	}
+	q.mutex.Unlock()
+	if len(points) == 0 {
+		return nil
+	}
+	err := errors.New("spilling is disabled")
+	if q.options.SpillFile != "" {
+		err = appendPoints(q.options.SpillFile, points)
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if err != nil {
+		q.stats.Dropped += uint64(len(points))
+		return err
+	}
+	q.stats.Spilled += len(points)
+	return nil
+}
+
+func appendPoints(filename string, points []storage.Point) error {
+	data, err := storage.EncodeLineProtocol(points)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeSpilled writes the points of the spill file in batches, starting at
+// the first point not written yet. If a write fails, the following attempt
+// starts at the failed batch.
+func (q *Queue) writeSpilled() error {
+	q.mutex.Lock()
+	spilled := q.stats.Spilled
+	q.mutex.Unlock()
+	if q.options.SpillFile == "" || spilled == 0 {
+		return nil
+	}
+	file, err := os.Open(q.options.SpillFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(q.spillOffset, io.SeekStart); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var lines bytes.Buffer
+	count := 0
+	offset := q.spillOffset
+	writeBatch := func() error {
+		if count == 0 {
+			return nil
+		}
+		points, err := storage.DecodeLineProtocol(lines.Bytes())
+		if err != nil {
+			// The file was damaged, e.g. by a crash while spilling.
+			log.WithFields(log.Fields{"file": q.options.SpillFile, "err": err}).Warn("Dropping damaged spilled points")
+			q.mutex.Lock()
+			q.stats.Dropped += uint64(count)
+			q.mutex.Unlock()
+		} else if err := q.writeBatch(points); err != nil {
+			return err
+		}
+		q.mutex.Lock()
+		q.stats.Spilled -= count
+		q.mutex.Unlock()
+		q.spillOffset = offset
+		lines.Reset()
+		count = 0
+		return nil
+	}
+	for scanner.Scan() {
+		lines.Write(scanner.Bytes())
+		lines.WriteByte('\n')
+		offset += int64(len(scanner.Bytes())) + 1
+		count++
+		if count == q.options.BatchSize {
+			if err := writeBatch(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := writeBatch(); err != nil {
+		return err
+	}
+	q.mutex.Lock()
+	q.stats.Spilled = 0
+	q.mutex.Unlock()
+	q.spillOffset = 0
+	return os.Remove(q.options.SpillFile)
+}
+
+// trimSpilled removes the points already written from the spill file by
+// copying the rest to a new file.
+func (q *Queue) trimSpilled() error {
+	if q.options.SpillFile == "" || q.spillOffset == 0 {
+		return nil
+	}
+	file, err := os.Open(q.options.SpillFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(q.spillOffset, io.SeekStart); err != nil {
+		return err
+	}
+	tmp := q.options.SpillFile + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, file); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, q.options.SpillFile); err != nil {
+		return err
+	}
+	q.spillOffset = 0
+	return nil
+}
+
+// countLines returns the number of lines of a file, 0 if it does not exist.
+func countLines(filename string) (int, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	count := 0
+	for scanner.Scan() {
+		count++
+	}
+	return count, scanner.Err()
+}
@@ -0,0 +1,226 @@
+package ingest
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/storage"
+)
+
+type fakeWriter struct {
+	mutex   sync.Mutex
+	down    bool
+	batches [][]storage.Point
+	// Batches containing a point with this value are rejected.
+	reject *float64
+}
+
+func (w *fakeWriter) Write(points []storage.Point) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.down {
+		return errors.New("connection refused")
+	}
+	for _, point := range points {
+		if w.reject != nil && point.Fields["value"] == *w.reject {
+			return storage.RejectedError{Err: errors.New("field type conflict")}
+		}
+	}
+	w.batches = append(w.batches, points)
+	return nil
+}
+
+func (w *fakeWriter) setDown(down bool) {
+	w.mutex.Lock()
+	w.down = down
+	w.mutex.Unlock()
+}
+
+func (w *fakeWriter) written() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	count := 0
+	for _, batch := range w.batches {
+		count += len(batch)
+	}
+	return count
+}
+
+func testPoints(count int) []storage.Point {
+	points := make([]storage.Point, count)
+	for i := range points {
+		points[i] = storage.Point{Measurement: "datapoint", Tags: storage.Tags{"device": "a"}, Fields: storage.Fields{"value": float64(i)}, Time: time.Unix(int64(i), 0)}
+	}
+	return points
+}
+
+func TestBatching(t *testing.T) {
+	writer := &fakeWriter{}
+	q, err := New(writer, Options{BatchSize: 4, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	q.Add(testPoints(10))
+	q.Add([]storage.Point{{Measurement: "datapoint", Time: time.Unix(0, 0)}})
+	if err := q.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(writer.batches) != 3 || len(writer.batches[0]) != 4 || len(writer.batches[2]) != 2 {
+		t.Fatalf("unexpected batches %v", writer.batches)
+	}
+	if stats := q.Stats(); stats.Written != 10 || stats.Dropped != 1 || stats.Pending != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestSpillAndRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spillFile := filepath.Join(dir, "spill.lp")
+	writer := &fakeWriter{down: true}
+	// The batch is never full, so only Flush writes.
+	q, err := New(writer, Options{BatchSize: 100, FlushInterval: time.Hour, MaxPending: 5, SpillFile: spillFile, MinBackoff: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q.Add(testPoints(8))
+	if err := q.Flush(); err == nil {
+		t.Fatal("expected write error")
+	}
+	stats := q.Stats()
+	if stats.Pending != 5 || stats.Spilled != 3 || !stats.Retrying || stats.Failures != 1 {
+		t.Fatalf("unexpected stats while down %+v", stats)
+	}
+	q.Close()
+	if stats := q.Stats(); stats.Pending != 0 || stats.Spilled != 8 {
+		t.Fatalf("unexpected stats after close %+v", stats)
+	}
+
+	writer.setDown(false)
+	q, err = New(writer, Options{BatchSize: 4, FlushInterval: time.Hour, SpillFile: spillFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err := q.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if writer.written() != 8 || q.Stats().Spilled != 0 {
+		t.Fatalf("spilled points were not written: %d, %+v", writer.written(), q.Stats())
+	}
+	if _, err := os.Stat(spillFile); !os.IsNotExist(err) {
+		t.Fatal("spill file was not removed")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	writer := &fakeWriter{down: true}
+	q, err := New(writer, Options{FlushInterval: 5 * time.Millisecond, MinBackoff: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	q.Add(testPoints(1))
+	time.Sleep(50 * time.Millisecond)
+
+	if stats := q.Stats(); stats.Failures != 1 || stats.NextAttempt.Before(time.Now().Add(50*time.Minute)) {
+		t.Fatalf("write was retried before the backoff: %+v", stats)
+	}
+}
+
+func TestRejectedPoints(t *testing.T) {
+	bad := 5.0
+	writer := &fakeWriter{reject: &bad}
+	q, err := New(writer, Options{BatchSize: 4, FlushInterval: time.Hour, MinBackoff: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	q.Add(testPoints(10))
+	if err := q.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := q.Stats(); writer.written() != 9 || stats.Written != 9 || stats.Rejected != 1 || stats.Pending != 0 || stats.Failures != 0 {
+		t.Fatalf("rejected point was not dropped: %d written, %+v", writer.written(), stats)
+	}
+}
+
+// flakyWriter accepts a number of writes and fails afterwards.
+type flakyWriter struct {
+	*fakeWriter
+	remaining int
+}
+
+func (w *flakyWriter) Write(points []storage.Point) error {
+	if w.remaining == 0 {
+		return errors.New("connection reset")
+	}
+	w.remaining--
+	return w.fakeWriter.Write(points)
+}
+
+func TestSpillLimitAndResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spillFile := filepath.Join(dir, "spill.lp")
+	writer := &flakyWriter{fakeWriter: &fakeWriter{}}
+	q, err := New(writer, Options{BatchSize: 2, FlushInterval: time.Hour, MaxPending: 1, MaxSpilled: 6, SpillFile: spillFile, MinBackoff: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	q.Add(testPoints(10))
+	q.Flush()
+	if stats := q.Stats(); stats.Pending != 1 || stats.Spilled != 6 || stats.Dropped != 3 {
+		t.Fatalf("unexpected stats with a full spill file %+v", stats)
+	}
+	info, err := os.Stat(spillFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first batch is written, the second fails.
+	writer.remaining = 1
+	if err := q.Flush(); err == nil {
+		t.Fatal("expected write error")
+	}
+	if after, _ := os.Stat(spillFile); q.Stats().Spilled != 4 || after.Size() != info.Size() {
+		t.Fatalf("unexpected state after a failed attempt: %+v, %d of %d bytes", q.Stats(), after.Size(), info.Size())
+	}
+	// Closing removes the written points from the spill file.
+	q.Close()
+	if count, _ := countLines(spillFile); count != 5 {
+		t.Fatalf("expected 5 points in the spill file, actual %d", count)
+	}
+
+	writer.remaining = -1
+	q, err = New(writer, Options{BatchSize: 2, FlushInterval: time.Hour, SpillFile: spillFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err := q.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if writer.written() != 7 || q.Stats().Spilled != 0 {
+		t.Fatalf("spilled points were not written exactly once: %d, %+v", writer.written(), q.Stats())
+	}
+}
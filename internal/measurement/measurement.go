@@ -0,0 +1,172 @@
+// Package measurement provides a registry of known measurement types. Every
+// type has a canonical unit, into which readings in other units are converted
+// before they are stored, and a range of plausible values.
+package measurement
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Unit is a unit of a measurement type together with the linear conversion
+// into the canonical unit of the type: canonical = value*Scale + Offset.
+type Unit struct {
+	Name   string  `json:"name"`
+	Scale  float64 `json:"scale"`
+	Offset float64 `json:"offset"`
+}
+
+// ToCanonical converts a value in this unit into the canonical unit.
+func (unit Unit) ToCanonical(value float64) float64 {
+	return value*unit.Scale + unit.Offset
+}
+
+// FromCanonical converts a value in the canonical unit into this unit.
+func (unit Unit) FromCanonical(value float64) float64 {
+	return (value - unit.Offset) / unit.Scale
+}
+
+// Type is a known measurement type.
+type Type struct {
+	Name          string `json:"name"`
+	CanonicalUnit string `json:"canonicalUnit"`
+	// Min and Max limit the plausible values in the canonical unit.
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Units []Unit  `json:"units"`
+	// MovedUnits maps units that were once accepted for this type to the
+	// type that readings in them belong to now.
+	MovedUnits map[string]string `json:"movedUnits,omitempty"`
+}
+
+// Unit looks up a unit of the type by name.
+func (t *Type) Unit(name string) (Unit, bool) {
+	for _, unit := range t.Units {
+		if unit.Name == name {
+			return unit, true
+		}
+	}
+	return Unit{}, false
+}
+
+// Registry holds the known measurement types.
+type Registry struct {
+	types map[string]*Type
+}
+
+// NewRegistry creates a registry of the given types. The canonical unit of
+// every type must be one of its units with scale 1 and offset 0.
+func NewRegistry(types ...*Type) *Registry {
+	registry := &Registry{types: make(map[string]*Type)}
+	for _, t := range types {
+		unit, ok := t.Unit(t.CanonicalUnit)
+		if !ok || unit.Scale != 1 || unit.Offset != 0 {
+			panic("measurement: invalid canonical unit of type " + t.Name)
+		}
+		registry.types[t.Name] = t
+	}
+	return registry
+}
+
+// Type looks up a measurement type by name.
+func (registry *Registry) Type(name string) (*Type, bool) {
+	t, ok := registry.types[name]
+	return t, ok
+}
+
+// Types returns all measurement types ordered by name.
+func (registry *Registry) Types() []*Type {
+	types := make([]*Type, 0, len(registry.types))
+	for _, t := range registry.types {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i].Name < types[j].Name
+	})
+	return types
+}
+
+// Migrate returns the type that readings of the given type and unit belong
+// to, which is another type if the unit moved there.
+func (registry *Registry) Migrate(typeName, unitName string) string {
+	if t, ok := registry.types[typeName]; ok {
+		if moved, ok := t.MovedUnits[unitName]; ok {
+			return moved
+		}
+	}
+	return typeName
+}
+
+// Normalize converts a value of the given type and unit into the canonical
+// unit of the type and checks that it is plausible.
+func (registry *Registry) Normalize(typeName, unitName string, value float64) (canonical float64, canonicalUnit string, err error) {
+	t, ok := registry.types[typeName]
+	if !ok {
+		return 0, "", fmt.Errorf("unknown type '%s'", typeName)
+	}
+	unit, ok := t.Unit(unitName)
+	if !ok {
+		return 0, "", fmt.Errorf("unknown unit '%s' for type '%s'", unitName, typeName)
+	}
+	canonical = unit.ToCanonical(value)
+	if canonical < t.Min || canonical > t.Max {
+		return 0, "", fmt.Errorf("value %v %s out of range [%v, %v] %s", value, unitName, t.Min, t.Max, t.CanonicalUnit)
+	}
+	return canonical, t.CanonicalUnit, nil
+}
+
+// Convert converts a value of the given type between two of its units.
+func (registry *Registry) Convert(typeName string, value float64, from, to string) (float64, error) {
+	t, ok := registry.types[typeName]
+	if !ok {
+		return 0, fmt.Errorf("unknown type '%s'", typeName)
+	}
+	fromUnit, ok := t.Unit(from)
+	if !ok {
+		return 0, fmt.Errorf("unknown unit '%s' for type '%s'", from, typeName)
+	}
+	toUnit, ok := t.Unit(to)
+	if !ok {
+		return 0, fmt.Errorf("unknown unit '%s' for type '%s'", to, typeName)
+	}
+	return toUnit.FromCanonical(fromUnit.ToCanonical(value)), nil
+}
+
+// canonical returns the canonical unit with the given name.
+func canonical(name string) Unit {
+	return Unit{Name: name, Scale: 1}
+}
+
+// Default is the registry of all measurement types known to the server.
+var Default = NewRegistry(
+	&Type{Name: "temperature", CanonicalUnit: "°C", Min: -60, Max: 150, Units: []Unit{
+		canonical("°C"),
+		{Name: "°F", Scale: 5.0 / 9.0, Offset: -32 * 5.0 / 9.0},
+		{Name: "K", Scale: 1, Offset: -273.15},
+	}},
+	&Type{Name: "humidity", CanonicalUnit: "%", Min: 0, Max: 100, Units: []Unit{
+		canonical("%"),
+	}},
+	&Type{Name: "brightness", CanonicalUnit: "%", Min: 0, Max: 100, Units: []Unit{
+		canonical("%"),
+	}, MovedUnits: map[string]string{"lx": "illuminance"}},
+	&Type{Name: "illuminance", CanonicalUnit: "lx", Min: 0, Max: 200000, Units: []Unit{
+		canonical("lx"),
+		{Name: "klx", Scale: 1000},
+	}},
+	&Type{Name: "pressure", CanonicalUnit: "hPa", Min: 300, Max: 1100, Units: []Unit{
+		canonical("hPa"),
+		{Name: "Pa", Scale: 0.01},
+		{Name: "kPa", Scale: 10},
+		{Name: "mbar", Scale: 1},
+	}},
+	&Type{Name: "co2", CanonicalUnit: "ppm", Min: 0, Max: 50000, Units: []Unit{
+		canonical("ppm"),
+		{Name: "ppb", Scale: 0.001},
+		{Name: "%", Scale: 10000},
+	}},
+	&Type{Name: "power", CanonicalUnit: "W", Min: -1e6, Max: 1e6, Units: []Unit{
+		canonical("W"),
+		{Name: "kW", Scale: 1000},
+	}},
+)
@@ -0,0 +1,62 @@
+package measurement
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	cases := []struct {
+		typeName, unit  string
+		value, expected float64
+		expectedUnit    string
+	}{
+		{"temperature", "°C", 21.5, 21.5, "°C"},
+		{"temperature", "°F", 212, 100, "°C"},
+		{"temperature", "K", 273.15, 0, "°C"},
+		{"pressure", "Pa", 101325, 1013.25, "hPa"},
+		{"illuminance", "klx", 1.5, 1500, "lx"},
+		{"co2", "%", 0.04, 400, "ppm"},
+	}
+	for _, c := range cases {
+		value, unit, err := Default.Normalize(c.typeName, c.unit, c.value)
+		if err != nil {
+			t.Fatalf("Normalize(%s, %s, %v) returned err: %v", c.typeName, c.unit, c.value, err)
+		}
+		if math.Abs(value-c.expected) > 1e-9 || unit != c.expectedUnit {
+			t.Fatalf("Normalize(%s, %s, %v): expected %v %s, actual %v %s", c.typeName, c.unit, c.value, c.expected, c.expectedUnit, value, unit)
+		}
+	}
+}
+
+func TestNormalizeRejects(t *testing.T) {
+	if _, _, err := Default.Normalize("smell", "%", 1); err == nil {
+		t.Fatal("Normalize accepted unknown type")
+	}
+	if _, _, err := Default.Normalize("temperature", "%", 1); err == nil {
+		t.Fatal("Normalize accepted unknown unit")
+	}
+	if _, _, err := Default.Normalize("temperature", "K", 0); err == nil {
+		t.Fatal("Normalize accepted implausible value")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	if migrated := Default.Migrate("brightness", "lx"); migrated != "illuminance" {
+		t.Fatalf("brightness in lx was migrated to '%s'", migrated)
+	}
+	if migrated := Default.Migrate("brightness", "%"); migrated != "brightness" {
+		t.Fatalf("brightness in %% was migrated to '%s'", migrated)
+	}
+	if _, _, err := Default.Normalize(Default.Migrate("brightness", "lx"), "lx", 350); err != nil {
+		t.Fatal("migrated brightness was rejected:", err)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	value, err := Default.Convert("temperature", 100, "°C", "°F")
+
+	if err != nil || math.Abs(value-212) > 1e-9 {
+		t.Fatalf("expected 212 °F, actual %v (err: %v)", value, err)
+	}
+}
@@ -0,0 +1,135 @@
+// Package provisioning implements the over-the-air enrollment of new hosts.
+//
+// A new host and the server share a short-lived bootstrap secret, which the
+// administrator reads from the server and enters on the host. The host
+// announces itself on the channel "<server>/provision" using a datagram
+// secured with the bootstrap secret. Once the administrator approves the
+// host, the server generates fresh secrets and sends them back on the channel
+// "<host>/provision", again secured with the bootstrap secret. From then on
+// the host uses the regular protocol with its fresh secrets.
+package provisioning
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+	log "github.com/sirupsen/logrus"
+)
+
+// Announcement is sent by a new host to request provisioning.
+type Announcement struct {
+	// Nonce is generated by the host and reproduced in the grant, which ties
+	// the grant to the current announcement.
+	Nonce []byte `json:"nonce"`
+	// Info is an optional human readable description of the host.
+	Info string `json:"info,omitempty"`
+}
+
+// Grant is sent by the server to deliver the secrets to an approved host.
+type Grant struct {
+	Nonce      []byte                     `json:"nonce"`
+	Key        commproto.ConfigurationKey `json:"key"`
+	Passphrase string                     `json:"passphrase"`
+	// TimeServer is set if the host should use the server as time server.
+	TimeServer bool `json:"time-server"`
+}
+
+// Channel returns the provisioning channel of the given address.
+func Channel(address string) string {
+	return fmt.Sprintf("%s/provision", address)
+}
+
+// Assemble encodes and encrypts a provisioning message using the bootstrap
+// secret.
+func Assemble(address string, message interface{}, bootstrap commproto.PartnerConfiguration) ([]byte, error) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := commproto.GenerateSecureRandomByteArray(commproto.IVSize)
+	if err != nil {
+		return nil, err
+	}
+	// Hosts without a clock cannot provide a meaningful timestamp before they
+	// are provisioned, so the nonce protects against replays instead.
+	return commproto.AssembleDatagram(address, iv, time.Now().UnixNano(), data, bootstrap.Key, bootstrap.Passphrase), nil
+}
+
+// Disassemble validates and decodes a provisioning message using the bootstrap
+// secret. It returns the address of the sender.
+func Disassemble(datagram []byte, message interface{}, bootstrap commproto.PartnerConfiguration) (string, error) {
+	sender, ok := commproto.ExtractAddress(datagram)
+	if !ok {
+		return "", errors.New("invalid datagram")
+	}
+	_, data, err := commproto.DisassembleDatagram(datagram, sender, bootstrap.Key, bootstrap.Passphrase)
+	if err != nil {
+		return sender, err
+	}
+	if err := json.Unmarshal(data, message); err != nil {
+		return sender, fmt.Errorf("invalid provisioning message: %v", err)
+	}
+	return sender, nil
+}
+
+// Enroll announces the host with the given address to the server and waits
+// until the server delivers the secrets or the timeout expires. The returned
+// configuration is ready to be saved with commproto.SaveConfiguration.
+func Enroll(ps commproto.PubSubClient, address, server, info string, bootstrap commproto.PartnerConfiguration, timeout time.Duration) (*commproto.ClientConfiguration, error) {
+	nonce, err := commproto.GenerateSecureRandomByteArray(commproto.NonceSize)
+	if err != nil {
+		return nil, err
+	}
+	announcement, err := Assemble(address, Announcement{Nonce: nonce, Info: info}, bootstrap)
+	if err != nil {
+		return nil, err
+	}
+
+	grants := make(chan Grant, 1)
+	ps.Subscribe(Channel(address), func(_ string, datagram []byte) {
+		var grant Grant
+		sender, err := Disassemble(datagram, &grant, bootstrap)
+		if err != nil || sender != server {
+			log.WithFields(log.Fields{"sender": sender, "err": err}).Warn("Received invalid provisioning grant")
+			return
+		}
+		if !bytes.Equal(grant.Nonce, nonce) {
+			log.WithFields(log.Fields{"sender": sender}).Warn("Received provisioning grant with wrong nonce")
+			return
+		}
+		select {
+		case grants <- grant:
+		default:
+		}
+	})
+	defer ps.Unsubscribe(Channel(address))
+
+	deadline := time.After(timeout)
+	for {
+		log.WithFields(log.Fields{"server": server}).Info("Announcing host for provisioning")
+		ps.Publish(Channel(server), announcement)
+		select {
+		case grant := <-grants:
+			config := &commproto.ClientConfiguration{
+				HostAddress: address,
+				Partners: map[string]commproto.PartnerConfiguration{
+					server: {Key: grant.Key, Passphrase: grant.Passphrase},
+				},
+			}
+			if grant.TimeServer {
+				config.UseTimeServer = server
+			}
+			if err := config.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid provisioning grant: %v", err)
+			}
+			return config, nil
+		case <-deadline:
+			return nil, errors.New("provisioning timed out")
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
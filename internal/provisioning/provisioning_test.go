@@ -0,0 +1,97 @@
+package provisioning
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+)
+
+type memoryPubSub struct {
+	mutex     sync.Mutex
+	callbacks map[string][]commproto.PubSubCallback
+}
+
+func (ps *memoryPubSub) Disconnect() {}
+
+func (ps *memoryPubSub) Subscribe(channel string, callback commproto.PubSubCallback) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.callbacks[channel] = append(ps.callbacks[channel], callback)
+}
+
+func (ps *memoryPubSub) Unsubscribe(channel string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	delete(ps.callbacks, channel)
+}
+
+func (ps *memoryPubSub) Publish(channel string, data []byte) {
+	ps.mutex.Lock()
+	callbacks := ps.callbacks[channel]
+	ps.mutex.Unlock()
+	for _, callback := range callbacks {
+		go callback(channel, append([]byte(nil), data...))
+	}
+}
+
+func TestEnroll(t *testing.T) {
+	ps := &memoryPubSub{callbacks: make(map[string][]commproto.PubSubCallback)}
+	bootstrap, err := commproto.GeneratePartnerConfiguration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := commproto.GeneratePartnerConfiguration()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act as the server and grant every valid announcement.
+	ps.Subscribe(Channel("master"), func(_ string, datagram []byte) {
+		var announcement Announcement
+		sender, err := Disassemble(datagram, &announcement, bootstrap)
+		if err != nil {
+			t.Errorf("Disassemble returned err for valid announcement: %v", err)
+			return
+		}
+		if sender != "sensor" || announcement.Info != "test" {
+			t.Errorf("unexpected announcement from '%s': %+v", sender, announcement)
+		}
+		grant := Grant{Nonce: announcement.Nonce, Key: secret.Key, Passphrase: secret.Passphrase, TimeServer: true}
+		response, err := Assemble("master", grant, bootstrap)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ps.Publish(Channel(sender), response)
+	})
+
+	config, err := Enroll(ps, "sensor", "master", "test", bootstrap, 2*time.Second)
+
+	if err != nil {
+		t.Fatalf("Enroll returned err: %v", err)
+	}
+	if config.HostAddress != "sensor" || config.UseTimeServer != "master" {
+		t.Fatalf("Enroll returned unexpected configuration: %+v", config)
+	}
+	if partner := config.Partners["master"]; string(partner.Key) != string(secret.Key) || partner.Passphrase != secret.Passphrase {
+		t.Fatal("Enroll did not return the granted secrets")
+	}
+}
+
+func TestDisassembleWrongBootstrap(t *testing.T) {
+	bootstrap, _ := commproto.GeneratePartnerConfiguration()
+	other, _ := commproto.GeneratePartnerConfiguration()
+	datagram, err := Assemble("sensor", Announcement{Nonce: make([]byte, commproto.NonceSize)}, bootstrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var announcement Announcement
+	_, err = Disassemble(datagram, &announcement, other)
+
+	if err == nil {
+		t.Fatal("Disassemble accepted announcement with wrong bootstrap secret")
+	}
+}
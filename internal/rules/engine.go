@@ -0,0 +1,330 @@
+package rules
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// recentAlerts is the number of alerts kept in memory.
+const recentAlerts = 100
+
+// notificationQueue is the number of alerts waiting for their notifiers.
+// Further alerts are dropped, so slow notifiers never block the ingest path.
+const notificationQueue = 64
+
+// Configuration is the content of the rules file.
+type Configuration struct {
+	Notifiers []NotifierConfiguration `json:"notifiers"`
+	Rules     []Rule                  `json:"rules"`
+}
+
+type sensorState struct {
+	value, previous float64
+	at, previousAt  time.Time
+}
+
+type ruleState struct {
+	rule      Rule
+	active    []bool
+	firing    bool
+	lastFired time.Time
+	since     time.Time
+}
+
+type notification struct {
+	alert     Alert
+	notifiers []string
+}
+
+// Engine evaluates the rules on every observed reading. It is safe for
+// concurrent use.
+type Engine struct {
+	mutex          sync.Mutex
+	filename       string
+	notifierConfig []NotifierConfiguration
+	notifiers      map[string]Notifier
+	rules          map[string]*ruleState
+	sensors        map[Sensor]*sensorState
+	recent         []Alert
+	queue          chan notification
+	now            func() time.Time
+}
+
+// LoadEngine loads the notifiers and rules from the given file and starts
+// delivering notifications. A missing file results in an engine without
+// rules. Notifiers are created with the factory.
+func LoadEngine(filename string, factory NotifierFactory) (*Engine, error) {
+	engine := &Engine{
+		filename:  filename,
+		notifiers: make(map[string]Notifier),
+		rules:     make(map[string]*ruleState),
+		sensors:   make(map[Sensor]*sensorState),
+		queue:     make(chan notification, notificationQueue),
+		now:       time.Now,
+	}
+
+	var config Configuration
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("rules file '%s': %v", filename, err)
+		}
+	}
+
+	for _, notifierConfig := range config.Notifiers {
+		if _, ok := engine.notifiers[notifierConfig.Name]; ok {
+			return nil, fmt.Errorf("rules file '%s': duplicate notifier '%s'", filename, notifierConfig.Name)
+		}
+		notifier, err := factory(notifierConfig)
+		if err != nil {
+			return nil, fmt.Errorf("rules file '%s': notifier '%s': %v", filename, notifierConfig.Name, err)
+		}
+		engine.notifiers[notifierConfig.Name] = notifier
+	}
+	engine.notifierConfig = config.Notifiers
+	for _, rule := range config.Rules {
+		if err := engine.validate(rule); err != nil {
+			return nil, fmt.Errorf("rules file '%s': rule '%s': %v", filename, rule.ID, err)
+		}
+		engine.rules[rule.ID] = engine.newState(rule)
+	}
+
+	go engine.deliver()
+	return engine, nil
+}
+
+func (engine *Engine) validate(rule Rule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	for _, name := range rule.Notifiers {
+		if _, ok := engine.notifiers[name]; !ok {
+			return fmt.Errorf("unknown notifier '%s'", name)
+		}
+	}
+	return nil
+}
+
+func (engine *Engine) newState(rule Rule) *ruleState {
+	return &ruleState{rule: rule, active: make([]bool, len(rule.Conditions)), since: engine.now()}
+}
+
+// Notifiers returns the names and types of all notifiers.
+func (engine *Engine) Notifiers() []NotifierConfiguration {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	result := make([]NotifierConfiguration, len(engine.notifierConfig))
+	for i, config := range engine.notifierConfig {
+		result[i] = NotifierConfiguration{Name: config.Name, Type: config.Type}
+	}
+	return result
+}
+
+// Rules returns all rules ordered by name.
+func (engine *Engine) Rules() []Rule {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	return engine.sortedRules()
+}
+
+func (engine *Engine) sortedRules() []Rule {
+	result := make([]Rule, 0, len(engine.rules))
+	for _, state := range engine.rules {
+		result = append(result, state.rule)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// SetRule adds a new rule or replaces the rule with the same id. Rules
+// without an id get a random one. Replacing a rule resets its state. The
+// rules are left unchanged if they cannot be saved.
+func (engine *Engine) SetRule(rule Rule) (Rule, error) {
+	if err := engine.validate(rule); err != nil {
+		return Rule{}, err
+	}
+	if rule.ID == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return Rule{}, err
+		}
+		rule.ID = hex.EncodeToString(id)
+	}
+
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	previous, replaced := engine.rules[rule.ID]
+	engine.rules[rule.ID] = engine.newState(rule)
+	if err := engine.save(); err != nil {
+		if replaced {
+			engine.rules[rule.ID] = previous
+		} else {
+			delete(engine.rules, rule.ID)
+		}
+		return Rule{}, err
+	}
+	return rule, nil
+}
+
+// DeleteRule removes a rule. The rule is kept if the rules cannot be saved.
+func (engine *Engine) DeleteRule(id string) error {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	state, ok := engine.rules[id]
+	if !ok {
+		return fmt.Errorf("unknown rule '%s'", id)
+	}
+	delete(engine.rules, id)
+	if err := engine.save(); err != nil {
+		engine.rules[id] = state
+		return err
+	}
+	return nil
+}
+
+// RecentAlerts returns the last alerts of all rules.
+func (engine *Engine) RecentAlerts() []Alert {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	return append([]Alert(nil), engine.recent...)
+}
+
+// Observe records a reading and evaluates all rules that depend on the
+// sensor. Readings older than the last reading of the sensor are ignored.
+func (engine *Engine) Observe(sensor Sensor, value float64, at time.Time) {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	state, ok := engine.sensors[sensor]
+	if !ok {
+		state = &sensorState{}
+		engine.sensors[sensor] = state
+	} else if at.Before(state.at) {
+		return
+	}
+	state.previous, state.previousAt = state.value, state.at
+	state.value, state.at = value, at
+
+	now := engine.now()
+	for _, rule := range engine.rules {
+		for _, condition := range rule.rule.Conditions {
+			if condition.Sensor == sensor {
+				engine.evaluate(rule, now)
+				break
+			}
+		}
+	}
+}
+
+// Tick evaluates all rules. It must be called periodically so that no-data
+// conditions are detected and alerts suppressed by a cooldown are raised
+// once it expires.
+func (engine *Engine) Tick() {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	now := engine.now()
+	for _, rule := range engine.rules {
+		engine.evaluate(rule, now)
+	}
+}
+
+// evaluate updates the state of a rule and raises alerts. The caller must hold
+// the mutex.
+func (engine *Engine) evaluate(state *ruleState, now time.Time) {
+	rule := state.rule
+	if !rule.Enabled {
+		return
+	}
+	met := rule.Combine != Any
+	var descriptions []string
+	for i, condition := range rule.Conditions {
+		sensor := engine.sensors[condition.Sensor]
+		state.active[i] = condition.evaluate(state.active[i], sensor, now, state.since)
+		if state.active[i] {
+			descriptions = append(descriptions, condition.describe(sensor))
+		}
+		if rule.Combine == Any {
+			met = met || state.active[i]
+		} else {
+			met = met && state.active[i]
+		}
+	}
+
+	cooldown := time.Duration(rule.CooldownSeconds) * time.Second
+	switch {
+	case met && !state.firing && (state.lastFired.IsZero() || now.Sub(state.lastFired) >= cooldown):
+		state.firing = true
+		state.lastFired = now
+		engine.raise(rule, Alert{State: Firing, Time: now, Conditions: descriptions})
+	case !met && state.firing:
+		state.firing = false
+		engine.raise(rule, Alert{State: Resolved, Time: now, Conditions: []string{}})
+	}
+}
+
+// raise records an alert and queues it for the notifiers of the rule. The
+// caller must hold the mutex.
+func (engine *Engine) raise(rule Rule, alert Alert) {
+	alert.RuleID, alert.RuleName, alert.Severity = rule.ID, rule.Name, rule.Severity
+	log.WithFields(log.Fields{"rule": rule.Name, "state": alert.State, "conditions": alert.Conditions}).Info("Alert")
+	engine.recent = append(engine.recent, alert)
+	if len(engine.recent) > recentAlerts {
+		engine.recent = engine.recent[len(engine.recent)-recentAlerts:]
+	}
+	select {
+	case engine.queue <- notification{alert: alert, notifiers: rule.Notifiers}:
+	default:
+		log.WithFields(log.Fields{"rule": rule.Name}).Warn("Notification queue full, dropping alert")
+	}
+}
+
+func (engine *Engine) deliver() {
+	for n := range engine.queue {
+		for _, name := range n.notifiers {
+			engine.mutex.Lock()
+			notifier := engine.notifiers[name]
+			engine.mutex.Unlock()
+			if notifier == nil {
+				continue
+			}
+			if err := notifier.Notify(n.alert); err != nil {
+				log.WithFields(log.Fields{"notifier": name, "err": err}).Warn("Failed to deliver alert")
+			}
+		}
+	}
+}
+
+// save writes the notifiers and rules to the rules file. The caller must hold
+// the mutex.
+func (engine *Engine) save() error {
+	if engine.filename == "" {
+		return nil
+	}
+	config := Configuration{Notifiers: engine.notifierConfig, Rules: engine.sortedRules()}
+	data, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := engine.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, engine.filename)
+}
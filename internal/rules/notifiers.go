@@ -0,0 +1,101 @@
+package rules
+
+// This file implements the built-in notifiers.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/util/rotatefile"
+)
+
+// Limits of the log file notifier.
+const (
+	logFileMaxSize = 1 << 20 // bytes
+	logFileKeep    = 5
+)
+
+// webhookTimeout limits the time to deliver an alert to a webhook.
+const webhookTimeout = 10 * time.Second
+
+// Notifier delivers alerts.
+type Notifier interface {
+	Notify(alert Alert) error
+}
+
+// NotifierFunc adapts a function to the Notifier interface.
+type NotifierFunc func(alert Alert) error
+
+// Notify implements Notifier.
+func (f NotifierFunc) Notify(alert Alert) error {
+	return f(alert)
+}
+
+// NotifierConfiguration configures a notifier. Which of the fields are used
+// depends on the type:
+//
+//	log      appends alerts as JSON lines to the file Path
+//	webhook  posts alerts as JSON to URL
+//
+// Applications can support further types with their own NotifierFactory.
+type NotifierConfiguration struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Path    string `json:"path,omitempty"`
+	URL     string `json:"url,omitempty"`
+	Partner string `json:"partner,omitempty"`
+}
+
+// NotifierFactory creates a notifier from its configuration.
+type NotifierFactory func(config NotifierConfiguration) (Notifier, error)
+
+// DefaultFactory creates the built-in notifiers.
+func DefaultFactory(config NotifierConfiguration) (Notifier, error) {
+	switch config.Type {
+	case "log":
+		if config.Path == "" {
+			return nil, errors.New("missing path")
+		}
+		file, err := rotatefile.Open(config.Path, logFileMaxSize, logFileKeep)
+		if err != nil {
+			return nil, err
+		}
+		return NotifierFunc(func(alert Alert) error {
+			return file.WriteJSON(alert)
+		}), nil
+	case "webhook":
+		if config.URL == "" {
+			return nil, errors.New("missing url")
+		}
+		return &Webhook{URL: config.URL, Client: &http.Client{Timeout: webhookTimeout}}, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier type '%s'", config.Type)
+	}
+}
+
+// Webhook posts alerts as JSON to a URL.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+// Notify implements Notifier.
+func (webhook *Webhook) Notify(alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := webhook.Client.Post(webhook.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %s", resp.Status)
+	}
+	return nil
+}
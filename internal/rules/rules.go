@@ -0,0 +1,187 @@
+// Package rules evaluates alerting rules on sensor readings. A rule combines
+// one or more conditions on sensors, e.g. a value above a threshold or no data
+// for some time, and notifies its notifiers when it starts or stops firing.
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ConditionType is the kind of check a condition performs.
+type ConditionType string
+
+// Condition types
+const (
+	// Above is met while the value is above the threshold.
+	Above ConditionType = "above"
+	// Below is met while the value is below the threshold.
+	Below ConditionType = "below"
+	// RateOfChange is met while the value changes by more than the threshold
+	// per minute, in either direction.
+	RateOfChange ConditionType = "rate-of-change"
+	// NoData is met if the sensor has not reported for DurationSeconds.
+	NoData ConditionType = "no-data"
+)
+
+// Sensor identifies a sensor of a device.
+type Sensor struct {
+	DeviceID string `json:"deviceId"`
+	SensorID byte   `json:"sensorId"`
+}
+
+func (sensor Sensor) String() string {
+	return fmt.Sprintf("%s/%d", sensor.DeviceID, sensor.SensorID)
+}
+
+// Condition is a single check on one sensor.
+type Condition struct {
+	Type      ConditionType `json:"type"`
+	Sensor    Sensor        `json:"sensor"`
+	Threshold float64       `json:"threshold,omitempty"`
+	// Hysteresis keeps a met threshold condition active until the value is
+	// back beyond the threshold by this amount, which prevents flapping.
+	Hysteresis      float64 `json:"hysteresis,omitempty"`
+	DurationSeconds int     `json:"durationSeconds,omitempty"`
+}
+
+func (c Condition) validate() error {
+	switch c.Type {
+	case Above, Below, RateOfChange:
+		if math.IsNaN(c.Threshold) || math.IsInf(c.Threshold, 0) {
+			return errors.New("invalid threshold")
+		}
+		if c.Hysteresis < 0 || math.IsNaN(c.Hysteresis) || math.IsInf(c.Hysteresis, 0) {
+			return errors.New("invalid hysteresis")
+		}
+	case NoData:
+		if c.DurationSeconds <= 0 {
+			return errors.New("no-data condition requires a positive duration")
+		}
+	default:
+		return fmt.Errorf("unknown condition type '%s'", c.Type)
+	}
+	if c.Sensor.DeviceID == "" {
+		return errors.New("missing device id")
+	}
+	return nil
+}
+
+// evaluate returns whether the condition is met, given whether it was met
+// before and the state of its sensor.
+func (c Condition) evaluate(active bool, sensor *sensorState, now, since time.Time) bool {
+	if c.Type == NoData {
+		lastSeen := since
+		if sensor != nil && sensor.at.After(lastSeen) {
+			lastSeen = sensor.at
+		}
+		return now.Sub(lastSeen) > time.Duration(c.DurationSeconds)*time.Second
+	}
+	if sensor == nil {
+		return false
+	}
+
+	value, threshold := sensor.value, c.Threshold
+	switch c.Type {
+	case Below:
+		// Mirror the values to share the logic of Above.
+		value, threshold = -value, -threshold
+	case RateOfChange:
+		if sensor.previousAt.IsZero() || !sensor.at.After(sensor.previousAt) {
+			return false
+		}
+		value = math.Abs(sensor.value-sensor.previous) / sensor.at.Sub(sensor.previousAt).Minutes()
+	}
+	if active {
+		return value > threshold-c.Hysteresis
+	}
+	return value > threshold
+}
+
+func (c Condition) describe(sensor *sensorState) string {
+	switch c.Type {
+	case NoData:
+		return fmt.Sprintf("no data from %s for %ds", c.Sensor, c.DurationSeconds)
+	case RateOfChange:
+		return fmt.Sprintf("%s changes faster than %v per minute", c.Sensor, c.Threshold)
+	default:
+		value := math.NaN()
+		if sensor != nil {
+			value = sensor.value
+		}
+		return fmt.Sprintf("%s is %s %v (%v)", c.Sensor, c.Type, c.Threshold, value)
+	}
+}
+
+// Combination selects how the conditions of a rule are combined.
+type Combination string
+
+// Combinations
+const (
+	All Combination = "all"
+	Any Combination = "any"
+)
+
+// Rule raises an alert when its conditions are met.
+type Rule struct {
+	ID         string      `json:"id"`
+	Name       string      `json:"name"`
+	Enabled    bool        `json:"enabled"`
+	Severity   string      `json:"severity,omitempty"`
+	Conditions []Condition `json:"conditions"`
+	// Combine defaults to All.
+	Combine Combination `json:"combine,omitempty"`
+	// CooldownSeconds is the minimum time between two alerts of the rule.
+	CooldownSeconds int      `json:"cooldownSeconds,omitempty"`
+	Notifiers       []string `json:"notifiers"`
+}
+
+func (rule Rule) validate() error {
+	if rule.Name == "" {
+		return errors.New("missing rule name")
+	}
+	if len(rule.Conditions) == 0 {
+		return errors.New("rule requires at least one condition")
+	}
+	for i, condition := range rule.Conditions {
+		if err := condition.validate(); err != nil {
+			return fmt.Errorf("condition %d: %v", i+1, err)
+		}
+	}
+	switch rule.Combine {
+	case "", All, Any:
+	default:
+		return fmt.Errorf("unknown combination '%s'", rule.Combine)
+	}
+	if rule.CooldownSeconds < 0 {
+		return errors.New("negative cooldown")
+	}
+	return nil
+}
+
+// AlertState tells whether a rule started or stopped firing.
+type AlertState string
+
+// Alert states
+const (
+	Firing   AlertState = "firing"
+	Resolved AlertState = "resolved"
+)
+
+// Alert is passed to the notifiers of a rule.
+type Alert struct {
+	RuleID   string     `json:"ruleId"`
+	RuleName string     `json:"ruleName"`
+	Severity string     `json:"severity,omitempty"`
+	State    AlertState `json:"state"`
+	Time     time.Time  `json:"time"`
+	// Conditions describes the conditions that are met.
+	Conditions []string `json:"conditions"`
+}
+
+// Message returns a single line description of the alert.
+func (alert Alert) Message() string {
+	return fmt.Sprintf("rule '%s' %s: %v", alert.RuleName, alert.State, alert.Conditions)
+}
@@ -0,0 +1,129 @@
+package rules
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var kitchen = Sensor{DeviceID: "shredder", SensorID: 2}
+var cellar = Sensor{DeviceID: "kronos", SensorID: 3}
+
+func newTestEngine(t *testing.T, rules ...Rule) (*Engine, *time.Time) {
+	factory := func(config NotifierConfiguration) (Notifier, error) {
+		return NotifierFunc(func(Alert) error { return nil }), nil
+	}
+	engine, err := LoadEngine("", factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1546300800, 0)
+	engine.now = func() time.Time { return now }
+	for _, rule := range rules {
+		if _, err := engine.SetRule(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return engine, &now
+}
+
+func states(engine *Engine) []AlertState {
+	var result []AlertState
+	for _, alert := range engine.RecentAlerts() {
+		result = append(result, alert.State)
+	}
+	return result
+}
+
+func TestThresholdWithHysteresisAndCooldown(t *testing.T) {
+	engine, now := newTestEngine(t, Rule{
+		Name:            "hot",
+		Enabled:         true,
+		Conditions:      []Condition{{Type: Above, Sensor: kitchen, Threshold: 30, Hysteresis: 2}},
+		CooldownSeconds: 600,
+	})
+	observe := func(value float64) {
+		*now = now.Add(time.Minute)
+		engine.Observe(kitchen, value, *now)
+	}
+
+	observe(31) // fires
+	observe(29) // still firing because of the hysteresis
+	observe(27) // resolved
+	observe(31) // suppressed by the cooldown
+
+	if actual := states(engine); len(actual) != 2 || actual[0] != Firing || actual[1] != Resolved {
+		t.Fatalf("expected firing and resolved, actual %v", actual)
+	}
+	*now = now.Add(10 * time.Minute)
+	engine.Tick()
+	if actual := states(engine); len(actual) != 3 || actual[2] != Firing {
+		t.Fatalf("expected alert after cooldown, actual %v", actual)
+	}
+}
+
+func TestCombinedConditions(t *testing.T) {
+	engine, now := newTestEngine(t, Rule{
+		Name:    "frost",
+		Enabled: true,
+		Conditions: []Condition{
+			{Type: Below, Sensor: kitchen, Threshold: 5},
+			{Type: Below, Sensor: cellar, Threshold: 5},
+		},
+	})
+
+	engine.Observe(kitchen, 3, *now)
+	if actual := states(engine); len(actual) != 0 {
+		t.Fatalf("rule fired with only one condition met: %v", actual)
+	}
+	engine.Observe(cellar, 4, *now)
+	if actual := states(engine); len(actual) != 1 || actual[0] != Firing {
+		t.Fatalf("expected firing, actual %v", actual)
+	}
+}
+
+func TestRateOfChangeAndNoData(t *testing.T) {
+	engine, now := newTestEngine(t,
+		Rule{Name: "jump", Enabled: true, Conditions: []Condition{{Type: RateOfChange, Sensor: kitchen, Threshold: 1}}},
+		Rule{Name: "silent", Enabled: true, Conditions: []Condition{{Type: NoData, Sensor: cellar, DurationSeconds: 300}}},
+	)
+
+	engine.Observe(kitchen, 20, *now)
+	engine.Observe(kitchen, 25, now.Add(time.Minute))
+	*now = now.Add(6 * time.Minute)
+	engine.Tick()
+
+	alerts := engine.RecentAlerts()
+	if len(alerts) != 2 || alerts[0].RuleName != "jump" || alerts[1].RuleName != "silent" {
+		t.Fatalf("expected alerts of 'jump' and 'silent', actual %+v", alerts)
+	}
+}
+
+func TestSetRuleValidation(t *testing.T) {
+	engine, _ := newTestEngine(t)
+
+	if _, err := engine.SetRule(Rule{Name: "empty"}); err == nil {
+		t.Fatal("SetRule accepted rule without conditions")
+	}
+	rule := Rule{Name: "hot", Conditions: []Condition{{Type: Above, Sensor: kitchen}}, Notifiers: []string{"unknown"}}
+	if _, err := engine.SetRule(rule); err == nil {
+		t.Fatal("SetRule accepted unknown notifier")
+	}
+}
+
+func TestRulesUnchangedOnSaveFailure(t *testing.T) {
+	rule := Rule{ID: "hot", Name: "hot", Conditions: []Condition{{Type: Above, Sensor: kitchen}}}
+	engine, _ := newTestEngine(t, rule)
+	engine.filename = filepath.Join(os.TempDir(), "missing-rules-dir", "rules.json")
+
+	if _, err := engine.SetRule(Rule{Name: "cold", Conditions: []Condition{{Type: Below, Sensor: cellar}}}); err == nil {
+		t.Fatal("SetRule did not fail for missing directory")
+	}
+	if err := engine.DeleteRule("hot"); err == nil {
+		t.Fatal("DeleteRule did not fail for missing directory")
+	}
+	if rules := engine.Rules(); len(rules) != 1 || rules[0].ID != "hot" {
+		t.Fatalf("rules changed although they were not saved: %+v", rules)
+	}
+}
@@ -0,0 +1,180 @@
+package secrets
+
+// This file implements the encrypted-at-rest secrets file.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	fileVersion = 1
+	saltSize    = 16
+	// scrypt parameters as recommended for interactive logins in 2017. They
+	// keep unlocking below one second on a Raspberry Pi.
+	scryptN = 32768
+	scryptR = 8
+	scryptP = 1
+)
+
+// encryptedFileContent is the on-disk format. The secrets are stored as a
+// JSON object encrypted with AES-256-GCM, using a key derived from the master
+// key with scrypt.
+type encryptedFileContent struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// EncryptedFile is a writable provider that stores all secrets in a single
+// file, which is encrypted with a master key (a passphrase or the content of a
+// key file).
+type EncryptedFile struct {
+	filename  string
+	masterKey []byte
+
+	mutex   sync.RWMutex
+	secrets map[string][]byte
+}
+
+// OpenEncryptedFile decrypts the secrets file with the master key. A missing
+// file results in an empty provider, which creates the file on the first
+// change.
+func OpenEncryptedFile(filename string, masterKey []byte) (*EncryptedFile, error) {
+	if len(masterKey) == 0 {
+		return nil, errors.New("missing master key for encrypted secrets file")
+	}
+	file := &EncryptedFile{
+		filename:  filename,
+		masterKey: masterKey,
+		secrets:   make(map[string][]byte),
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return file, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var content encryptedFileContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, fmt.Errorf("secrets file '%s': %v", filename, err)
+	}
+	if content.Version != fileVersion {
+		return nil, fmt.Errorf("secrets file '%s': unsupported version %d", filename, content.Version)
+	}
+	aead, err := newAEAD(masterKey, content.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(content.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("secrets file '%s': invalid nonce", filename)
+	}
+	plaintext, err := aead.Open(nil, content.Nonce, content.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("secrets file '%s': wrong master key or corrupted file", filename)
+	}
+	if err := json.Unmarshal(plaintext, &file.secrets); err != nil {
+		return nil, fmt.Errorf("secrets file '%s': %v", filename, err)
+	}
+	return file, nil
+}
+
+func newAEAD(masterKey, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(masterKey, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Secret implements Provider.
+func (file *EncryptedFile) Secret(name string) ([]byte, error) {
+	file.mutex.RLock()
+	defer file.mutex.RUnlock()
+	value, ok := file.secrets[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+// SetSecret implements WritableProvider.
+func (file *EncryptedFile) SetSecret(name string, value []byte) error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	file.secrets[name] = value
+	return file.save()
+}
+
+// DeleteSecret removes the secret from the file.
+func (file *EncryptedFile) DeleteSecret(name string) error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	if _, ok := file.secrets[name]; !ok {
+		return ErrNotFound
+	}
+	delete(file.secrets, name)
+	return file.save()
+}
+
+// Names returns the sorted names of all stored secrets.
+func (file *EncryptedFile) Names() []string {
+	file.mutex.RLock()
+	defer file.mutex.RUnlock()
+	names := make([]string, 0, len(file.secrets))
+	for name := range file.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// save encrypts and writes the secrets with a fresh salt and nonce. The
+// caller must hold the mutex.
+func (file *EncryptedFile) save() error {
+	plaintext, err := json.Marshal(file.secrets)
+	if err != nil {
+		return err
+	}
+	content := encryptedFileContent{Version: fileVersion, Salt: make([]byte, saltSize)}
+	if _, err := rand.Read(content.Salt); err != nil {
+		return err
+	}
+	aead, err := newAEAD(file.masterKey, content.Salt)
+	if err != nil {
+		return err
+	}
+	content.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(content.Nonce); err != nil {
+		return err
+	}
+	content.Data = aead.Seal(nil, content.Nonce, plaintext, nil)
+
+	data, err := json.MarshalIndent(content, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := file.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file.filename)
+}
@@ -0,0 +1,151 @@
+// Package secrets provides access to secret values like keys and passwords,
+// so that they do not have to be stored in plaintext configuration files.
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned by providers that do not know the requested secret.
+var ErrNotFound = errors.New("secret not found")
+
+// Provider looks up secrets by name.
+type Provider interface {
+	// Secret returns the value of the secret or ErrNotFound.
+	Secret(name string) ([]byte, error)
+}
+
+// WritableProvider is a provider that can store new secrets.
+type WritableProvider interface {
+	Provider
+	// SetSecret stores the secret, replacing any previous value.
+	SetSecret(name string, value []byte) error
+	// DeleteSecret removes the secret or returns ErrNotFound.
+	DeleteSecret(name string) error
+}
+
+// Env reads secrets from environment variables. The variable name is the
+// prefix followed by the secret name in upper case with all characters other
+// than letters and digits replaced by underscores, e.g. the secret
+// "influx-password" with prefix "RASPI_" is read from RASPI_INFLUX_PASSWORD.
+type Env struct {
+	Prefix string
+}
+
+// Secret implements Provider.
+func (env Env) Secret(name string) ([]byte, error) {
+	value, ok := os.LookupEnv(env.Prefix + envName(name))
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return []byte(value), nil
+}
+
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// Directory reads every secret from a file of the same name in a directory,
+// like the credentials directory systemd provides in $CREDENTIALS_DIRECTORY.
+// A single trailing newline is removed from the value.
+type Directory struct {
+	Path string
+}
+
+// Secret implements Provider.
+func (dir Directory) Secret(name string) ([]byte, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid secret name '%s'", name)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir.Path, name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n := len(data); n > 0 && data[n-1] == '\n' {
+		data = data[:n-1]
+	}
+	return data, nil
+}
+
+// Chain asks each provider in order and returns the first secret found.
+type Chain []Provider
+
+// Secret implements Provider.
+func (chain Chain) Secret(name string) ([]byte, error) {
+	for _, provider := range chain {
+		value, err := provider.Secret(name)
+		if err != ErrNotFound {
+			return value, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Writable returns the first writable provider of the chain, if any.
+func (chain Chain) Writable() (WritableProvider, bool) {
+	for _, provider := range chain {
+		if writable, ok := provider.(WritableProvider); ok {
+			return writable, true
+		}
+	}
+	return nil, false
+}
+
+// Parse creates a provider from a comma separated list of specifications:
+//
+//	env:PREFIX  environment variables starting with PREFIX
+//	dir:PATH    one file per secret in the directory PATH
+//	file:PATH   encrypted secrets file at PATH
+//
+// The master key for encrypted files is obtained from the masterKey function,
+// which is only called if needed.
+func Parse(specs string, masterKey func() ([]byte, error)) (Chain, error) {
+	var chain Chain
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		index := strings.Index(spec, ":")
+		if index == -1 {
+			return nil, fmt.Errorf("invalid secrets specification '%s'", spec)
+		}
+		kind, argument := spec[:index], spec[index+1:]
+		switch kind {
+		case "env":
+			chain = append(chain, Env{Prefix: argument})
+		case "dir":
+			chain = append(chain, Directory{Path: argument})
+		case "file":
+			key, err := masterKey()
+			if err != nil {
+				return nil, err
+			}
+			file, err := OpenEncryptedFile(argument, key)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, file)
+		default:
+			return nil, fmt.Errorf("unknown secrets provider '%s'", kind)
+		}
+	}
+	return chain, nil
+}
@@ -0,0 +1,74 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "secrets.json")
+
+	file, err := OpenEncryptedFile(filename, []byte("master"))
+	if err != nil {
+		t.Fatalf("OpenEncryptedFile returned err for missing file: %v", err)
+	}
+	if err := file.SetSecret("influx-password", []byte("hunter2")); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenEncryptedFile(filename, []byte("master"))
+
+	if err != nil {
+		t.Fatalf("OpenEncryptedFile returned err: %v", err)
+	}
+	value, err := reopened.Secret("influx-password")
+	if err != nil || string(value) != "hunter2" {
+		t.Fatalf("expected 'hunter2', actual '%s' (err: %v)", value, err)
+	}
+	if _, err := OpenEncryptedFile(filename, []byte("wrong")); err == nil {
+		t.Fatal("OpenEncryptedFile accepted wrong master key")
+	}
+	data, _ := ioutil.ReadFile(filename)
+	if string(data) == "" || strings.Contains(string(data), "hunter2") {
+		t.Fatal("secrets file contains plaintext secret")
+	}
+}
+
+func TestChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "shredder-key"), []byte("from-dir\n"), 0600)
+	os.Setenv("SECRETS_TEST_SHREDDER_KEY", "from-env")
+	os.Setenv("SECRETS_TEST_KRONOS_KEY", "only-env")
+	defer os.Unsetenv("SECRETS_TEST_SHREDDER_KEY")
+	defer os.Unsetenv("SECRETS_TEST_KRONOS_KEY")
+
+	chain, err := Parse("dir:"+dir+", env:SECRETS_TEST_", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := chain.Secret("shredder-key"); string(value) != "from-dir" {
+		t.Fatalf("expected 'from-dir', actual '%s'", value)
+	}
+	if value, _ := chain.Secret("kronos-key"); string(value) != "only-env" {
+		t.Fatalf("expected 'only-env', actual '%s'", value)
+	}
+	if _, err := chain.Secret("unknown"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, actual %v", err)
+	}
+	if _, err := chain.Secret("../escape"); err == nil {
+		t.Fatal("Directory accepted secret name with path separator")
+	}
+}
@@ -0,0 +1,143 @@
+// Package sensorpayload encodes and decodes the sensor readings that devices
+// send to the server. Readings are encoded either as JSON or in a compact
+// binary TLV format for constrained devices. Both formats can carry several
+// readings per message, each with its own measurement time, so devices can
+// report readings buffered while offline in one batch.
+//
+// Both formats are forward compatible: unknown JSON fields and unknown TLV
+// tags are ignored, so newer devices can add fields without breaking older
+// servers. Missing required fields are still errors.
+package sensorpayload
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+)
+
+// ContentTypeTLV is the content type of the binary TLV format.
+const ContentTypeTLV = "application/x-sensor-tlv"
+
+// Reading is a single measurement of one sensor.
+type Reading struct {
+	// DeviceID is set by gateways that forward readings on behalf of child
+	// devices. It is empty for readings of the sending device itself.
+	DeviceID string  `json:"device_id,omitempty"`
+	SensorID byte    `json:"sensor_id"`
+	Value    float64 `json:"value"`
+	Type     string  `json:"type"`
+	Unit     string  `json:"unit"`
+	// Timestamp is the time of the measurement in nanoseconds since the Unix
+	// epoch. Devices without a synchronized clock can specify the Age instead.
+	// If both are zero, the measurement is assumed to have been taken when the
+	// message was sent.
+	Timestamp int64 `json:"timestamp,omitempty"`
+	// Age is the time in milliseconds between the measurement and sending the
+	// message.
+	Age uint32 `json:"age_ms,omitempty"`
+}
+
+// Time returns the time of the measurement, given the timestamp of the
+// message that carried the reading in nanoseconds.
+func (reading Reading) Time(messageTimestamp int64) time.Time {
+	if reading.Timestamp != 0 {
+		return time.Unix(0, reading.Timestamp)
+	}
+	return time.Unix(0, messageTimestamp).Add(-time.Duration(reading.Age) * time.Millisecond)
+}
+
+// Encode encodes the readings using the given content type, which must be
+// commproto.ContentTypeJSON or ContentTypeTLV.
+func Encode(contentType string, readings []Reading) ([]byte, error) {
+	switch contentType {
+	case commproto.ContentTypeJSON:
+		if len(readings) == 1 {
+			return json.Marshal(readings[0])
+		}
+		return json.Marshal(readings)
+	case ContentTypeTLV:
+		return EncodeTLV(readings)
+	default:
+		return nil, fmt.Errorf("unsupported content type '%s'", contentType)
+	}
+}
+
+// Decode decodes the readings of a message. If the content type is empty, it
+// is detected from the data.
+func Decode(contentType string, data []byte) ([]Reading, error) {
+	if contentType == "" {
+		contentType = DetectContentType(data)
+	}
+	switch contentType {
+	case commproto.ContentTypeJSON:
+		return DecodeJSON(data)
+	case ContentTypeTLV:
+		return DecodeTLV(data)
+	default:
+		return nil, fmt.Errorf("unsupported content type '%s'", contentType)
+	}
+}
+
+// DetectContentType guesses the content type of untyped data. It returns an
+// empty string if the format is unknown.
+func DetectContentType(data []byte) string {
+	if isTLV(data) {
+		return ContentTypeTLV
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return commproto.ContentTypeJSON
+	}
+	return ""
+}
+
+// requiredJSONFields must be present in every JSON encoded reading.
+var requiredJSONFields = []string{"sensor_id", "value", "type", "unit"}
+
+// DecodeJSON decodes either a single reading object or an array of readings.
+// Missing required fields are reported as errors, unknown fields are ignored.
+func DecodeJSON(data []byte) ([]Reading, error) {
+	trimmed := bytes.TrimSpace(data)
+	var objects []json.RawMessage
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &objects); err != nil {
+			return nil, err
+		}
+	} else {
+		objects = []json.RawMessage{trimmed}
+	}
+	if len(objects) == 0 {
+		return nil, errors.New("no readings")
+	}
+
+	readings := make([]Reading, len(objects))
+	for i, object := range objects {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(object, &fields); err != nil {
+			return nil, fmt.Errorf("reading %d: %v", i+1, err)
+		}
+		for _, field := range requiredJSONFields {
+			if _, ok := fields[field]; !ok {
+				return nil, fmt.Errorf("reading %d: missing field '%s'", i+1, field)
+			}
+		}
+		if err := json.Unmarshal(object, &readings[i]); err != nil {
+			return nil, fmt.Errorf("reading %d: %v", i+1, err)
+		}
+	}
+	return readings, nil
+}
+
+// Rejection is sent back to a device as a commproto.MessageError with JSON
+// content if its sensor data was rejected by the server.
+type Rejection struct {
+	// Code is a machine readable reason, e.g. "malformed-payload" or
+	// "invalid-reading".
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// SensorID is the sensor of the rejected reading, if any.
+	SensorID *byte `json:"sensor_id,omitempty"`
+}
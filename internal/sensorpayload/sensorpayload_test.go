@@ -0,0 +1,110 @@
+package sensorpayload
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/commproto"
+)
+
+var testReadings = []Reading{
+	{SensorID: 1, Value: 21.5, Type: "temperature", Unit: "°C"},
+	{SensorID: 2, Value: 21.25, Type: "temperature", Unit: "°C"},
+	{SensorID: 3, Value: 0.1, Type: "humidity", Unit: "%"},
+	{SensorID: 3, Value: 0.2, Type: "humidity", Unit: "%", Age: 10000},
+	{SensorID: 3, Value: 0.3, Type: "humidity", Unit: "%", Timestamp: 1546300800000000000},
+	{DeviceID: "FFFF", SensorID: 1, Value: 19, Type: "temperature", Unit: "°C"},
+	{DeviceID: "FFFF", SensorID: 2, Value: 55, Type: "humidity", Unit: "%"},
+	{SensorID: 1, Value: 20, Type: "temperature", Unit: "°C"},
+}
+
+func TestTLVRoundTrip(t *testing.T) {
+	data, err := EncodeTLV(testReadings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readings, err := Decode("", data)
+
+	if err != nil {
+		t.Fatalf("Decode returned err for valid TLV: %v", err)
+	}
+	if !reflect.DeepEqual(readings, testReadings) {
+		t.Fatalf("expected %+v, actual %+v", testReadings, readings)
+	}
+}
+
+func TestTLVEncoding(t *testing.T) {
+	data, _ := EncodeTLV([]Reading{{SensorID: 7, Value: 1, Type: "t", Unit: "u"}})
+
+	expected := []byte{0xD5, 0x01, 0x01, 0x01, 0x07, 0x02, 0x04, 0x3F, 0x80, 0x00, 0x00, 0x03, 0x01, 't', 0x04, 0x01, 'u'}
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("EncodeTLV: expected (top) vs actual (bottom):\n%x\n%x\n", expected, data)
+	}
+}
+
+func TestDecodeTLVTruncated(t *testing.T) {
+	data, _ := EncodeTLV(testReadings)
+
+	_, err := DecodeTLV(data[:len(data)-1])
+
+	if err == nil {
+		t.Fatal("DecodeTLV failed to report truncated field")
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	single, err := Decode("", []byte(`{"sensor_id": 1, "value": 21.5, "type": "temperature", "unit": "°C"}`))
+	if err != nil || len(single) != 1 || single[0] != testReadings[0] {
+		t.Fatalf("Decode failed for single reading: %+v (err: %v)", single, err)
+	}
+
+	data, _ := Encode(commproto.ContentTypeJSON, testReadings)
+	multiple, err := Decode(commproto.ContentTypeJSON, data)
+	if err != nil || !reflect.DeepEqual(multiple, testReadings) {
+		t.Fatalf("Decode failed for multiple readings: %+v (err: %v)", multiple, err)
+	}
+}
+
+func TestDecodeIgnoresUnknownFields(t *testing.T) {
+	readings, err := Decode("", []byte(`{"sensor_id": 1, "value": 21.5, "type": "temperature", "unit": "°C", "color": "red"}`))
+	if err != nil || len(readings) != 1 || readings[0] != testReadings[0] {
+		t.Fatalf("Decode failed for JSON with unknown field: %+v (err: %v)", readings, err)
+	}
+
+	data := []byte{0xD5, 0x01, 0x01, 0x01, 0x07, 0x02, 0x04, 0x3F, 0x80, 0x00, 0x00, 0x7F, 0x02, 'x', 'y', 0x03, 0x01, 't', 0x04, 0x01, 'u'}
+	readings, err = Decode("", data)
+	if err != nil || len(readings) != 1 || readings[0].Type != "t" {
+		t.Fatalf("Decode failed for TLV with unknown tag: %+v (err: %v)", readings, err)
+	}
+}
+
+func TestReadingTime(t *testing.T) {
+	messageTimestamp := int64(1546300800000000000)
+
+	if actual := (Reading{}).Time(messageTimestamp); actual.UnixNano() != messageTimestamp {
+		t.Fatalf("expected message time, actual %v", actual)
+	}
+	if actual := (Reading{Age: 1500}).Time(messageTimestamp); actual.UnixNano() != messageTimestamp-1500000000 {
+		t.Fatalf("expected message time minus age, actual %v", actual)
+	}
+	if actual := (Reading{Timestamp: 42}).Time(messageTimestamp); actual.UnixNano() != 42 {
+		t.Fatalf("expected reading timestamp, actual %v", actual)
+	}
+}
+
+func TestDecodeRejectsIncompleteReadings(t *testing.T) {
+	invalid := map[string][]byte{
+		"missing value":  []byte(`{"sensor_id": 1, "type": "temperature", "unit": "°C"}`),
+		"empty batch":    []byte(`[]`),
+		"TLV no value":   {0xD5, 0x01, 0x01, 0x01, 0x07, 0x03, 0x01, 't', 0x04, 0x01, 'u'},
+		"TLV no type":    {0xD5, 0x01, 0x01, 0x01, 0x07, 0x02, 0x04, 0x3F, 0x80, 0x00, 0x00},
+		"TLV no reading": {0xD5, 0x01},
+	}
+	for name, data := range invalid {
+		if _, err := Decode("", data); err == nil {
+			t.Errorf("%s: Decode failed to report error", name)
+		}
+	}
+}
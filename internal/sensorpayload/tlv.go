@@ -0,0 +1,185 @@
+package sensorpayload
+
+// This file implements the binary TLV format.
+//
+// A TLV message starts with the two byte header 0xD5 0x01 (magic byte and
+// format version) followed by a sequence of fields. Each field consists of a
+// one byte tag, a one byte length and the value:
+//
+//	tag  length  value
+//	0x01 1       sensor id, starts a new reading
+//	0x02 4 or 8  value as IEEE 754 float32 or float64, big-endian
+//	0x03 0-255   measurement type, UTF-8
+//	0x04 0-255   unit, UTF-8
+//	0x05 8       timestamp in nanoseconds since the Unix epoch, big-endian
+//	0x06 1-4     age in milliseconds before sending, big-endian
+//	0x07 0-255   child device id of a gateway, UTF-8
+//
+// Fields other than the sensor id belong to the reading started by the last
+// sensor id field. Unknown tags are skipped, so newer devices can add fields
+// without breaking older servers. Every reading requires a value. Type, unit
+// and device id may be omitted, in which case they are copied from the
+// previous reading, but the first reading must specify type and unit.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	tlvMagic   = 0xD5
+	tlvVersion = 0x01
+)
+
+const (
+	tagSensorID = 0x01
+	tagValue    = 0x02
+	tagType     = 0x03
+	tagUnit     = 0x04
+	tagTime     = 0x05
+	tagAge      = 0x06
+	tagDeviceID = 0x07
+)
+
+func isTLV(data []byte) bool {
+	return len(data) >= 2 && data[0] == tlvMagic && data[1] == tlvVersion
+}
+
+// EncodeTLV encodes the readings in the binary TLV format. Values are encoded
+// as float32 if that is lossless and as float64 otherwise.
+func EncodeTLV(readings []Reading) ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteByte(tlvMagic)
+	buffer.WriteByte(tlvVersion)
+
+	var previousType, previousUnit, previousDeviceID string
+	for i, reading := range readings {
+		if len(reading.Type) > 255 || len(reading.Unit) > 255 || len(reading.DeviceID) > 255 {
+			return nil, errors.New("type, unit or device id too long")
+		}
+		writeField(&buffer, tagSensorID, []byte{reading.SensorID})
+		if reading.DeviceID != previousDeviceID {
+			writeField(&buffer, tagDeviceID, []byte(reading.DeviceID))
+		}
+		previousDeviceID = reading.DeviceID
+
+		if float64(float32(reading.Value)) == reading.Value {
+			value := make([]byte, 4)
+			binary.BigEndian.PutUint32(value, math.Float32bits(float32(reading.Value)))
+			writeField(&buffer, tagValue, value)
+		} else {
+			value := make([]byte, 8)
+			binary.BigEndian.PutUint64(value, math.Float64bits(reading.Value))
+			writeField(&buffer, tagValue, value)
+		}
+
+		if i == 0 || reading.Type != previousType {
+			writeField(&buffer, tagType, []byte(reading.Type))
+		}
+		if i == 0 || reading.Unit != previousUnit {
+			writeField(&buffer, tagUnit, []byte(reading.Unit))
+		}
+		previousType, previousUnit = reading.Type, reading.Unit
+
+		if reading.Timestamp != 0 {
+			value := make([]byte, 8)
+			binary.BigEndian.PutUint64(value, uint64(reading.Timestamp))
+			writeField(&buffer, tagTime, value)
+		} else if reading.Age != 0 {
+			value := make([]byte, 4)
+			binary.BigEndian.PutUint32(value, reading.Age)
+			writeField(&buffer, tagAge, bytes.TrimLeft(value, "\x00"))
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+func writeField(buffer *bytes.Buffer, tag byte, value []byte) {
+	buffer.WriteByte(tag)
+	buffer.WriteByte(byte(len(value)))
+	buffer.Write(value)
+}
+
+// DecodeTLV decodes readings encoded in the binary TLV format.
+func DecodeTLV(data []byte) ([]Reading, error) {
+	if !isTLV(data) {
+		return nil, errors.New("missing TLV header")
+	}
+
+	var readings []Reading
+	var current *Reading
+	var hasValue []bool
+	rest := data[2:]
+	for len(rest) > 0 {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, errors.New("truncated TLV field")
+		}
+		tag, value := rest[0], rest[2:2+int(rest[1])]
+		rest = rest[2+len(value):]
+
+		if tag == tagSensorID {
+			if len(value) != 1 {
+				return nil, errors.New("invalid sensor id field")
+			}
+			reading := Reading{SensorID: value[0]}
+			if current != nil {
+				reading.Type, reading.Unit, reading.DeviceID = current.Type, current.Unit, current.DeviceID
+			}
+			readings = append(readings, reading)
+			hasValue = append(hasValue, false)
+			current = &readings[len(readings)-1]
+			continue
+		}
+		if current == nil {
+			return nil, fmt.Errorf("field 0x%02x before first sensor id", tag)
+		}
+
+		switch tag {
+		case tagValue:
+			switch len(value) {
+			case 4:
+				current.Value = float64(math.Float32frombits(binary.BigEndian.Uint32(value)))
+			case 8:
+				current.Value = math.Float64frombits(binary.BigEndian.Uint64(value))
+			default:
+				return nil, errors.New("invalid value field")
+			}
+			hasValue[len(hasValue)-1] = true
+		case tagType:
+			current.Type = string(value)
+		case tagUnit:
+			current.Unit = string(value)
+		case tagDeviceID:
+			current.DeviceID = string(value)
+		case tagTime:
+			if len(value) != 8 {
+				return nil, errors.New("invalid timestamp field")
+			}
+			current.Timestamp = int64(binary.BigEndian.Uint64(value))
+		case tagAge:
+			if len(value) == 0 || len(value) > 4 {
+				return nil, errors.New("invalid age field")
+			}
+			current.Age = 0
+			for _, b := range value {
+				current.Age = current.Age<<8 | uint32(b)
+			}
+		}
+	}
+
+	if len(readings) == 0 {
+		return nil, errors.New("no readings")
+	}
+	for i, reading := range readings {
+		if !hasValue[i] {
+			return nil, fmt.Errorf("reading %d: missing value", i+1)
+		}
+		if reading.Type == "" || reading.Unit == "" {
+			return nil, fmt.Errorf("reading %d: missing type or unit", i+1)
+		}
+	}
+	return readings, nil
+}
@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// maxKeptValues limits the values of a bucket that are kept for aggregates
+// that need all of them, e.g. the median.
+const maxKeptValues = 1 << 20
+
+// bucket accumulates the values of one time bucket, which are added in time
+// order.
+type bucket struct {
+	start         int64
+	count         int
+	sum, min, max float64
+	first, last   float64
+	lastAt        int64
+	integral      float64
+	// runningMean and squares, the sum of squared differences from the
+	// mean, are accumulated with Welford's method for the standard deviation.
+	runningMean, squares float64
+	// values are only kept if an aggregate needs all of them.
+	values []float64
+	// mean is kept for the derivative of the following bucket.
+	mean float64
+}
+
+// add adds a value.
+func (b *bucket) add(at int64, value float64, keep bool) {
+	if b.count == 0 {
+		b.first, b.min, b.max = value, value, value
+	} else {
+		b.min = math.Min(b.min, value)
+		b.max = math.Max(b.max, value)
+		b.integral += (value + b.last) / 2 * time.Duration(at-b.lastAt).Seconds()
+	}
+	b.count++
+	b.sum += value
+	difference := value - b.runningMean
+	b.runningMean += difference / float64(b.count)
+	b.squares += difference * (value - b.runningMean)
+	b.last, b.lastAt = value, at
+	if keep {
+		b.values = append(b.values, value)
+	}
+}
+
+// result computes an aggregate of a bucket with data. previous is the last
+// bucket with data before it, if any. Aggregates that have no value are
+// reported as not ok.
+func (b *bucket) result(aggregate Aggregate, previous *bucket) (float64, bool) {
+	n := b.count
+	switch aggregate {
+	case Mean:
+		return b.mean, true
+	case Min:
+		return b.min, true
+	case Max:
+		return b.max, true
+	case Sum:
+		return b.sum, true
+	case Count:
+		return float64(n), true
+	case First:
+		return b.first, true
+	case Last:
+		return b.last, true
+	case Median:
+		if n%2 == 0 {
+			return (b.values[n/2-1] + b.values[n/2]) / 2, true
+		}
+		return b.values[n/2], true
+	case Stddev:
+		if n < 2 {
+			return 0, false
+		}
+		return math.Sqrt(b.squares / float64(n-1)), true
+	case Derivative:
+		if previous == nil {
+			return 0, false
+		}
+		return (b.mean - previous.mean) / time.Duration(b.start-previous.start).Seconds(), true
+	case Integral:
+		return b.integral, true
+	}
+	// Percentiles use the nearest rank like InfluxDB.
+	p, _ := aggregate.percentile()
+	rank := int(math.Floor(float64(n)*p/100+0.5)) - 1
+	if rank < 0 || rank >= n {
+		return 0, false
+	}
+	return b.values[rank], true
+}
+
+// keepsValues tells whether an aggregate needs all values of a bucket.
+func keepsValues(aggregates []Aggregate) bool {
+	for _, aggregate := range aggregates {
+		if _, ok := aggregate.percentile(); ok || aggregate == Median {
+			return true
+		}
+	}
+	return false
+}
+
+// bucketStarts returns the starts of all buckets that overlap the time range
+// of a validated query. Buckets are aligned to the Unix epoch in the location
+// of the query, so e.g. daily buckets start at local midnight.
+func bucketStarts(q Query) []int64 {
+	interval := int64(q.Interval)
+	location := q.Location
+	if location == nil {
+		location = time.UTC
+	}
+	floor := func(t int64) int64 {
+		_, offset := time.Unix(0, t).In(location).Zone()
+		local := t + int64(offset)*int64(time.Second)
+		start := local - local%interval
+		if local%interval < 0 {
+			start -= interval
+		}
+		return start - int64(offset)*int64(time.Second)
+	}
+	end := q.To.UnixNano()
+	starts := []int64{floor(q.From.UnixNano())}
+	for {
+		last := starts[len(starts)-1]
+		next := floor(last + interval)
+		if next <= last {
+			// The bucket is longer than the interval because the
+			// offset of the location changed.
+			next = floor(last + 2*interval)
+		}
+		if next >= end {
+			return starts
+		}
+		starts = append(starts, next)
+	}
+}
+
+// aggregator combines the values of the field of a validated query in its
+// buckets like InfluxDB does: every bucket between From and To is returned
+// unless the fill policy omits it. Values must be added in time order. A bucket
+// is completed as soon as a value of a later bucket is added, so at most the
+// values of one bucket are held in memory.
+type aggregator struct {
+	q           Query
+	keep        bool
+	buckets     []bucket
+	results     []Point
+	withoutData []bool
+	// completed is the number of completed buckets.
+	completed int
+	previous  *bucket
+}
+
+func newAggregator(q Query) *aggregator {
+	starts := bucketStarts(q)
+	a := &aggregator{
+		q:           q,
+		keep:        keepsValues(q.Aggregates),
+		buckets:     make([]bucket, len(starts)),
+		results:     make([]Point, len(starts)),
+		withoutData: make([]bool, len(starts)),
+	}
+	for i, start := range starts {
+		a.buckets[i].start = start
+	}
+	return a
+}
+
+// add adds a value measured at the time in nanoseconds. Values before the
+// current bucket are ignored.
+func (a *aggregator) add(at int64, value float64) error {
+	i := sort.Search(len(a.buckets), func(i int) bool { return a.buckets[i].start > at }) - 1
+	if i < a.completed {
+		return nil
+	}
+	a.complete(i)
+	b := &a.buckets[i]
+	if a.keep && len(b.values) >= maxKeptValues {
+		return fmt.Errorf("more than %d values in a bucket, use a shorter interval", maxKeptValues)
+	}
+	b.add(at, value, a.keep)
+	return nil
+}
+
+// complete computes the aggregates of all buckets before end that are not
+// completed yet.
+func (a *aggregator) complete(end int) {
+	for ; a.completed < end; a.completed++ {
+		i := a.completed
+		b := &a.buckets[i]
+		a.results[i] = Point{Measurement: a.q.Measurement, Tags: Tags{}, Fields: Fields{}, Time: time.Unix(0, b.start)}
+		if b.count == 0 {
+			a.withoutData[i] = true
+			continue
+		}
+		sort.Float64s(b.values)
+		b.mean = b.sum / float64(b.count)
+		for _, aggregate := range a.q.Aggregates {
+			if value, ok := b.result(aggregate, a.previous); ok {
+				a.results[i].Fields[string(aggregate)] = value
+			}
+		}
+		b.values = nil
+		a.previous = b
+	}
+}
+
+// result completes all buckets and returns their aggregates.
+func (a *aggregator) result() []Point {
+	a.complete(len(a.buckets))
+	return fill(a.results, a.withoutData, a.q)
+}
+
+// fill applies the fill policy of the query to the aggregates of buckets
+// without data.
+func fill(points []Point, withoutData []bool, q Query) []Point {
+	switch q.Fill {
+	case FillNone:
+		var result []Point
+		for i, point := range points {
+			if !withoutData[i] {
+				result = append(result, point)
+			}
+		}
+		return result
+	case FillZero:
+		for i, point := range points {
+			if withoutData[i] {
+				for _, aggregate := range q.Aggregates {
+					point.Fields[string(aggregate)] = 0.0
+				}
+			}
+		}
+	case FillPrevious:
+		for i, point := range points {
+			if i > 0 && withoutData[i] {
+				for key, value := range points[i-1].Fields {
+					point.Fields[key] = value
+				}
+			}
+		}
+	case FillLinear:
+		for _, aggregate := range q.Aggregates {
+			key := string(aggregate)
+			last := -1
+			for i, point := range points {
+				value, ok := point.Fields[key].(float64)
+				if !ok {
+					continue
+				}
+				if last >= 0 && i-last > 1 {
+					lastValue := points[last].Fields[key].(float64)
+					for j := last + 1; j < i; j++ {
+						if withoutData[j] {
+							points[j].Fields[key] = lastValue + (value-lastValue)*float64(j-last)/float64(i-last)
+						}
+					}
+				}
+				last = i
+			}
+		}
+	}
+	return points
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func aggregateQuery(fill Fill, aggregates ...Aggregate) Query {
+	return Query{Measurement: "datapoint", From: time.Unix(0, 0), To: time.Unix(240, 0), Aggregates: aggregates, Field: "value", Interval: time.Minute, Fill: fill}
+}
+
+// aggregatePoints aggregates the points, which must be ordered by time.
+func aggregatePoints(t *testing.T, points []Point, q Query) []Point {
+	a := newAggregator(q)
+	for _, point := range points {
+		if err := a.add(point.Time.UnixNano(), point.Fields[q.Field].(float64)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a.result()
+}
+
+func TestAggregates(t *testing.T) {
+	points := []Point{testPoint("a", 0, 1), testPoint("a", 10, 2), testPoint("b", 20, 3), testPoint("a", 30, 10), testPoint("a", 60, 4), testPoint("a", 70, 6)}
+
+	result := aggregatePoints(t, points, aggregateQuery(FillNull, Median, Percentile(25), Stddev, Derivative, Integral, Count))
+
+	if len(result) != 4 {
+		t.Fatalf("expected 4 buckets, actual %d", len(result))
+	}
+	first, second := result[0].Fields, result[1].Fields
+	if first["median"] != 2.5 || first["p25"] != 1.0 || first["count"] != 4.0 {
+		t.Fatalf("unexpected aggregates %v", first)
+	}
+	if _, ok := first["derivative"]; ok {
+		t.Fatalf("first bucket has a derivative %v", first)
+	}
+	// (1+2)/2*10 + (2+3)/2*10 + (3+10)/2*10
+	if first["integral"] != 105.0 {
+		t.Fatalf("unexpected integral %v", first["integral"])
+	}
+	// The mean changes from 4 to 5 in a minute.
+	if second["derivative"] != 1.0/60 || second["stddev"].(float64) < 1.414 || second["stddev"].(float64) > 1.415 {
+		t.Fatalf("unexpected aggregates %v", second)
+	}
+}
+
+func TestFill(t *testing.T) {
+	points := []Point{testPoint("a", 0, 1), testPoint("a", 180, 4)}
+
+	if result := aggregatePoints(t, points, aggregateQuery(FillNone, Mean)); len(result) != 2 {
+		t.Fatalf("expected 2 buckets, actual %d", len(result))
+	}
+	result := aggregatePoints(t, points, aggregateQuery(FillLinear, Mean))
+	if result[1].Fields["mean"] != 2.0 || result[2].Fields["mean"] != 3.0 {
+		t.Fatalf("unexpected interpolation %+v", result)
+	}
+	result = aggregatePoints(t, points, aggregateQuery(FillPrevious, Mean))
+	if result[1].Fields["mean"] != 1.0 || result[2].Fields["mean"] != 1.0 {
+		t.Fatalf("unexpected previous values %+v", result)
+	}
+	result = aggregatePoints(t, points, aggregateQuery(FillZero, Mean))
+	if result[1].Fields["mean"] != 0.0 {
+		t.Fatalf("unexpected zero fill %+v", result)
+	}
+}
+
+func TestBucketsInTimeZone(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("time zone database not available")
+	}
+	// The last Sunday of March 2019 has 23 hours in Berlin.
+	from := time.Date(2019, 3, 30, 12, 0, 0, 0, berlin)
+	q := Query{Measurement: "datapoint", From: from, To: from.Add(72 * time.Hour), Aggregates: []Aggregate{Mean}, Field: "value", Interval: 24 * time.Hour, Location: berlin}
+
+	starts := bucketStarts(q)
+
+	if len(starts) != 4 {
+		t.Fatalf("expected 4 buckets, actual %d", len(starts))
+	}
+	for i, start := range starts {
+		local := time.Unix(0, start).In(berlin)
+		if local.Hour() != 0 || local.Day() != 30+i && local.Day() != i-1 {
+			t.Fatalf("bucket %d starts at %v", i, local)
+		}
+	}
+}
+
+func TestAggregateLimitsKeptValues(t *testing.T) {
+	a := newAggregator(aggregateQuery(FillNull, Median))
+	for i := 0; i < maxKeptValues; i++ {
+		if err := a.add(int64(i), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.add(maxKeptValues, 1); err == nil {
+		t.Fatal("bucket kept more values than allowed")
+	}
+	// Aggregates that need no values are not limited.
+	a = newAggregator(aggregateQuery(FillNull, Mean, Stddev))
+	for i := 0; i <= maxKeptValues; i++ {
+		if err := a.add(int64(i), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if result := a.result(); result[0].Fields["mean"] != 1.0 || result[0].Fields["stddev"] != 0.0 {
+		t.Fatalf("unexpected aggregates %v", result[0].Fields)
+	}
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/iot-bp-project-2018/raspi-server/internal/tsdb"
+)
+
+// Embedded stores points in an embedded time series database in its data
+// directory. Only numeric fields are supported, they are stored as floating
+// point numbers.
+type Embedded struct {
+	db *tsdb.DB
+}
+
+// OpenEmbedded opens the store in the data directory, creating it if
+// necessary.
+func OpenEmbedded(directory string, options Options) (*Embedded, error) {
+	if directory == "" {
+		return nil, fmt.Errorf("embedded: missing data directory")
+	}
+	db, err := tsdb.Open(directory, tsdb.Options{
+		Retention:          options.Retention,
+		DownsampleAfter:    options.DownsampleAfter,
+		DownsampleInterval: options.DownsampleInterval,
+		CompactInterval:    options.CompactInterval,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Embedded{db: db}, nil
+}
+
+// toFloat converts a numeric field value.
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
+
+// Write implements Storage.
+func (s *Embedded) Write(points []Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	converted := make([]tsdb.Point, len(points))
+	for i, point := range points {
+		fields := make(map[string]float64, len(point.Fields))
+		for key, value := range point.Fields {
+			number, ok := toFloat(value)
+			if !ok {
+				return RejectedError{fmt.Errorf("embedded: field '%s' of type %T is not numeric", key, value)}
+			}
+			fields[key] = number
+		}
+		converted[i] = tsdb.Point{Measurement: point.Measurement, Tags: point.Tags, Fields: fields, Time: point.Time}
+	}
+	err := s.db.Write(converted)
+	if _, ok := err.(tsdb.InvalidPointError); ok {
+		return RejectedError{fmt.Errorf("embedded: %v", err)}
+	}
+	return err
+}
+
+// Query implements Storage. Aggregates are computed while the stored values
+// are read, so the raw points are never held in memory.
+func (s *Embedded) Query(q Query) ([]Point, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	if len(q.Aggregates) > 0 {
+		a := newAggregator(q)
+		err := s.db.Scan(q.Measurement, q.Match, q.Field, q.From, q.To, func(values []tsdb.Value) error {
+			for _, value := range values {
+				if err := a.add(value.Time, value.Value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return a.result(), nil
+	}
+	series, err := s.db.Select(q.Measurement, q.Match, q.From, q.To)
+	if err != nil {
+		return nil, err
+	}
+	var points []Point
+	for _, data := range series {
+		for _, sample := range data.Samples {
+			tags := Tags{}
+			for k, v := range data.Tags {
+				tags[k] = v
+			}
+			fields := Fields{}
+			for k, v := range sample.Fields {
+				fields[k] = v
+			}
+			points = append(points, Point{Measurement: data.Measurement, Tags: tags, Fields: fields, Time: sample.Time})
+		}
+	}
+	return points, nil
+}
+
+// Series implements Storage.
+func (s *Embedded) Series(measurement string, match Tags) ([]Tags, error) {
+	var result []Tags
+	for _, tags := range s.db.Series(measurement, match) {
+		result = append(result, Tags(tags))
+	}
+	return result, nil
+}
+
+// First implements Storage.
+func (s *Embedded) First(measurement string, match Tags, from time.Time) (time.Time, bool, error) {
+	first, ok, err := s.db.First(measurement, match, from)
+	if err != nil || !ok {
+		return time.Time{}, false, err
+	}
+	return time.Unix(0, first), true, nil
+}
+
+// Delete implements Storage.
+func (s *Embedded) Delete(measurement string, match Tags, before time.Time) error {
+	return s.db.Delete(measurement, match, before)
+}
+
+// Ping implements Storage.
+func (s *Embedded) Ping() error {
+	return nil
+}
+
+// Close implements Storage.
+func (s *Embedded) Close() error {
+	return s.db.Close()
+}
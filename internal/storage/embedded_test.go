@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func openTestEmbedded(t *testing.T) (*Embedded, string) {
+	dir, err := ioutil.TempDir("", "embedded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	store, err := OpenEmbedded(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, dir
+}
+
+func testPoint(device string, seconds int64, value float64) Point {
+	return Point{Measurement: "datapoint", Tags: Tags{"device": device, "sensor": "1"}, Fields: Fields{"value": value}, Time: time.Unix(seconds, 0)}
+}
+
+func TestEmbeddedAggregate(t *testing.T) {
+	store, _ := openTestEmbedded(t)
+	defer store.Close()
+	store.Write([]Point{testPoint("a", 10, 1), testPoint("a", 20, 3), testPoint("b", 15, 5), testPoint("a", 130, 7)})
+
+	points, err := store.Query(Query{Measurement: "datapoint", Match: Tags{"sensor": "1"}, From: time.Unix(30, 0), To: time.Unix(200, 0), Aggregates: []Aggregate{Mean}, Field: "value", Interval: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 4 {
+		t.Fatalf("expected 4 buckets, actual %d", len(points))
+	}
+	if !points[0].Time.Equal(time.Unix(0, 0)) || len(points[0].Fields) != 0 || len(points[1].Fields) != 0 {
+		t.Fatalf("points outside of the time range were aggregated: %+v", points[:2])
+	}
+	if points[2].Fields["mean"] != 7.0 || len(points[3].Fields) != 0 {
+		t.Fatalf("unexpected buckets %+v", points[2:])
+	}
+
+	points, _ = store.Query(Query{Measurement: "datapoint", From: time.Unix(0, 0), To: time.Unix(60, 0), Aggregates: []Aggregate{Max}, Field: "value", Interval: time.Minute})
+	if len(points) != 1 || points[0].Fields["max"] != 5.0 {
+		t.Fatalf("unexpected maximum %+v", points)
+	}
+}
+
+func TestEmbeddedPersistence(t *testing.T) {
+	store, dir := openTestEmbedded(t)
+	store.Write([]Point{testPoint("a", 10, 1), testPoint("b", 10, 2)})
+	// Overwriting a point replaces its fields.
+	store.Write([]Point{testPoint("a", 10, 4)})
+	if err := store.Delete("datapoint", Tags{"device": "b"}, time.Unix(0, math.MaxInt64)); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	loaded, err := OpenEmbedded(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+
+	points, err := loaded.Query(Query{Measurement: "datapoint", From: time.Unix(0, 0), To: time.Unix(60, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 1 || points[0].Tags["device"] != "a" || points[0].Fields["value"] != 4.0 {
+		t.Fatalf("unexpected points after reload %+v", points)
+	}
+	series, _ := loaded.Series("datapoint", nil)
+	if len(series) != 1 || series[0]["device"] != "a" {
+		t.Fatalf("unexpected series %v", series)
+	}
+}
+
+func TestEmbeddedRejectsInvalidPoints(t *testing.T) {
+	store, _ := openTestEmbedded(t)
+	defer store.Close()
+	if err := store.Write([]Point{{Measurement: "event", Fields: Fields{"text": "x"}, Time: time.Unix(0, 0)}}); !IsRejected(err) {
+		t.Fatal("expected rejection of a string field, got", err)
+	}
+	for _, point := range []Point{
+		{Fields: Fields{"value": 1.0}, Time: time.Unix(0, 0)},
+		{Measurement: "datapoint", Fields: Fields{}, Time: time.Unix(0, 0)},
+		{Measurement: "datapoint", Fields: Fields{"value": math.Inf(1)}, Time: time.Unix(0, 0)},
+	} {
+		if err := store.Write([]Point{point}); !IsRejected(err) {
+			t.Errorf("expected rejection of %+v, got %v", point, err)
+		}
+	}
+}
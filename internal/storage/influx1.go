@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/influxdata/influxdb1-client/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// pingTimeout limits how long Ping waits for the database.
+const pingTimeout = 5 * time.Second
+
+// rejectedWrite matches the errors of InfluxDB 1.x for points it does not
+// accept. The client does not report the status code.
+var rejectedWrite = regexp.MustCompile(`partial write|unable to parse|field type conflict|points beyond retention policy`)
+
+// Influx1 stores points in an InfluxDB 1.x database.
+type Influx1 struct {
+	client   client.Client
+	database string
+}
+
+// NewInflux1 connects to the database with the Database, Username and
+// Password options.
+func NewInflux1(url string, options Options) (*Influx1, error) {
+	if options.Database == "" {
+		return nil, errors.New("influx1: missing database")
+	}
+	c, err := client.NewHTTPClient(client.HTTPConfig{
+		Addr:     url,
+		Username: options.Username,
+		Password: options.Password,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Influx1{client: c, database: options.Database}, nil
+}
+
+// Write implements Storage.
+func (s *Influx1) Write(points []Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{Database: s.database, Precision: "ns"})
+	if err != nil {
+		return err
+	}
+	for _, point := range points {
+		pt, err := client.NewPoint(point.Measurement, point.Tags, point.Fields, point.Time)
+		if err != nil {
+			return err
+		}
+		bp.AddPoint(pt)
+	}
+	err = s.client.Write(bp)
+	if err != nil && rejectedWrite.MatchString(err.Error()) {
+		return RejectedError{err}
+	}
+	return err
+}
+
+// exec runs a statement and returns the rows of its result.
+func (s *Influx1) exec(stmt statement) ([]models.Row, error) {
+	resp, err := s.client.Query(client.Query{Command: stmt.command, Parameters: stmt.parameters, Database: s.database, Precision: "ns"})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error() != nil {
+		return nil, resp.Error()
+	}
+	if len(resp.Results) == 0 {
+		return nil, nil
+	}
+	for _, message := range resp.Results[0].Messages {
+		log.WithFields(log.Fields{"level": message.Level}).Info("InfluxDB: ", message.Text)
+	}
+	return resp.Results[0].Series, nil
+}
+
+// Query implements Storage.
+func (s *Influx1) Query(q Query) ([]Point, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	rows, err := s.exec(selectStatement(q))
+	if err != nil {
+		return nil, err
+	}
+	return parseRows(q.Measurement, rows)
+}
+
+// Series implements Storage.
+func (s *Influx1) Series(measurement string, match Tags) ([]Tags, error) {
+	rows, err := s.exec(seriesStatement(measurement, match))
+	if err != nil {
+		return nil, err
+	}
+	return parseSeries(rows), nil
+}
+
+// First implements Storage.
+func (s *Influx1) First(measurement string, match Tags, from time.Time) (time.Time, bool, error) {
+	rows, err := s.exec(firstStatement(measurement, match, from))
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return parseFirst(measurement, rows)
+}
+
+// Delete implements Storage.
+func (s *Influx1) Delete(measurement string, match Tags, before time.Time) error {
+	_, err := s.exec(deleteStatement(measurement, match, before))
+	return err
+}
+
+// Ping implements Storage.
+func (s *Influx1) Ping() error {
+	_, _, err := s.client.Ping(pingTimeout)
+	return err
+}
+
+// Close implements Storage.
+func (s *Influx1) Close() error {
+	return s.client.Close()
+}
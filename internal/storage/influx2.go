@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/influxdata/influxdb1-client/v2"
+)
+
+// Influx2 stores points in an InfluxDB 2.x bucket. Points are written in line
+// protocol, so any server accepting the /api/v2/write endpoint works. Queries
+// use the InfluxQL compatibility endpoint, which requires a database and
+// retention policy mapping for the bucket.
+type Influx2 struct {
+	url          string
+	token        string
+	organization string
+	bucket       string
+	client       *http.Client
+}
+
+// NewInflux2 connects to the server with the Database (the bucket),
+// Organization and Token options.
+func NewInflux2(url string, options Options) (*Influx2, error) {
+	if options.Database == "" || options.Organization == "" {
+		return nil, errors.New("influx2: missing bucket or organization")
+	}
+	return &Influx2{
+		url:          strings.TrimRight(url, "/"),
+		token:        options.Token,
+		organization: options.Organization,
+		bucket:       options.Database,
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// request sends a request and fails unless the response status is 2xx. The
+// caller must close the body of the response.
+func (s *Influx2) request(method, path string, query url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url+path+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, statusError{resp.StatusCode, fmt.Sprintf("influx2: %s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(message))}
+	}
+	return resp, nil
+}
+
+// statusError is returned by request for responses with an error status.
+type statusError struct {
+	status  int
+	message string
+}
+
+func (e statusError) Error() string {
+	return e.message
+}
+
+func (s *Influx2) bucketQuery() url.Values {
+	return url.Values{"org": {s.organization}, "bucket": {s.bucket}}
+}
+
+// Write implements Storage.
+func (s *Influx2) Write(points []Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	data, err := EncodeLineProtocol(points)
+	if err != nil {
+		return err
+	}
+	query := s.bucketQuery()
+	query.Set("precision", "ns")
+	resp, err := s.request("POST", "/api/v2/write", query, "text/plain; charset=utf-8", bytes.NewReader(data))
+	if failed, ok := err.(statusError); ok {
+		switch failed.status {
+		case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+			return RejectedError{err}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// exec runs an InfluxQL statement and returns the rows of its result.
+func (s *Influx2) exec(stmt statement) ([]models.Row, error) {
+	query := url.Values{"db": {s.bucket}, "epoch": {"ns"}, "q": {stmt.command}}
+	if len(stmt.parameters) > 0 {
+		params, err := json.Marshal(stmt.parameters)
+		if err != nil {
+			return nil, err
+		}
+		query.Set("params", string(params))
+	}
+	resp, err := s.request("GET", "/query", query, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var response client.Response
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&response); err != nil {
+		return nil, err
+	}
+	if response.Error() != nil {
+		return nil, response.Error()
+	}
+	if len(response.Results) == 0 {
+		return nil, nil
+	}
+	return response.Results[0].Series, nil
+}
+
+// Query implements Storage.
+func (s *Influx2) Query(q Query) ([]Point, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	rows, err := s.exec(selectStatement(q))
+	if err != nil {
+		return nil, err
+	}
+	return parseRows(q.Measurement, rows)
+}
+
+// Series implements Storage.
+func (s *Influx2) Series(measurement string, match Tags) ([]Tags, error) {
+	rows, err := s.exec(seriesStatement(measurement, match))
+	if err != nil {
+		return nil, err
+	}
+	return parseSeries(rows), nil
+}
+
+// deletePredicate builds a predicate for the delete endpoint.
+func deletePredicate(measurement string, match Tags) string {
+	quote := func(value string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+	}
+	conditions := []string{"_measurement=" + quote(measurement)}
+	for _, key := range sortedKeys(match) {
+		conditions = append(conditions, key+"="+quote(match[key]))
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// First implements Storage.
+func (s *Influx2) First(measurement string, match Tags, from time.Time) (time.Time, bool, error) {
+	rows, err := s.exec(firstStatement(measurement, match, from))
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return parseFirst(measurement, rows)
+}
+
+// Delete implements Storage. The time range of the delete endpoint includes
+// its stop.
+func (s *Influx2) Delete(measurement string, match Tags, before time.Time) error {
+	body, err := json.Marshal(map[string]string{
+		"start":     time.Unix(0, 0).UTC().Format(time.RFC3339Nano),
+		"stop":      before.Add(-1).UTC().Format(time.RFC3339Nano),
+		"predicate": deletePredicate(measurement, match),
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := s.request("POST", "/api/v2/delete", s.bucketQuery(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Ping implements Storage.
+func (s *Influx2) Ping() error {
+	resp, err := s.request("GET", "/ping", nil, "", nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Close implements Storage.
+func (s *Influx2) Close() error {
+	return nil
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInflux2(t *testing.T) {
+	var written string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v2/write":
+			if r.URL.Query().Get("bucket") != "bp" || r.URL.Query().Get("org") != "home" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			data, _ := ioutil.ReadAll(r.Body)
+			if strings.Contains(string(data), "conflict") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			written = string(data)
+			w.WriteHeader(http.StatusNoContent)
+		case "/query":
+			if r.URL.Query().Get("params") != `{"p0":0,"p1":120000000000}` {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"datapoint","columns":["time","mean"],"values":[[0,1.5],[60000000000,null]]}]}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	store, err := NewInflux2(server.URL, Options{Database: "bp", Organization: "home", Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write([]Point{{Measurement: "datapoint", Tags: Tags{"device": "a"}, Fields: Fields{"value": 1.5}, Time: time.Unix(1, 0)}}); err != nil {
+		t.Fatal(err)
+	}
+	if written != "datapoint,device=a value=1.5 1000000000\n" {
+		t.Fatalf("unexpected line protocol %q", written)
+	}
+	if err := store.Write([]Point{{Measurement: "datapoint", Tags: Tags{"device": "conflict"}, Fields: Fields{"value": 1.5}, Time: time.Unix(1, 0)}}); !IsRejected(err) {
+		t.Fatal("expected rejection, got", err)
+	}
+
+	points, err := store.Query(Query{Measurement: "datapoint", From: time.Unix(0, 0), To: time.Unix(120, 0), Aggregates: []Aggregate{Mean}, Field: "value", Interval: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 || points[0].Fields["mean"] != 1.5 || len(points[1].Fields) != 0 || !points[1].Time.Equal(time.Unix(60, 0)) {
+		t.Fatalf("unexpected points %+v", points)
+	}
+
+	store.token = "wrong"
+	if err := store.Ping(); err == nil {
+		t.Fatal("Ping succeeded with wrong token")
+	}
+}
+
+func TestDeletePredicate(t *testing.T) {
+	predicate := deletePredicate("datapoint", Tags{"sensor": "1", "device": `say "hi"`})
+
+	expected := `_measurement="datapoint" AND device="say \"hi\"" AND sensor="1"`
+	if predicate != expected {
+		t.Fatalf("expected %s, actual %s", expected, predicate)
+	}
+}
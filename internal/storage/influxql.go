@@ -0,0 +1,254 @@
+package storage
+
+// This file builds the InfluxQL statements and parses the results shared by
+// the InfluxDB adapters.
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+// statement is an InfluxQL statement with bound parameters. Values such as
+// tag values and times are only passed as parameters, names cannot be bound
+// and are quoted.
+type statement struct {
+	command    string
+	parameters map[string]interface{}
+}
+
+// parameterBinder collects the bound parameters of a statement.
+type parameterBinder map[string]interface{}
+
+// bind adds a parameter and returns its placeholder.
+func (b parameterBinder) bind(value interface{}) string {
+	name := fmt.Sprintf("p%d", len(b))
+	b[name] = value
+	return "$" + name
+}
+
+// quoteIdentifier quotes a measurement, tag or field name for InfluxQL.
+func quoteIdentifier(name string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(name) + `"`
+}
+
+func sortedKeys(tags Tags) []string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// tagCondition builds a condition that matches all tags.
+func tagCondition(b parameterBinder, tags Tags) string {
+	keys := sortedKeys(tags)
+	conditions := make([]string, len(keys))
+	for i, key := range keys {
+		conditions[i] = fmt.Sprintf("%s = %s", quoteIdentifier(key), b.bind(tags[key]))
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// whereClause returns the WHERE clause for the conditions, which may be empty.
+func whereClause(conditions ...string) string {
+	var nonEmpty []string
+	for _, condition := range conditions {
+		if condition != "" {
+			nonEmpty = append(nonEmpty, condition)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(nonEmpty, " AND ")
+}
+
+// durationLiteral formats a duration in the largest unit that represents it
+// exactly.
+func durationLiteral(d time.Duration) string {
+	for _, unit := range []struct {
+		suffix   string
+		duration time.Duration
+	}{{"s", time.Second}, {"ms", time.Millisecond}, {"u", time.Microsecond}} {
+		if d%unit.duration == 0 {
+			return fmt.Sprintf("%d%s", d/unit.duration, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dns", d)
+}
+
+// aggregateExpression returns the InfluxQL expression of an aggregate.
+func aggregateExpression(aggregate Aggregate, field string) string {
+	switch aggregate {
+	case Derivative:
+		return fmt.Sprintf("derivative(mean(%s), 1s)", quoteIdentifier(field))
+	case Integral:
+		return fmt.Sprintf("integral(%s, 1s)", quoteIdentifier(field))
+	}
+	if p, ok := aggregate.percentile(); ok {
+		return fmt.Sprintf("percentile(%s, %s)", quoteIdentifier(field), strconv.FormatFloat(p, 'f', -1, 64))
+	}
+	return fmt.Sprintf("%s(%s)", aggregate, quoteIdentifier(field))
+}
+
+// fillClause returns the InfluxQL fill option of a fill policy.
+func fillClause(policy Fill) string {
+	switch policy {
+	case FillNone, FillPrevious, FillLinear:
+		return fmt.Sprintf("fill(%s)", policy)
+	case FillZero:
+		return "fill(0)"
+	default:
+		return "fill(null)"
+	}
+}
+
+// selectStatement builds the statement for a validated query. Times are
+// compared in nanoseconds.
+func selectStatement(q Query) statement {
+	b := parameterBinder{}
+	match := tagCondition(b, q.Match)
+	timeRange := fmt.Sprintf("time >= %s AND time < %s", b.bind(q.From.UnixNano()), b.bind(q.To.UnixNano()))
+	where := whereClause(match, timeRange)
+	if len(q.Aggregates) == 0 {
+		return statement{fmt.Sprintf("SELECT * FROM %s%s GROUP BY *", quoteIdentifier(q.Measurement), where), b}
+	}
+	columns := make([]string, len(q.Aggregates))
+	for i, aggregate := range q.Aggregates {
+		columns[i] = aggregateExpression(aggregate, q.Field) + " AS " + quoteIdentifier(string(aggregate))
+	}
+	command := fmt.Sprintf("SELECT %s FROM %s%s GROUP BY time(%s) %s",
+		strings.Join(columns, ", "), quoteIdentifier(q.Measurement), where, durationLiteral(q.Interval), fillClause(q.Fill))
+	// Validate ensures that the location name needs no escaping.
+	if q.Location != nil && q.Location != time.UTC {
+		command += fmt.Sprintf(" tz('%s')", q.Location)
+	}
+	return statement{command, b}
+}
+
+// seriesStatement builds a statement that returns one row per series.
+func seriesStatement(measurement string, match Tags) statement {
+	b := parameterBinder{}
+	return statement{fmt.Sprintf("SELECT last(*) FROM %s%s GROUP BY *", quoteIdentifier(measurement), whereClause(tagCondition(b, match))), b}
+}
+
+// firstStatement builds a statement that returns the earliest matching point
+// at or after from.
+func firstStatement(measurement string, match Tags, from time.Time) statement {
+	b := parameterBinder{}
+	where := whereClause(tagCondition(b, match), "time >= "+b.bind(from.UnixNano()))
+	return statement{fmt.Sprintf("SELECT * FROM %s%s ORDER BY time ASC LIMIT 1", quoteIdentifier(measurement), where), b}
+}
+
+// parseFirst returns the time of the point of a first statement.
+func parseFirst(measurement string, rows []models.Row) (time.Time, bool, error) {
+	points, err := parseRows(measurement, rows)
+	if err != nil || len(points) == 0 {
+		return time.Time{}, false, err
+	}
+	return points[0].Time, true, nil
+}
+
+// deleteStatement builds a statement that deletes the matching points before
+// the time.
+func deleteStatement(measurement string, match Tags, before time.Time) statement {
+	b := parameterBinder{}
+	where := whereClause(tagCondition(b, match), "time < "+b.bind(before.UnixNano()))
+	return statement{fmt.Sprintf("DELETE FROM %s%s", quoteIdentifier(measurement), where), b}
+}
+
+// parseRows converts the rows of a query with nanosecond precision into
+// points. Null values are omitted.
+func parseRows(measurement string, rows []models.Row) ([]Point, error) {
+	var points []Point
+	for _, row := range rows {
+		for _, values := range row.Values {
+			point := Point{Measurement: measurement, Tags: Tags{}, Fields: Fields{}}
+			for key, value := range row.Tags {
+				if value != "" {
+					point.Tags[key] = value
+				}
+			}
+			for i, column := range row.Columns {
+				if i >= len(values) || values[i] == nil {
+					continue
+				}
+				value := values[i]
+				number, isNumber := value.(json.Number)
+				if column == "time" {
+					nanoseconds, err := number.Int64()
+					if !isNumber || err != nil {
+						return nil, fmt.Errorf("unexpected time %v", value)
+					}
+					point.Time = time.Unix(0, nanoseconds)
+					continue
+				}
+				if isNumber {
+					float, err := number.Float64()
+					if err != nil {
+						return nil, err
+					}
+					value = float
+				}
+				point.Fields[column] = value
+			}
+			points = append(points, point)
+		}
+	}
+	return points, nil
+}
+
+// parseSeries returns the tags of the rows of a series statement.
+func parseSeries(rows []models.Row) []Tags {
+	result := make([]Tags, 0, len(rows))
+	for _, row := range rows {
+		tags := Tags{}
+		for key, value := range row.Tags {
+			if value != "" {
+				tags[key] = value
+			}
+		}
+		result = append(result, tags)
+	}
+	return result
+}
+
+// EncodeLineProtocol formats the points in line protocol with nanosecond
+// timestamps, one point per line.
+func EncodeLineProtocol(points []Point) ([]byte, error) {
+	var buffer []byte
+	for _, point := range points {
+		pt, err := models.NewPoint(point.Measurement, models.NewTags(point.Tags), models.Fields(point.Fields), point.Time)
+		if err != nil {
+			return nil, err
+		}
+		buffer = pt.AppendString(buffer)
+		buffer = append(buffer, '\n')
+	}
+	return buffer, nil
+}
+
+// DecodeLineProtocol parses points in line protocol with nanosecond
+// timestamps.
+func DecodeLineProtocol(data []byte) ([]Point, error) {
+	parsed, err := models.ParsePointsWithPrecision(data, time.Now(), "ns")
+	if err != nil {
+		return nil, err
+	}
+	points := make([]Point, len(parsed))
+	for i, pt := range parsed {
+		fields, err := pt.Fields()
+		if err != nil {
+			return nil, err
+		}
+		points[i] = Point{Measurement: string(pt.Name()), Tags: Tags(pt.Tags().Map()), Fields: Fields(fields), Time: pt.Time()}
+	}
+	return points, nil
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+func TestTagCondition(t *testing.T) {
+	b := parameterBinder{}
+
+	condition := tagCondition(b, Tags{"sensor": "1", "device": `it's" OR 1=1`})
+
+	expected := `"device" = $p0 AND "sensor" = $p1`
+	if condition != expected {
+		t.Fatalf("expected %s, actual %s", expected, condition)
+	}
+	if b["p0"] != `it's" OR 1=1` || b["p1"] != "1" {
+		t.Fatalf("unexpected parameters %v", b)
+	}
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	if quoted := quoteIdentifier("a\"b\\c"); quoted != `"a\"b\\c"` {
+		t.Fatalf("unexpected quoted identifier %s", quoted)
+	}
+}
+
+func TestSelectStatement(t *testing.T) {
+	q := Query{
+		Measurement: "datapoint",
+		Match:       Tags{"device": "shredder-2.local"},
+		From:        time.Unix(0, 1000),
+		To:          time.Unix(0, 2000),
+		Aggregates:  []Aggregate{Mean},
+		Field:       "value",
+		Interval:    90 * time.Second,
+	}
+
+	stmt := selectStatement(q)
+
+	expected := `SELECT mean("value") AS "mean" FROM "datapoint" WHERE "device" = $p0 AND time >= $p1 AND time < $p2 GROUP BY time(90s) fill(null)`
+	if stmt.command != expected {
+		t.Fatalf("expected %s, actual %s", expected, stmt.command)
+	}
+	if len(stmt.parameters) != 3 || stmt.parameters["p0"] != "shredder-2.local" || stmt.parameters["p1"] != int64(1000) || stmt.parameters["p2"] != int64(2000) {
+		t.Fatalf("unexpected parameters %v", stmt.parameters)
+	}
+	q.Aggregates = nil
+	expected = `SELECT * FROM "datapoint" WHERE "device" = $p0 AND time >= $p1 AND time < $p2 GROUP BY *`
+	if stmt := selectStatement(q); stmt.command != expected {
+		t.Fatalf("expected %s, actual %s", expected, stmt.command)
+	}
+}
+
+func TestSelectStatementAggregates(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("time zone database not available")
+	}
+	q := Query{
+		Measurement: "datapoint",
+		From:        time.Unix(0, 0),
+		To:          time.Unix(86400, 0),
+		Aggregates:  []Aggregate{Percentile(99.5), Derivative, Integral},
+		Field:       "value",
+		Interval:    time.Hour,
+		Fill:        FillZero,
+		Location:    berlin,
+	}
+
+	stmt := selectStatement(q)
+
+	expected := `SELECT percentile("value", 99.5) AS "p99.5", derivative(mean("value"), 1s) AS "derivative", integral("value", 1s) AS "integral" FROM "datapoint" WHERE time >= $p0 AND time < $p1 GROUP BY time(3600s) fill(0) tz('Europe/Berlin')`
+	if stmt.command != expected {
+		t.Fatalf("expected %s, actual %s", expected, stmt.command)
+	}
+}
+
+func TestParseRows(t *testing.T) {
+	rows := []models.Row{{
+		Name:    "datapoint",
+		Tags:    map[string]string{"device": "shredder", "gateway": "", "sensor": "1"},
+		Columns: []string{"time", "raw", "value"},
+		Values:  [][]interface{}{{json.Number("1546300800000000000"), nil, json.Number("21.5")}},
+	}}
+
+	points, err := parseRows("datapoint", rows)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 1 {
+		t.Fatalf("expected 1 point, actual %d", len(points))
+	}
+	point := points[0]
+	if point.Time.UnixNano() != 1546300800000000000 || point.Fields["value"] != 21.5 || len(point.Fields) != 1 {
+		t.Fatalf("unexpected point %+v", point)
+	}
+	if _, ok := point.Tags["gateway"]; ok || point.Tags["device"] != "shredder" || point.Tags["sensor"] != "1" {
+		t.Fatalf("unexpected tags %v", point.Tags)
+	}
+}
+
+func TestLineProtocol(t *testing.T) {
+	points := []Point{{Measurement: "datapoint", Tags: Tags{"device": "my device", "sensor": "1"}, Fields: Fields{"value": 21.5}, Time: time.Unix(0, 1546300800000000000)}}
+
+	data, err := EncodeLineProtocol(points)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "datapoint,device=my\\ device,sensor=1 value=21.5 1546300800000000000\n"
+	if string(data) != expected {
+		t.Fatalf("expected %q, actual %q", expected, data)
+	}
+	decoded, err := DecodeLineProtocol(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 1 || decoded[0].Tags["device"] != "my device" || decoded[0].Fields["value"] != 21.5 || !decoded[0].Time.Equal(points[0].Time) {
+		t.Fatalf("unexpected decoded points %+v", decoded)
+	}
+}
+
+func TestFirstStatement(t *testing.T) {
+	stmt := firstStatement("datapoint", Tags{"device": "shredder"}, time.Unix(0, 1000))
+
+	expected := `SELECT * FROM "datapoint" WHERE "device" = $p0 AND time >= $p1 ORDER BY time ASC LIMIT 1`
+	if stmt.command != expected {
+		t.Fatalf("expected %s, actual %s", expected, stmt.command)
+	}
+	rows := []models.Row{{Name: "datapoint", Columns: []string{"time", "device", "value"}, Values: [][]interface{}{{json.Number("60000000000"), "shredder", json.Number("1.5")}}}}
+	if first, ok, err := parseFirst("datapoint", rows); err != nil || !ok || !first.Equal(time.Unix(60, 0)) {
+		t.Fatalf("unexpected first point %v, %v, %v", first, ok, err)
+	}
+	if _, ok, _ := parseFirst("datapoint", nil); ok {
+		t.Fatal("found a first point without rows")
+	}
+}
+
+func TestDeleteStatement(t *testing.T) {
+	stmt := deleteStatement("datapoint", Tags{"device": "shredder"}, time.Unix(0, 1000))
+
+	expected := `DELETE FROM "datapoint" WHERE "device" = $p0 AND time < $p1`
+	if stmt.command != expected {
+		t.Fatalf("expected %s, actual %s", expected, stmt.command)
+	}
+	if stmt.parameters["p1"] != int64(1000) {
+		t.Fatalf("unexpected parameters %v", stmt.parameters)
+	}
+}
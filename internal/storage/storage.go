@@ -0,0 +1,253 @@
+// Package storage defines how the server stores and queries time series and
+// provides adapters for InfluxDB 1.x, InfluxDB 2.x and an embedded store that
+// needs no separate database.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tags identify a series within a measurement.
+type Tags map[string]string
+
+// Fields are the values of a point.
+type Fields map[string]interface{}
+
+// Point is a single data point.
+type Point struct {
+	Measurement string
+	Tags        Tags
+	Fields      Fields
+	Time        time.Time
+}
+
+// matches tells whether the tags include all tags of match.
+func (tags Tags) matches(match Tags) bool {
+	for key, value := range match {
+		if tags[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Aggregate is a function that combines the values of a field in a time
+// bucket. Percentiles are named p followed by the percentile, e.g. p95.
+type Aggregate string
+
+// Aggregates
+const (
+	Mean   Aggregate = "mean"
+	Median Aggregate = "median"
+	Min    Aggregate = "min"
+	Max    Aggregate = "max"
+	Sum    Aggregate = "sum"
+	Count  Aggregate = "count"
+	First  Aggregate = "first"
+	Last   Aggregate = "last"
+	// Stddev is the sample standard deviation.
+	Stddev Aggregate = "stddev"
+	// Derivative is the change of the mean per second compared to the
+	// previous bucket with data.
+	Derivative Aggregate = "derivative"
+	// Integral is the area under the values in value-seconds, e.g. energy in
+	// joules from power in watts.
+	Integral Aggregate = "integral"
+)
+
+// Percentile returns the aggregate that selects the value at the percentile
+// p, which is between 0 and 100.
+func Percentile(p float64) Aggregate {
+	return Aggregate("p" + strconv.FormatFloat(p, 'f', -1, 64))
+}
+
+// percentile returns the percentile of a percentile aggregate.
+func (a Aggregate) percentile() (float64, bool) {
+	if !strings.HasPrefix(string(a), "p") {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(string(a[1:]), 64)
+	if err != nil || p < 0 || p > 100 || Percentile(p) != a {
+		return 0, false
+	}
+	return p, true
+}
+
+// Valid tells whether the aggregate is known.
+func (a Aggregate) Valid() bool {
+	switch a {
+	case Mean, Median, Min, Max, Sum, Count, First, Last, Stddev, Derivative, Integral:
+		return true
+	}
+	_, ok := a.percentile()
+	return ok
+}
+
+// Fill determines the values of aggregates in buckets without data.
+type Fill string
+
+// Fill policies
+const (
+	// FillNull leaves the aggregates out. It is the default.
+	FillNull Fill = "null"
+	// FillNone omits buckets without data.
+	FillNone Fill = "none"
+	// FillZero uses 0.
+	FillZero Fill = "zero"
+	// FillPrevious uses the value of the previous bucket.
+	FillPrevious Fill = "previous"
+	// FillLinear interpolates linearly between the surrounding buckets with
+	// data.
+	FillLinear Fill = "linear"
+)
+
+// locationName matches the names of the IANA time zone database.
+var locationName = regexp.MustCompile(`^[A-Za-z0-9_+/-]+$`)
+
+// MaxBuckets is the maximum number of time buckets of an aggregate query.
+const MaxBuckets = 100000
+
+// Query selects the points of one measurement.
+type Query struct {
+	Measurement string
+	// Match selects all series whose tags include these tags.
+	Match Tags
+	// From is inclusive, To exclusive.
+	From, To time.Time
+	// Aggregates combine Field of all selected series in buckets of
+	// Interval, each into a field of the same name. Buckets are aligned to
+	// the Unix epoch in the Location, UTC if it is nil. Without aggregates
+	// the raw points are returned.
+	Aggregates []Aggregate
+	Field      string
+	Interval   time.Duration
+	Fill       Fill
+	Location   *time.Location
+}
+
+// Validate checks the query before it is passed to a backend.
+func (q Query) Validate() error {
+	if q.Measurement == "" {
+		return errors.New("missing measurement")
+	}
+	if !q.To.After(q.From) {
+		return errors.New("empty time range")
+	}
+	if len(q.Aggregates) == 0 {
+		return nil
+	}
+	seen := make(map[Aggregate]bool, len(q.Aggregates))
+	for _, aggregate := range q.Aggregates {
+		if !aggregate.Valid() {
+			return fmt.Errorf("unknown aggregate '%s'", aggregate)
+		}
+		if seen[aggregate] {
+			return fmt.Errorf("duplicate aggregate '%s'", aggregate)
+		}
+		seen[aggregate] = true
+	}
+	switch q.Fill {
+	case "", FillNull, FillNone, FillZero, FillPrevious, FillLinear:
+	default:
+		return fmt.Errorf("unknown fill policy '%s'", q.Fill)
+	}
+	if q.Location != nil && !locationName.MatchString(q.Location.String()) {
+		return fmt.Errorf("invalid time zone '%s'", q.Location)
+	}
+	if q.Field == "" {
+		return errors.New("missing field")
+	}
+	if q.Interval <= 0 {
+		return errors.New("aggregate requires a positive interval")
+	}
+	if q.To.Sub(q.From)/q.Interval > MaxBuckets {
+		return fmt.Errorf("query spans more than %d intervals", MaxBuckets)
+	}
+	return nil
+}
+
+// RejectedError is returned by Write if the storage rejects the points
+// themselves, e.g. because of a field type conflict, so that writing them again
+// fails the same way.
+type RejectedError struct {
+	Err error
+}
+
+func (e RejectedError) Error() string {
+	return e.Err.Error()
+}
+
+// IsRejected tells whether a write failed because the storage rejected the
+// points.
+func IsRejected(err error) bool {
+	_, ok := err.(RejectedError)
+	return ok
+}
+
+// Storage stores points and queries them. Implementations are safe for
+// concurrent use.
+type Storage interface {
+	// Write stores the points. A point with the same measurement, tags and
+	// time as a stored point replaces its fields. Points the storage rejects
+	// cause a RejectedError.
+	Write(points []Point) error
+	// Query returns the raw points ordered by series and time, or one point
+	// per time bucket which holds the aggregates in fields of the same name.
+	// Aggregates without a value, e.g. of buckets without data, are left out.
+	Query(q Query) ([]Point, error)
+	// Series returns the tags of all series of the measurement that include
+	// the tags in match.
+	Series(measurement string, match Tags) ([]Tags, error)
+	// First returns the time of the earliest point at or after from of the
+	// series of the measurement that include the tags in match. ok is false
+	// if there is none.
+	First(measurement string, match Tags, from time.Time) (first time.Time, ok bool, err error)
+	// Delete removes the points before the time of all series of the
+	// measurement that include the tags in match.
+	Delete(measurement string, match Tags, before time.Time) error
+	// Ping checks that the storage is available.
+	Ping() error
+	Close() error
+}
+
+// Options configures the adapters. Each adapter uses only some options.
+type Options struct {
+	// Database is the InfluxDB 1.x database or InfluxDB 2.x bucket.
+	Database     string
+	Username     string
+	Password     string
+	Token        string
+	Organization string
+	// Retention, DownsampleAfter, DownsampleInterval and CompactInterval
+	// configure the embedded store, see tsdb.Options.
+	Retention          time.Duration
+	DownsampleAfter    time.Duration
+	DownsampleInterval time.Duration
+	CompactInterval    time.Duration
+}
+
+// Open creates a storage from a specification of the form kind:argument.
+// Known kinds are influx1 and influx2, whose argument is the URL of the
+// database, and embedded, whose argument is the data directory.
+func Open(spec string, options Options) (Storage, error) {
+	index := strings.Index(spec, ":")
+	if index == -1 {
+		return nil, fmt.Errorf("invalid storage specification '%s'", spec)
+	}
+	kind, argument := spec[:index], spec[index+1:]
+	switch kind {
+	case "influx1":
+		return NewInflux1(argument, options)
+	case "influx2":
+		return NewInflux2(argument, options)
+	case "embedded":
+		return OpenEmbedded(argument, options)
+	default:
+		return nil, fmt.Errorf("unknown storage '%s'", kind)
+	}
+}
@@ -0,0 +1,239 @@
+package tsdb
+
+// This file implements the encoding of blocks. A block holds the samples of
+// one time window, one stream per field of a series. Timestamps are delta
+// encoded and values XORed with their predecessor, which keeps slowly
+// changing readings small, and the whole block is compressed with gzip:
+//
+//	"TSDB1" | resolution | stream count | streams...
+//	stream: series key | field | sample count | times... | values...
+//
+// All numbers are varints, strings are prefixed with their length.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+)
+
+const blockMagic = "TSDB1"
+
+// maxStreamSamples protects against damaged blocks.
+const maxStreamSamples = 1 << 28
+
+// sample is a single value of a field.
+type sample struct {
+	time  int64
+	value float64
+}
+
+// stream is the ordered samples of one field of a series.
+type stream struct {
+	key     string
+	field   string
+	samples []sample
+}
+
+// block is the decoded content of a block file.
+type block struct {
+	// resolution is the downsampling interval in nanoseconds, 0 for raw data.
+	resolution int64
+	streams    []stream
+}
+
+func writeUvarint(w *bufio.Writer, value uint64) {
+	var buffer [binary.MaxVarintLen64]byte
+	w.Write(buffer[:binary.PutUvarint(buffer[:], value)])
+}
+
+func writeVarint(w *bufio.Writer, value int64) {
+	var buffer [binary.MaxVarintLen64]byte
+	w.Write(buffer[:binary.PutVarint(buffer[:], value)])
+}
+
+func writeString(w *bufio.Writer, value string) {
+	writeUvarint(w, uint64(len(value)))
+	w.WriteString(value)
+}
+
+// encode writes the compressed block. Streams are written in order of key and
+// field.
+func (b *block) encode(w io.Writer) error {
+	sort.Slice(b.streams, func(i, j int) bool {
+		if b.streams[i].key != b.streams[j].key {
+			return b.streams[i].key < b.streams[j].key
+		}
+		return b.streams[i].field < b.streams[j].field
+	})
+	compressor := gzip.NewWriter(w)
+	buffered := bufio.NewWriter(compressor)
+	buffered.WriteString(blockMagic)
+	writeUvarint(buffered, uint64(b.resolution))
+	writeUvarint(buffered, uint64(len(b.streams)))
+	for _, s := range b.streams {
+		writeString(buffered, s.key)
+		writeString(buffered, s.field)
+		writeUvarint(buffered, uint64(len(s.samples)))
+		previousTime := int64(0)
+		for _, sample := range s.samples {
+			writeVarint(buffered, sample.time-previousTime)
+			previousTime = sample.time
+		}
+		previousBits := uint64(0)
+		for _, sample := range s.samples {
+			bits := math.Float64bits(sample.value)
+			writeUvarint(buffered, bits^previousBits)
+			previousBits = bits
+		}
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	return compressor.Close()
+}
+
+func readString(r *bufio.Reader) (string, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if length > 1<<16 {
+		return "", errors.New("string too long")
+	}
+	buffer := make([]byte, length)
+	if _, err := io.ReadFull(r, buffer); err != nil {
+		return "", err
+	}
+	return string(buffer), nil
+}
+
+// decodeBlock reads a compressed block.
+func decodeBlock(r io.Reader) (*block, error) {
+	decompressor, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer decompressor.Close()
+	buffered := bufio.NewReader(decompressor)
+	magic := make([]byte, len(blockMagic))
+	if _, err := io.ReadFull(buffered, magic); err != nil || string(magic) != blockMagic {
+		return nil, errors.New("not a block")
+	}
+	resolution, err := binary.ReadUvarint(buffered)
+	if err != nil {
+		return nil, err
+	}
+	count, err := binary.ReadUvarint(buffered)
+	if err != nil {
+		return nil, err
+	}
+	b := &block{resolution: int64(resolution)}
+	for i := uint64(0); i < count; i++ {
+		var s stream
+		if s.key, err = readString(buffered); err != nil {
+			return nil, err
+		}
+		if s.field, err = readString(buffered); err != nil {
+			return nil, err
+		}
+		samples, err := binary.ReadUvarint(buffered)
+		if err != nil {
+			return nil, err
+		}
+		if samples > maxStreamSamples {
+			return nil, fmt.Errorf("stream with %d samples", samples)
+		}
+		s.samples = make([]sample, samples)
+		previousTime := int64(0)
+		for j := range s.samples {
+			delta, err := binary.ReadVarint(buffered)
+			if err != nil {
+				return nil, err
+			}
+			previousTime += delta
+			s.samples[j].time = previousTime
+		}
+		previousBits := uint64(0)
+		for j := range s.samples {
+			xor, err := binary.ReadUvarint(buffered)
+			if err != nil {
+				return nil, err
+			}
+			previousBits ^= xor
+			s.samples[j].value = math.Float64frombits(previousBits)
+		}
+		b.streams = append(b.streams, s)
+	}
+	return b, nil
+}
+
+// readBlock reads a block file.
+func readBlock(filename string) (*block, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	b, err := decodeBlock(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("block '%s': %v", filename, err)
+	}
+	return b, nil
+}
+
+// writeBlock writes a block file atomically.
+func writeBlock(filename string, b *block) error {
+	var buffer bytes.Buffer
+	if err := b.encode(&buffer); err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, buffer.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// downsample replaces the samples of every stream by their mean in buckets of
+// the resolution, timestamped with the start of the bucket.
+func (b *block) downsample(resolution int64) {
+	for i, s := range b.streams {
+		var result []sample
+		var sum float64
+		var count int
+		bucket := int64(math.MinInt64)
+		flush := func() {
+			if count > 0 {
+				result = append(result, sample{time: bucket, value: sum / float64(count)})
+			}
+		}
+		for _, sample := range s.samples {
+			start := floor(sample.time, resolution)
+			if start != bucket {
+				flush()
+				bucket, sum, count = start, 0, 0
+			}
+			sum += sample.value
+			count++
+		}
+		flush()
+		b.streams[i].samples = result
+	}
+	b.resolution = resolution
+}
+
+// floor returns the start of the interval that contains t.
+func floor(t, interval int64) int64 {
+	start := t - t%interval
+	if t%interval < 0 {
+		start -= interval
+	}
+	return start
+}
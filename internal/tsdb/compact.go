@@ -0,0 +1,169 @@
+package tsdb
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// merge adds the samples of a head window to a block. Head samples replace
+// block samples of the same series, field and time.
+func (b *block) merge(window map[string]headSeries) {
+	type streamID struct{ key, field string }
+	values := make(map[streamID]map[int64]float64)
+	for _, s := range b.streams {
+		id := streamID{s.key, s.field}
+		values[id] = make(map[int64]float64, len(s.samples))
+		for _, sample := range s.samples {
+			values[id][sample.time] = sample.value
+		}
+	}
+	for key, series := range window {
+		for t, fields := range series {
+			for field, value := range fields {
+				id := streamID{key, field}
+				if values[id] == nil {
+					values[id] = make(map[int64]float64)
+				}
+				values[id][t] = value
+			}
+		}
+	}
+	b.streams = b.streams[:0]
+	for id, samples := range values {
+		s := stream{key: id.key, field: id.field, samples: make([]sample, 0, len(samples))}
+		for t, value := range samples {
+			s.samples = append(s.samples, sample{time: t, value: value})
+		}
+		sort.Slice(s.samples, func(i, j int) bool { return s.samples[i].time < s.samples[j].time })
+		b.streams = append(b.streams, s)
+	}
+}
+
+// expired tells whether the time window starting at start is past the
+// retention period.
+func (db *DB) expired(start int64, now time.Time) bool {
+	return db.options.Retention > 0 && start+db.blockDuration <= now.Add(-db.options.Retention).UnixNano()
+}
+
+// downsampleDue tells whether the block of the time window starting at start
+// should be downsampled.
+func (db *DB) downsampleDue(start int64, now time.Time) bool {
+	return db.options.DownsampleAfter > 0 && db.options.DownsampleInterval > 0 &&
+		start+db.blockDuration <= now.Add(-db.options.DownsampleAfter).UnixNano()
+}
+
+// Compact moves the points of all time windows that ended before now from the
+// head into blocks, downsamples old blocks and removes expired blocks.
+func (db *DB) Compact(now time.Time) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	// Split the head into completed time windows.
+	windows := make(map[int64]map[string]headSeries)
+	for key, series := range db.head {
+		for t, fields := range series {
+			start := floor(t, db.blockDuration)
+			if start+db.blockDuration > now.UnixNano() {
+				continue
+			}
+			if windows[start] == nil {
+				windows[start] = make(map[string]headSeries)
+			}
+			if windows[start][key] == nil {
+				windows[start][key] = make(headSeries)
+			}
+			windows[start][key][t] = fields
+		}
+	}
+
+	for start, window := range windows {
+		if !db.expired(start, now) {
+			b := &block{}
+			if _, ok := db.blocks[start]; ok {
+				existing, err := readBlock(db.blockFile(start))
+				if err != nil {
+					return err
+				}
+				b = existing
+			}
+			b.merge(window)
+			if db.downsampleDue(start, now) {
+				b.downsample(int64(db.options.DownsampleInterval))
+			}
+			if err := db.replaceBlock(start, b); err != nil {
+				return err
+			}
+		}
+		for key, series := range window {
+			for t := range series {
+				delete(db.head[key], t)
+			}
+			if len(db.head[key]) == 0 {
+				delete(db.head, key)
+			}
+		}
+	}
+
+	for _, info := range db.sortedBlocks() {
+		switch {
+		case db.expired(info.Start, now):
+			if err := db.replaceBlock(info.Start, &block{}); err != nil {
+				return err
+			}
+			log.WithFields(log.Fields{"block": time.Unix(0, info.Start)}).Info("Removed expired block")
+		case info.Resolution == 0 && db.downsampleDue(info.Start, now):
+			b, err := readBlock(db.blockFile(info.Start))
+			if err != nil {
+				return err
+			}
+			b.downsample(int64(db.options.DownsampleInterval))
+			if err := db.replaceBlock(info.Start, b); err != nil {
+				return err
+			}
+			log.WithFields(log.Fields{"block": time.Unix(0, info.Start)}).Info("Downsampled block")
+		}
+	}
+
+	db.pruneSeries()
+	if err := db.saveIndex(); err != nil {
+		return err
+	}
+	return db.rewriteWAL()
+}
+
+// pruneSeries removes series without data from the series index. The caller
+// must hold the write lock.
+func (db *DB) pruneSeries() {
+	used := make(map[string]bool, len(db.series))
+	for key := range db.head {
+		used[key] = true
+	}
+	for _, info := range db.blocks {
+		for _, key := range info.Series {
+			used[key] = true
+		}
+	}
+	for key := range db.series {
+		if !used[key] {
+			delete(db.series, key)
+		}
+	}
+}
+
+func (db *DB) compactPeriodically(interval time.Duration) {
+	defer close(db.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := db.Compact(now); err != nil {
+				log.WithFields(log.Fields{"err": err}).Warn("Compaction failed")
+			}
+		case <-db.stop:
+			return
+		}
+	}
+}
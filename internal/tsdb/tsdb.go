@@ -0,0 +1,701 @@
+// Package tsdb is an embedded time series database, which lets the server run
+// without a separate database.
+//
+// New points are appended to a write-ahead log and kept in memory. Compaction
+// moves the points of every completed time window into an immutable,
+// compressed block file, downsamples old blocks and removes blocks that are
+// older than the retention period. Points may be written to any time window;
+// compaction merges them into the existing block, later points replacing
+// earlier points of the same series and time.
+package tsdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// Files in the data directory
+const (
+	indexFile      = "index.json"
+	walFile        = "wal.log"
+	blockDirectory = "blocks"
+)
+
+// DefaultBlockDuration is the time window of a block if no other is set.
+const DefaultBlockDuration = 24 * time.Hour
+
+// Point is a single data point. Only floating point fields are supported.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]float64
+	Time        time.Time
+}
+
+// Sample holds the fields of a series at one time.
+type Sample struct {
+	Time   time.Time
+	Fields map[string]float64
+}
+
+// Series is the data of one series returned by Select.
+type Series struct {
+	Measurement string
+	Tags        map[string]string
+	Samples     []Sample
+}
+
+// Options configure the database.
+type Options struct {
+	// BlockDuration is the time window of a block. It is fixed when the
+	// database is created.
+	BlockDuration time.Duration
+	// Retention removes blocks that ended more than Retention ago. 0 keeps
+	// all data.
+	Retention time.Duration
+	// DownsampleAfter replaces the samples of blocks that ended more than
+	// DownsampleAfter ago by their mean in intervals of DownsampleInterval.
+	// Downsampling is disabled if either is 0.
+	DownsampleAfter    time.Duration
+	DownsampleInterval time.Duration
+	// CompactInterval is the interval of the background compaction. 0
+	// disables it, Compact must then be called explicitly.
+	CompactInterval time.Duration
+}
+
+// blockInfo describes a block file in the index.
+type blockInfo struct {
+	Start      int64    `json:"start"`
+	Resolution int64    `json:"resolution,omitempty"`
+	Series     []string `json:"series"`
+}
+
+// index is the content of the index file.
+type index struct {
+	BlockDuration int64        `json:"blockDuration"`
+	Blocks        []*blockInfo `json:"blocks"`
+}
+
+type seriesInfo struct {
+	measurement string
+	tags        map[string]string
+}
+
+// matches tells whether the series belongs to the measurement and has all
+// tags of match.
+func (s *seriesInfo) matches(measurement string, match map[string]string) bool {
+	if s.measurement != measurement {
+		return false
+	}
+	for key, value := range match {
+		if s.tags[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// headSeries holds the fields of a series by time.
+type headSeries map[int64]map[string]float64
+
+// walRecord is a line of the write-ahead log.
+type walRecord struct {
+	Key    string             `json:"k"`
+	Time   int64              `json:"t"`
+	Fields map[string]float64 `json:"f"`
+}
+
+// DB is an embedded time series database. It is safe for concurrent use.
+type DB struct {
+	mutex         sync.RWMutex
+	dir           string
+	options       Options
+	blockDuration int64
+	blocks        map[int64]*blockInfo
+	series        map[string]*seriesInfo
+	head          map[string]headSeries
+	wal           *os.File
+	stop          chan struct{}
+	stopped       chan struct{}
+}
+
+// Open opens the database in the directory, creating it if necessary.
+func Open(dir string, options Options) (*DB, error) {
+	if err := os.MkdirAll(filepath.Join(dir, blockDirectory), 0755); err != nil {
+		return nil, err
+	}
+	if options.BlockDuration <= 0 {
+		options.BlockDuration = DefaultBlockDuration
+	}
+	db := &DB{
+		dir:           dir,
+		options:       options,
+		blockDuration: int64(options.BlockDuration),
+		blocks:        make(map[int64]*blockInfo),
+		series:        make(map[string]*seriesInfo),
+		head:          make(map[string]headSeries),
+	}
+	if err := db.loadIndex(); err != nil {
+		return nil, err
+	}
+	if err := db.replay(); err != nil {
+		return nil, err
+	}
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	db.wal = wal
+	if options.CompactInterval > 0 {
+		db.stop, db.stopped = make(chan struct{}), make(chan struct{})
+		go db.compactPeriodically(options.CompactInterval)
+	}
+	return db, nil
+}
+
+func (db *DB) loadIndex() error {
+	data, err := ioutil.ReadFile(filepath.Join(db.dir, indexFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var idx index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return fmt.Errorf("tsdb index: %v", err)
+	}
+	if idx.BlockDuration > 0 {
+		db.blockDuration = idx.BlockDuration
+	}
+	for _, info := range idx.Blocks {
+		db.blocks[info.Start] = info
+		for _, key := range info.Series {
+			db.addSeries(key)
+		}
+	}
+	return nil
+}
+
+// replay restores the head from the write-ahead log. Damaged lines, e.g. a
+// line cut off by a crash, are skipped.
+func (db *DB) replay() error {
+	file, err := os.Open(filepath.Join(db.dir, walFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var record walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || record.Key == "" {
+			log.WithFields(log.Fields{"line": line, "err": err}).Warn("Skipping damaged write-ahead log record")
+			continue
+		}
+		db.insert(record)
+	}
+	return scanner.Err()
+}
+
+// addSeries adds a series to the series index. The caller must hold the write
+// lock.
+func (db *DB) addSeries(key string) {
+	if _, ok := db.series[key]; ok {
+		return
+	}
+	measurement, tags := models.ParseKey([]byte(key))
+	db.series[key] = &seriesInfo{measurement: measurement, tags: tags.Map()}
+}
+
+// insert adds a record to the head. The caller must hold the write lock.
+func (db *DB) insert(record walRecord) {
+	db.addSeries(record.Key)
+	series, ok := db.head[record.Key]
+	if !ok {
+		series = make(headSeries)
+		db.head[record.Key] = series
+	}
+	fields, ok := series[record.Time]
+	if !ok {
+		fields = make(map[string]float64, len(record.Fields))
+		series[record.Time] = fields
+	}
+	for field, value := range record.Fields {
+		fields[field] = value
+	}
+}
+
+// InvalidPointError is returned by Write for points that cannot be stored.
+type InvalidPointError struct {
+	Reason string
+}
+
+func (e InvalidPointError) Error() string {
+	return e.Reason
+}
+
+// Write stores the points. A point replaces the fields it has of a stored
+// point with the same series and time. Nothing is stored if a point is
+// invalid.
+func (db *DB) Write(points []Point) error {
+	records := make([]walRecord, len(points))
+	var buffer []byte
+	for i, point := range points {
+		if point.Measurement == "" {
+			return InvalidPointError{"missing measurement"}
+		}
+		if len(point.Fields) == 0 {
+			return InvalidPointError{"point without fields"}
+		}
+		for field, value := range point.Fields {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return InvalidPointError{fmt.Sprintf("field '%s' is not a finite number", field)}
+			}
+		}
+		records[i] = walRecord{Key: string(models.MakeKey([]byte(point.Measurement), models.NewTags(point.Tags))), Time: point.Time.UnixNano(), Fields: point.Fields}
+		line, err := json.Marshal(records[i])
+		if err != nil {
+			return err
+		}
+		buffer = append(append(buffer, line...), '\n')
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, err := db.wal.Write(buffer); err != nil {
+		return err
+	}
+	for _, record := range records {
+		db.insert(record)
+	}
+	return nil
+}
+
+// matching returns the keys of all series of the measurement that have the
+// tags in match, ordered by key. The caller must hold a lock.
+func (db *DB) matching(measurement string, match map[string]string) []string {
+	var keys []string
+	for key, info := range db.series {
+		if info.matches(measurement, match) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Series returns the tags of all series of the measurement that have the tags
+// in match.
+func (db *DB) Series(measurement string, match map[string]string) []map[string]string {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	var result []map[string]string
+	for _, key := range db.matching(measurement, match) {
+		tags := make(map[string]string)
+		for k, v := range db.series[key].tags {
+			tags[k] = v
+		}
+		result = append(result, tags)
+	}
+	return result
+}
+
+func (db *DB) blockFile(start int64) string {
+	return filepath.Join(db.dir, blockDirectory, fmt.Sprintf("%d.blk", start))
+}
+
+// Select returns the samples of all series of the measurement that have the
+// tags in match between from (inclusive) and to (exclusive).
+func (db *DB) Select(measurement string, match map[string]string, from, to time.Time) ([]Series, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	start, end := from.UnixNano(), to.UnixNano()
+	keys := db.matching(measurement, match)
+	wanted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		wanted[key] = true
+	}
+
+	collected := make(map[string]headSeries)
+	add := func(key string, t int64, field string, value float64) {
+		series, ok := collected[key]
+		if !ok {
+			series = make(headSeries)
+			collected[key] = series
+		}
+		fields, ok := series[t]
+		if !ok {
+			fields = make(map[string]float64)
+			series[t] = fields
+		}
+		fields[field] = value
+	}
+
+	for _, info := range db.sortedBlocks() {
+		if info.Start >= end || info.Start+db.blockDuration <= start || !containsAny(info.Series, wanted) {
+			continue
+		}
+		b, err := readBlock(db.blockFile(info.Start))
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range b.streams {
+			if !wanted[s.key] {
+				continue
+			}
+			first := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].time >= start })
+			for _, sample := range s.samples[first:] {
+				if sample.time >= end {
+					break
+				}
+				add(s.key, sample.time, s.field, sample.value)
+			}
+		}
+	}
+	for _, key := range keys {
+		for t, fields := range db.head[key] {
+			if t >= start && t < end {
+				for field, value := range fields {
+					add(key, t, field, value)
+				}
+			}
+		}
+	}
+
+	var result []Series
+	for _, key := range keys {
+		data, ok := collected[key]
+		if !ok {
+			continue
+		}
+		info := db.series[key]
+		series := Series{Measurement: info.measurement, Tags: make(map[string]string), Samples: make([]Sample, 0, len(data))}
+		for k, v := range info.tags {
+			series.Tags[k] = v
+		}
+		for t, fields := range data {
+			series.Samples = append(series.Samples, Sample{Time: time.Unix(0, t), Fields: fields})
+		}
+		sort.Slice(series.Samples, func(i, j int) bool { return series.Samples[i].Time.Before(series.Samples[j].Time) })
+		result = append(result, series)
+	}
+	return result, nil
+}
+
+// First returns the time of the earliest sample at or after from of all series
+// of the measurement that have the tags in match. ok is false if there is
+// none. Blocks are only read up to the first one with such a sample.
+func (db *DB) First(measurement string, match map[string]string, from time.Time) (first int64, ok bool, err error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	start := from.UnixNano()
+	keys := db.matching(measurement, match)
+	wanted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		wanted[key] = true
+		for t := range db.head[key] {
+			if t >= start && (!ok || t < first) {
+				first, ok = t, true
+			}
+		}
+	}
+	for _, info := range db.sortedBlocks() {
+		if ok && info.Start >= first {
+			break
+		}
+		if info.Start+db.blockDuration <= start || !containsAny(info.Series, wanted) {
+			continue
+		}
+		b, err := readBlock(db.blockFile(info.Start))
+		if err != nil {
+			return 0, false, err
+		}
+		found := false
+		for _, s := range b.streams {
+			if !wanted[s.key] {
+				continue
+			}
+			i := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].time >= start })
+			if i < len(s.samples) && (!ok || s.samples[i].time < first) {
+				first, ok, found = s.samples[i].time, true, true
+			}
+		}
+		if found {
+			break
+		}
+	}
+	return first, ok, nil
+}
+
+// Value is a single value of a field of a series returned by Scan.
+type Value struct {
+	Key   string
+	Time  int64
+	Value float64
+}
+
+// Scan passes the values of a field of all series of the measurement that
+// have the tags in match between from (inclusive) and to (exclusive) to fn,
+// one block window at a time in ascending time order. Only the values of one
+// window are held in memory. fn must not call the database.
+func (db *DB) Scan(measurement string, match map[string]string, field string, from, to time.Time, fn func(values []Value) error) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	start, end := from.UnixNano(), to.UnixNano()
+	keys := db.matching(measurement, match)
+	wanted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		wanted[key] = true
+	}
+
+	type valueID struct {
+		key  string
+		time int64
+	}
+	windows := make(map[int64]bool)
+	head := make(map[int64]map[valueID]float64)
+	for _, key := range keys {
+		for t, fields := range db.head[key] {
+			value, ok := fields[field]
+			if !ok || t < start || t >= end {
+				continue
+			}
+			window := floor(t, db.blockDuration)
+			if head[window] == nil {
+				head[window] = make(map[valueID]float64)
+			}
+			head[window][valueID{key, t}] = value
+			windows[window] = true
+		}
+	}
+	for _, info := range db.blocks {
+		if info.Start < end && info.Start+db.blockDuration > start && containsAny(info.Series, wanted) {
+			windows[info.Start] = true
+		}
+	}
+	starts := make([]int64, 0, len(windows))
+	for window := range windows {
+		starts = append(starts, window)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	for _, window := range starts {
+		collected := make(map[valueID]float64)
+		if info, ok := db.blocks[window]; ok && containsAny(info.Series, wanted) {
+			b, err := readBlock(db.blockFile(window))
+			if err != nil {
+				return err
+			}
+			for _, s := range b.streams {
+				if s.field != field || !wanted[s.key] {
+					continue
+				}
+				first := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].time >= start })
+				for _, sample := range s.samples[first:] {
+					if sample.time >= end {
+						break
+					}
+					collected[valueID{s.key, sample.time}] = sample.value
+				}
+			}
+		}
+		for id, value := range head[window] {
+			collected[id] = value
+		}
+		values := make([]Value, 0, len(collected))
+		for id, value := range collected {
+			values = append(values, Value{Key: id.key, Time: id.time, Value: value})
+		}
+		sort.Slice(values, func(i, j int) bool {
+			if values[i].Time != values[j].Time {
+				return values[i].Time < values[j].Time
+			}
+			return values[i].Key < values[j].Key
+		})
+		if err := fn(values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsAny(keys []string, wanted map[string]bool) bool {
+	for _, key := range keys {
+		if wanted[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedBlocks returns the blocks ordered by time. The caller must hold a
+// lock.
+func (db *DB) sortedBlocks() []*blockInfo {
+	blocks := make([]*blockInfo, 0, len(db.blocks))
+	for _, info := range db.blocks {
+		blocks = append(blocks, info)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Start < blocks[j].Start })
+	return blocks
+}
+
+// Delete removes the samples before the time of all series of the
+// measurement that have the tags in match. Series without samples left are
+// removed.
+func (db *DB) Delete(measurement string, match map[string]string, before time.Time) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	end := before.UnixNano()
+	keys := db.matching(measurement, match)
+	if len(keys) == 0 {
+		return nil
+	}
+	deleted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		deleted[key] = true
+	}
+	for _, info := range db.sortedBlocks() {
+		if info.Start >= end || !containsAny(info.Series, deleted) {
+			continue
+		}
+		b, err := readBlock(db.blockFile(info.Start))
+		if err != nil {
+			return err
+		}
+		streams := b.streams[:0]
+		for _, s := range b.streams {
+			if deleted[s.key] {
+				first := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].time >= end })
+				s.samples = s.samples[first:]
+			}
+			if len(s.samples) > 0 {
+				streams = append(streams, s)
+			}
+		}
+		b.streams = streams
+		if err := db.replaceBlock(info.Start, b); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		for t := range db.head[key] {
+			if t < end {
+				delete(db.head[key], t)
+			}
+		}
+		if len(db.head[key]) == 0 {
+			delete(db.head, key)
+		}
+	}
+	db.pruneSeries()
+	if err := db.saveIndex(); err != nil {
+		return err
+	}
+	return db.rewriteWAL()
+}
+
+// replaceBlock writes the block of a time window and updates the index, or
+// removes the block if it is empty. The caller must hold the write lock and
+// save the index.
+func (db *DB) replaceBlock(start int64, b *block) error {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, s := range b.streams {
+		if !seen[s.key] && len(s.samples) > 0 {
+			seen[s.key] = true
+			keys = append(keys, s.key)
+		}
+	}
+	if len(keys) == 0 {
+		delete(db.blocks, start)
+		if err := os.Remove(db.blockFile(start)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	sort.Strings(keys)
+	if err := writeBlock(db.blockFile(start), b); err != nil {
+		return err
+	}
+	db.blocks[start] = &blockInfo{Start: start, Resolution: b.resolution, Series: keys}
+	return nil
+}
+
+// saveIndex writes the index file atomically. The caller must hold the write
+// lock.
+func (db *DB) saveIndex() error {
+	data, err := json.MarshalIndent(index{BlockDuration: db.blockDuration, Blocks: db.sortedBlocks()}, "", "\t")
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(db.dir, indexFile)
+	if err := ioutil.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// rewriteWAL replaces the write-ahead log by the content of the head. The
+// caller must hold the write lock.
+func (db *DB) rewriteWAL() error {
+	filename := filepath.Join(db.dir, walFile)
+	tmp, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for key, series := range db.head {
+		for t, fields := range series {
+			if err := encoder.Encode(walRecord{Key: key, Time: t, Fields: fields}); err != nil {
+				tmp.Close()
+				return err
+			}
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		return err
+	}
+	wal, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	db.wal.Close()
+	db.wal = wal
+	return nil
+}
+
+// Close stops the background compaction and closes the write-ahead log.
+func (db *DB) Close() error {
+	if db.stop != nil {
+		close(db.stop)
+		<-db.stopped
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.wal.Close()
+}
@@ -0,0 +1,220 @@
+package tsdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+var day0 = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func openTestDB(t *testing.T, options Options) (*DB, string) {
+	dir, err := ioutil.TempDir("", "tsdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := Open(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, dir
+}
+
+func reading(device string, at time.Time, value float64) Point {
+	return Point{Measurement: "datapoint", Tags: map[string]string{"device": device, "sensor": "1"}, Fields: map[string]float64{"value": value}, Time: at}
+}
+
+func selectValues(t *testing.T, db *DB, device string, from, to time.Time) []float64 {
+	series, err := db.Select("datapoint", map[string]string{"device": device}, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []float64
+	for _, s := range series {
+		for _, sample := range s.Samples {
+			values = append(values, sample.Fields["value"])
+		}
+	}
+	return values
+}
+
+func equal(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBlockEncoding(t *testing.T) {
+	b := &block{resolution: 60, streams: []stream{
+		{key: "datapoint,device=a", field: "value", samples: []sample{{-5, 1.5}, {10, 1.5}, {11, math.Pi}}},
+		{key: "datapoint,device=a", field: "raw", samples: []sample{{10, 0}}},
+	}}
+	var buffer bytes.Buffer
+	if err := b.encode(&buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := decodeBlock(&buffer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.resolution != 60 || len(decoded.streams) != 2 {
+		t.Fatalf("unexpected block %+v", decoded)
+	}
+	values := decoded.streams[1]
+	if values.field != "value" || len(values.samples) != 3 || values.samples[0] != (sample{-5, 1.5}) || values.samples[2] != (sample{11, math.Pi}) {
+		t.Fatalf("unexpected stream %+v", values)
+	}
+}
+
+func TestReplayAndCompact(t *testing.T) {
+	db, dir := openTestDB(t, Options{})
+	db.Write([]Point{reading("a", day0.Add(time.Hour), 1), reading("a", day0.Add(25*time.Hour), 2), reading("b", day0, 3)})
+	db.Close()
+
+	db, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if values := selectValues(t, db, "a", day0, day0.Add(48*time.Hour)); !equal(values, []float64{1, 2}) {
+		t.Fatalf("unexpected values after replay %v", values)
+	}
+
+	if err := db.Compact(day0.Add(30 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.blocks) != 1 || len(db.head) != 1 {
+		t.Fatalf("expected one block and one series in head, actual %d and %d", len(db.blocks), len(db.head))
+	}
+	// A late point replaces the compacted one.
+	db.Write([]Point{reading("a", day0.Add(time.Hour), 4)})
+	if values := selectValues(t, db, "a", day0, day0.Add(48*time.Hour)); !equal(values, []float64{4, 2}) {
+		t.Fatalf("unexpected values before merge %v", values)
+	}
+	db.Compact(day0.Add(30 * time.Hour))
+	if values := selectValues(t, db, "a", day0, day0.Add(48*time.Hour)); !equal(values, []float64{4, 2}) {
+		t.Fatalf("unexpected values after merge %v", values)
+	}
+	if series := db.Series("datapoint", nil); len(series) != 2 {
+		t.Fatalf("expected 2 series, actual %v", series)
+	}
+}
+
+func TestRetentionAndDownsampling(t *testing.T) {
+	db, _ := openTestDB(t, Options{Retention: 10 * 24 * time.Hour, DownsampleAfter: 2 * 24 * time.Hour, DownsampleInterval: time.Hour})
+	defer db.Close()
+	db.Write([]Point{
+		reading("a", day0, 1),
+		reading("a", day0.Add(10*time.Minute), 2),
+		reading("a", day0.Add(20*time.Minute), 6),
+		reading("a", day0.Add(4*24*time.Hour), 5),
+	})
+
+	db.Compact(day0.Add(5 * 24 * time.Hour))
+
+	if values := selectValues(t, db, "a", day0, day0.Add(time.Hour)); !equal(values, []float64{3}) {
+		t.Fatalf("expected downsampled mean 3, actual %v", values)
+	}
+	if values := selectValues(t, db, "a", day0.Add(4*24*time.Hour), day0.Add(5*24*time.Hour)); !equal(values, []float64{5}) {
+		t.Fatalf("recent block was changed: %v", values)
+	}
+
+	db.Compact(day0.Add(11 * 24 * time.Hour))
+
+	if values := selectValues(t, db, "a", day0, day0.Add(30*24*time.Hour)); !equal(values, []float64{5}) {
+		t.Fatalf("expired data was not removed: %v", values)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	db, _ := openTestDB(t, Options{})
+	defer db.Close()
+	db.Write([]Point{reading("a", day0, 1), reading("b", day0, 2)})
+	db.Compact(day0.Add(48 * time.Hour))
+	db.Write([]Point{reading("a", day0.Add(24*time.Hour), 3)})
+
+	if err := db.Delete("datapoint", map[string]string{"device": "a"}, day0.Add(48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if values := selectValues(t, db, "a", day0, day0.Add(48*time.Hour)); len(values) != 0 {
+		t.Fatalf("deleted series still has values %v", values)
+	}
+	if values := selectValues(t, db, "b", day0, day0.Add(48*time.Hour)); !equal(values, []float64{2}) {
+		t.Fatalf("unexpected values of remaining series %v", values)
+	}
+
+	// Only samples before the time are deleted.
+	db.Write([]Point{reading("b", day0.Add(2*time.Hour), 4)})
+	if err := db.Delete("datapoint", map[string]string{"device": "b"}, day0.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if values := selectValues(t, db, "b", day0, day0.Add(48*time.Hour)); !equal(values, []float64{4}) {
+		t.Fatalf("unexpected values after deleting the older samples %v", values)
+	}
+	if series := db.Series("datapoint", nil); len(series) != 1 {
+		t.Fatalf("expected 1 series, actual %v", series)
+	}
+}
+
+func TestScan(t *testing.T) {
+	db, _ := openTestDB(t, Options{})
+	defer db.Close()
+	db.Write([]Point{reading("a", day0.Add(2*time.Hour), 1), reading("b", day0.Add(time.Hour), 2), reading("a", day0.Add(25*time.Hour), 3)})
+	db.Compact(day0.Add(48 * time.Hour))
+	// The head replaces a compacted value and adds a later window.
+	db.Write([]Point{reading("a", day0.Add(2*time.Hour), 4), reading("a", day0.Add(49*time.Hour), 5)})
+
+	var windows [][]Value
+	err := db.Scan("datapoint", map[string]string{"sensor": "1"}, "value", day0.Add(time.Hour), day0.Add(72*time.Hour), func(values []Value) error {
+		windows = append(windows, values)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) != 3 || len(windows[0]) != 2 || len(windows[1]) != 1 || len(windows[2]) != 1 {
+		t.Fatalf("unexpected windows %v", windows)
+	}
+	if windows[0][0].Value != 2 || windows[0][1].Value != 4 || windows[1][0].Value != 3 || windows[2][0].Value != 5 {
+		t.Fatalf("unexpected values %v", windows)
+	}
+}
+
+func TestFirst(t *testing.T) {
+	db, _ := openTestDB(t, Options{})
+	defer db.Close()
+	if _, ok, err := db.First("datapoint", nil, day0); ok || err != nil {
+		t.Fatalf("empty database has a first sample: %v", err)
+	}
+	db.Write([]Point{reading("a", day0.Add(25*time.Hour), 1), reading("b", day0.Add(time.Hour), 2), reading("a", day0.Add(26*time.Hour), 3)})
+	db.Compact(day0.Add(48 * time.Hour))
+
+	if first, ok, _ := db.First("datapoint", map[string]string{"device": "a"}, day0); !ok || first != day0.Add(25*time.Hour).UnixNano() {
+		t.Fatalf("unexpected first sample of a compacted series %v", time.Unix(0, first))
+	}
+	// A late point in the head is earlier than the blocks.
+	db.Write([]Point{reading("a", day0.Add(-time.Hour), 4)})
+	if first, ok, _ := db.First("datapoint", map[string]string{"device": "a"}, day0.Add(-24*time.Hour)); !ok || first != day0.Add(-time.Hour).UnixNano() {
+		t.Fatalf("unexpected first sample with a late point %v", time.Unix(0, first))
+	}
+	if first, ok, _ := db.First("datapoint", map[string]string{"device": "a"}, day0.Add(25*time.Hour+1)); !ok || first != day0.Add(26*time.Hour).UnixNano() {
+		t.Fatalf("unexpected first sample after a time %v", time.Unix(0, first))
+	}
+	if _, ok, _ := db.First("datapoint", map[string]string{"device": "b"}, day0.Add(2*time.Hour)); ok {
+		t.Fatal("found a sample after the last one")
+	}
+}
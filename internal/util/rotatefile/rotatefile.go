@@ -0,0 +1,110 @@
+// Package rotatefile provides an append-only file that is rotated once it
+// exceeds a maximum size. Rotated files are renamed to "<path>.1",
+// "<path>.2", ... and only a limited number of them is kept.
+package rotatefile
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// File is an append-only, size-limited file. It is safe for concurrent use.
+type File struct {
+	mutex   sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	file    *os.File
+	size    int64
+}
+
+// Open opens or creates the file at path. The file is rotated before a write
+// would grow it beyond maxSize bytes, keeping at most keep rotated files.
+func Open(path string, maxSize int64, keep int) (*File, error) {
+	f := &File{path: path, maxSize: maxSize, keep: keep}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if necessary.
+func (f *File) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// WriteJSON appends v as a single line of JSON.
+func (f *File) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// rotate renames the current and all rotated files and opens a new file. The
+// caller must hold the mutex.
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	os.Remove(f.rotatedPath(f.keep))
+	for i := f.keep - 1; i >= 1; i-- {
+		os.Rename(f.rotatedPath(i), f.rotatedPath(i+1))
+	}
+	if f.keep > 0 {
+		if err := os.Rename(f.path, f.rotatedPath(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *File) rotatedPath(index int) string {
+	return fmt.Sprintf("%s.%d", f.path, index)
+}
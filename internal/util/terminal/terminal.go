@@ -27,3 +27,7 @@ func Restore(fd int, state *State) error {
 func GetSize(fd int) (width, height int, err error) {
 	return terminal.GetSize(fd)
 }
+
+func ReadPassword(fd int) ([]byte, error) {
+	return terminal.ReadPassword(fd)
+}